@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// writeTarget describes what a write operation changes, so that an
+// ambiguous failure (a timeout or lost connection after sending) can be
+// resolved by reading the target back
+type writeTarget struct {
+	coils   bool
+	address uint16
+	count   uint16
+
+	// applied reports whether the values read back show that the write took
+	// effect; untouched, if not nil, whether they show that it did not
+	applied   func(values []uint16) bool
+	untouched func(values []uint16) bool
+}
+
+// writesValues is the target of a write of absolute values from address,
+// given as they read back
+func writesValues(coils bool, address uint16, written []uint16) writeTarget {
+	written = append([]uint16(nil), written...)
+	return writeTarget{
+		coils:   coils,
+		address: address,
+		count:   uint16(len(written)),
+		applied: func(values []uint16) bool { return equalValues(values, written) },
+	}
+}
+
+// equalValues reports whether a and b hold the same values
+func equalValues(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// notAppliedError is an ambiguous failure that reading back showed did not
+// take effect, so the write may safely be sent again
+type notAppliedError struct {
+	err error
+}
+
+func (e *notAppliedError) Error() string {
+	return e.err.Error() + " (not applied)"
+}
+
+func (e *notAppliedError) Unwrap() error {
+	return e.err
+}
+
+// resolveWrite checks a write that failed with err by reading target back,
+// if the failure leaves it unknown whether the write took effect. It returns
+// nil if it did, a notAppliedError if it did not, and err if the readback
+// cannot tell; in that last case the target is kept in s.pending, so repeat
+// can try again once it has reconnected.
+func (s *session) resolveWrite(err error, target writeTarget) error {
+	if !s.isAmbiguous(err) {
+		return err
+	}
+	applied, untouched, readErr := s.checkTarget(target)
+	switch {
+	case readErr != nil:
+		logWarnf("Cannot tell whether the failed write took effect: %v", readErr)
+		s.pending = &target
+		return err
+	case applied:
+		logWarnf("The write failed (%v), but reading back shows it took effect", err)
+		return nil
+	case untouched:
+		logWarnf("The write failed (%v) and reading back shows it did not take effect", err)
+		return &notAppliedError{err}
+	}
+	logWarnf("Cannot tell whether the failed write took effect: the target was changed otherwise")
+	return err
+}
+
+// checkTarget reads target back and reports whether the write took effect
+// or, as far as that can be told, did not
+func (s *session) checkTarget(target writeTarget) (applied, untouched bool, err error) {
+	values, err := readBackAt(s.client, s.args.ByteOrder, target.coils, target.address, target.count)
+	if err != nil {
+		return false, false, fmt.Errorf("reading back: %w", err)
+	}
+	logDebugf("Read back %v to check the failed write", values)
+	if target.applied(values) {
+		return true, false, nil
+	}
+	return false, target.untouched != nil && target.untouched(values), nil
+}
+
+// resolvePending checks the write of an operation that failed with a lost
+// connection, once the connection is back. A write that took effect turns
+// the failure into a success; one that did not may be sent again. It returns
+// the outcome of the operation: nil, a notAppliedError or err.
+func (s *session) resolvePending(err error) error {
+	target := s.pending
+	s.pending = nil
+	if target == nil {
+		return err
+	}
+	applied, untouched, readErr := s.checkTarget(*target)
+	switch {
+	case readErr != nil:
+		logWarnf("Cannot tell whether the write interrupted by the lost connection took effect: %v", readErr)
+		return err
+	case applied:
+		logWarnf("Reading back shows the write interrupted by the lost connection took effect")
+		s.failed--
+		s.succeeded++
+		s.ambiguous--
+		return nil
+	case untouched:
+		logWarnf("Reading back shows the write interrupted by the lost connection did not take effect")
+		s.ambiguous--
+		return &notAppliedError{err}
+	}
+	return err
+}
+
+// isNotApplied reports whether err is a failure known not to have taken effect
+func isNotApplied(err error) bool {
+	var notApplied *notAppliedError
+	return errors.As(err, &notApplied)
+}
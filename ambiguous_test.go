@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/goburrow/modbus"
+)
+
+func TestResolveWriteApplied(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		run   func(context.Context, *session) error
+		check func(*testServer) bool
+	}{
+		{"write_single_register", []string{"-o", "write_single_register", "--start", "3", "--value", "42"}, writeSingleRegister,
+			func(server *testServer) bool { return server.holding[3] == 42 }},
+		{"write_multiple_coils", []string{"-o", "write_multiple_coils", "--start", "3", "--values", "1,0,1"}, writeMultipleCoils,
+			func(server *testServer) bool { return server.coils[3] && !server.coils[4] && server.coils[5] }},
+		{"mask_write_register", []string{"-o", "mask_write_register", "--start", "3", "--and-mask", "0x00FF", "--or-mask", "0x1200"}, maskWriteRegister,
+			func(server *testServer) bool { return server.holding[3] == 0x1234 }},
+		{"set_bits", []string{"-o", "set_bits", "--start", "3", "--bits", "0"}, modifyBits,
+			func(server *testServer) bool { return server.holding[3] == 0x5635 }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t)
+			server.holding[3] = 0x5634
+			server.dropWrites = true
+			s, out := newTestSession(t, server, test.flags...)
+
+			if err := test.run(context.Background(), s); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if !test.check(server) {
+				t.Errorf("the write was not applied")
+			}
+			// Reading back turns the lost response into a success
+			if s.succeeded != 1 || s.failed != 0 || s.ambiguous != 0 {
+				t.Errorf("succeeded, failed, ambiguous = %d, %d, %d, want 1, 0, 0", s.succeeded, s.failed, s.ambiguous)
+			}
+			if results := testResults(t, out); len(results) != 1 || results[0].Quality != qualityGood {
+				t.Errorf("results = %v, want one GOOD result", results)
+			}
+		})
+	}
+}
+
+func TestResolveWriteNotApplied(t *testing.T) {
+	server := newTestServer(t)
+	server.holding[3] = 0x5634
+	server.discardWrites = true
+	s, _ := newTestSession(t, server, "-o", "toggle_bits", "--start", "3", "--bits", "0", "--retries", "1", "--retry-delay", "0")
+
+	err := modifyBits(context.Background(), s)
+	if !errors.Is(err, errReported) {
+		t.Fatalf("modifyBits = %v, want errReported", err)
+	}
+	if !isNotApplied(s.lastErr) {
+		t.Errorf("error = %v, want a notAppliedError", s.lastErr)
+	}
+	// The toggle is known not to have taken effect, so it is sent again
+	// despite not being idempotent, and no failure is left ambiguous
+	writes := 0
+	for _, functionCode := range server.functionCodes {
+		if functionCode == modbus.FuncCodeWriteSingleRegister {
+			writes++
+		}
+	}
+	if writes != 2 {
+		t.Errorf("sent %d writes, want 2", writes)
+	}
+	if s.failed != 2 || s.ambiguous != 0 {
+		t.Errorf("failed, ambiguous = %d, %d, want 2, 0", s.failed, s.ambiguous)
+	}
+	if server.holding[3] != 0x5634 {
+		t.Errorf("register 3 = 0x%04X, want it unchanged", server.holding[3])
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+)
+
+// Binary log (--format binlog) layout. All integers are little-endian;
+// varints are Go encoding/binary varints (zig-zag LEB128).
+//
+// File header:
+//
+//	magic      4 bytes  "MBLG"
+//	version    uint16   binlogVersion
+//	unit id    uint8
+//	op length  uint8    length of the operation name
+//	operation  bytes    e.g. read_holding_registers
+//	start      int64    Unix time of the header in nanoseconds
+//
+// The header is followed by one block per result:
+//
+//	length     uint32   payload length
+//	payload    records
+//	crc        uint32   CRC-32 (IEEE) of the payload
+//
+// A payload holds one record per value, or a single record carrying the
+// error message of a failed operation:
+//
+//	time       varint   microseconds since the header start time, so every
+//	                    block can be decoded on its own
+//	address    uint16
+//	type       uint8    binlog type code, see below
+//	flags      uint8    binlogFlagBad, binlogFlagClockStep, binlogFlagRetried
+//	value      1, 2, 4 or 8 bytes for numbers (floats as IEEE-754 bits),
+//	                    uvarint length and bytes for strings
+const (
+	binlogMagic   = "MBLG"
+	binlogVersion = 1
+)
+
+// Binlog type codes
+const (
+	binlogBool    = 1
+	binlogUint8   = 2
+	binlogInt16   = 3
+	binlogUint16  = 4
+	binlogInt32   = 5
+	binlogUint32  = 6
+	binlogInt64   = 7
+	binlogUint64  = 8
+	binlogFloat32 = 9
+	binlogFloat64 = 10
+	binlogString  = 11
+)
+
+// binlogValueSizes are the encoded sizes of the fixed-size types
+var binlogValueSizes = map[byte]int{
+	binlogBool: 1, binlogUint8: 1, binlogInt16: 2, binlogUint16: 2, binlogInt32: 4,
+	binlogUint32: 4, binlogInt64: 8, binlogUint64: 8, binlogFloat32: 4, binlogFloat64: 8,
+}
+
+// Binlog record flags
+const (
+	// binlogFlagBad marks the record of a failed operation; its value is the
+	// error message
+	binlogFlagBad = 1 << 0
+	// binlogFlagClockStep marks the first result after a wall clock step
+	binlogFlagClockStep = 1 << 1
+	// binlogFlagRetried marks a result only obtained by retrying the request.
+	// It does not lower the quality of the result, which is still GOOD.
+	binlogFlagRetried = 1 << 2
+)
+
+// binlogWriter writes results to a binary log
+type binlogWriter struct {
+	out     io.Writer
+	clock   clock
+	started time.Time
+}
+
+// newBinlogWriter writes the file header for the session to out. Records are
+// timestamped with clock.
+func newBinlogWriter(out io.Writer, args *ModbusArgs, clock clock) (*binlogWriter, error) {
+	w := &binlogWriter{out: out, clock: clock, started: clock.Now()}
+	header := []byte(binlogMagic)
+	header = binary.LittleEndian.AppendUint16(header, binlogVersion)
+	header = append(header, args.UnitID, byte(len(args.Operation)))
+	header = append(header, args.Operation...)
+	header = binary.LittleEndian.AppendUint64(header, uint64(w.started.UnixNano()))
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// binlogRecord is one decoded record of a binary log
+type binlogRecord struct {
+	Time    time.Time
+	Address uint16
+	Flags   byte
+	Value   interface{}
+}
+
+// writeBlock writes one result as a block of records with the given flags.
+// address returns the address of the i-th value.
+func (w *binlogWriter) writeBlock(values []interface{}, address func(int) int, err error, flags byte) {
+	// Wall clock time, so the log shows the same timestamps as other formats
+	elapsed := w.clock.Now().Round(0).Sub(w.started.Round(0)).Microseconds()
+
+	var payload []byte
+	appendRecord := func(address int, flags byte, value interface{}) {
+		payload = binary.AppendVarint(payload, elapsed)
+		payload = binary.LittleEndian.AppendUint16(payload, uint16(address))
+		payload = appendBinlogValue(payload, flags, value)
+	}
+	if err != nil {
+		appendRecord(address(0), flags|binlogFlagBad, err.Error())
+	}
+	for i, value := range values {
+		appendRecord(address(i), flags, value)
+	}
+
+	block := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+	block = append(block, payload...)
+	block = binary.LittleEndian.AppendUint32(block, crc32.ChecksumIEEE(payload))
+	if _, err := w.out.Write(block); err != nil {
+		logErrorf("Error writing binlog output: %v", err)
+	}
+}
+
+// appendBinlogValue appends the type code, flags and encoded value
+func appendBinlogValue(b []byte, flags byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case bool:
+		var bit byte
+		if v {
+			bit = 1
+		}
+		return append(b, binlogBool, flags, bit)
+	case uint8:
+		return append(b, binlogUint8, flags, v)
+	case int16:
+		return binary.LittleEndian.AppendUint16(append(b, binlogInt16, flags), uint16(v))
+	case uint16:
+		return binary.LittleEndian.AppendUint16(append(b, binlogUint16, flags), v)
+	case int32:
+		return binary.LittleEndian.AppendUint32(append(b, binlogInt32, flags), uint32(v))
+	case uint32:
+		return binary.LittleEndian.AppendUint32(append(b, binlogUint32, flags), v)
+	case int64:
+		return binary.LittleEndian.AppendUint64(append(b, binlogInt64, flags), uint64(v))
+	case uint64:
+		return binary.LittleEndian.AppendUint64(append(b, binlogUint64, flags), v)
+	case float32:
+		return binary.LittleEndian.AppendUint32(append(b, binlogFloat32, flags), math.Float32bits(v))
+	case float64:
+		return binary.LittleEndian.AppendUint64(append(b, binlogFloat64, flags), math.Float64bits(v))
+	}
+	text := fmt.Sprint(value)
+	b = binary.AppendUvarint(append(b, binlogString, flags), uint64(len(text)))
+	return append(b, text...)
+}
+
+// binlogReader reads a binary log written by binlogWriter
+type binlogReader struct {
+	in        *bufio.Reader
+	offset    int64
+	UnitID    byte
+	Operation string
+	Started   time.Time
+}
+
+// errBinlogCRC is returned by readBlock for a block whose payload does not
+// match its checksum. The block is skipped and reading can continue.
+var errBinlogCRC = errors.New("CRC mismatch")
+
+// newBinlogReader reads and checks the file header
+func newBinlogReader(in io.Reader) (*binlogReader, error) {
+	r := &binlogReader{in: bufio.NewReader(in)}
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r.in, header); err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	if string(header[:4]) != binlogMagic {
+		return nil, errors.New("not a binlog file")
+	}
+	if version := binary.LittleEndian.Uint16(header[4:]); version != binlogVersion {
+		return nil, fmt.Errorf("unsupported binlog version %d", version)
+	}
+	r.UnitID = header[6]
+	rest := make([]byte, int(header[7])+8)
+	if _, err := io.ReadFull(r.in, rest); err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	r.Operation = string(rest[:header[7]])
+	r.Started = time.Unix(0, int64(binary.LittleEndian.Uint64(rest[header[7]:])))
+	r.offset = int64(len(header) + len(rest))
+	return r, nil
+}
+
+// readBlock returns the records of the next block, io.EOF at the end of the
+// log, or errBinlogCRC (wrapped with the block offset) for a corrupt block
+func (r *binlogReader) readBlock() ([]binlogRecord, error) {
+	offset := r.offset
+	var length [4]byte
+	if _, err := io.ReadFull(r.in, length[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("block at offset %d: truncated", offset)
+		}
+		return nil, err
+	}
+	block := make([]byte, binary.LittleEndian.Uint32(length[:])+4)
+	if _, err := io.ReadFull(r.in, block); err != nil {
+		return nil, fmt.Errorf("block at offset %d: truncated", offset)
+	}
+	r.offset += int64(len(length) + len(block))
+	payload := block[:len(block)-4]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(block[len(payload):]) {
+		return nil, fmt.Errorf("block at offset %d: %w", offset, errBinlogCRC)
+	}
+
+	var records []binlogRecord
+	for len(payload) > 0 {
+		record, n, err := r.decodeRecord(payload)
+		if err != nil {
+			return nil, fmt.Errorf("block at offset %d: %v", offset, err)
+		}
+		records = append(records, record)
+		payload = payload[n:]
+	}
+	return records, nil
+}
+
+// decodeRecord decodes the record at the start of b and returns its length
+func (r *binlogReader) decodeRecord(b []byte) (binlogRecord, int, error) {
+	var record binlogRecord
+	delta, n := binary.Varint(b)
+	if n <= 0 || len(b) < n+4 {
+		return record, 0, errors.New("malformed record")
+	}
+	record.Time = r.Started.Add(time.Duration(delta) * time.Microsecond)
+	record.Address = binary.LittleEndian.Uint16(b[n:])
+	code, flags := b[n+2], b[n+3]
+	record.Flags = flags
+	b, used := b[n+4:], n+4
+
+	if code == binlogString {
+		length, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < length {
+			return record, 0, errors.New("malformed string value")
+		}
+		record.Value = string(b[n : n+int(length)])
+		return record, used + n + int(length), nil
+	}
+	size, ok := binlogValueSizes[code]
+	if !ok {
+		return record, 0, fmt.Errorf("unknown type code %d", code)
+	}
+	if len(b) < size {
+		return record, 0, errors.New("malformed value")
+	}
+	switch code {
+	case binlogBool:
+		record.Value = b[0] != 0
+	case binlogUint8:
+		record.Value = b[0]
+	case binlogInt16:
+		record.Value = int16(binary.LittleEndian.Uint16(b))
+	case binlogUint16:
+		record.Value = binary.LittleEndian.Uint16(b)
+	case binlogInt32:
+		record.Value = int32(binary.LittleEndian.Uint32(b))
+	case binlogUint32:
+		record.Value = binary.LittleEndian.Uint32(b)
+	case binlogInt64:
+		record.Value = int64(binary.LittleEndian.Uint64(b))
+	case binlogUint64:
+		record.Value = binary.LittleEndian.Uint64(b)
+	case binlogFloat32:
+		record.Value = math.Float32frombits(binary.LittleEndian.Uint32(b))
+	case binlogFloat64:
+		record.Value = math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+	return record, used + size, nil
+}
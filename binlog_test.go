@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBinlogRoundTrip(t *testing.T) {
+	// Every type a result can carry, at the limits of its range
+	values := []interface{}{
+		true, false,
+		uint8(0), uint8(math.MaxUint8),
+		int16(math.MinInt16), int16(-1), int16(math.MaxInt16),
+		uint16(0), uint16(math.MaxUint16),
+		int32(math.MinInt32), int32(math.MaxInt32),
+		uint32(math.MaxUint32),
+		int64(math.MinInt64), int64(math.MaxInt64),
+		uint64(math.MaxUint64),
+		float32(0.1), float32(-math.MaxFloat32), float32(math.SmallestNonzeroFloat32), float32(math.Inf(1)),
+		0.1, -math.MaxFloat64, math.SmallestNonzeroFloat64, math.Inf(-1),
+		"", "pump 3 ⚙",
+	}
+	args := &ModbusArgs{UnitID: 17, Operation: "read_holding_registers"}
+	clock := newFakeClock()
+	var log bytes.Buffer
+	w, err := newBinlogWriter(&log, args, clock)
+	if err != nil {
+		t.Fatalf("newBinlogWriter: %v", err)
+	}
+	address := func(i int) int { return 100 + i }
+	clock.Advance(1500 * time.Millisecond)
+	w.writeBlock(values, address, nil, binlogFlagRetried)
+	clock.Advance(time.Second)
+	w.writeBlock(nil, address, errors.New("i/o timeout"), binlogFlagClockStep)
+
+	r, err := newBinlogReader(&log)
+	if err != nil {
+		t.Fatalf("newBinlogReader: %v", err)
+	}
+	started := newFakeClock().Now()
+	if r.UnitID != 17 || r.Operation != "read_holding_registers" || !r.Started.Equal(started) {
+		t.Errorf("header = %d, %s, %v, want 17, read_holding_registers, %v", r.UnitID, r.Operation, r.Started, started)
+	}
+
+	records, err := r.readBlock()
+	if err != nil {
+		t.Fatalf("readBlock: %v", err)
+	}
+	if len(records) != len(values) {
+		t.Fatalf("got %d records, want %d", len(records), len(values))
+	}
+	for i, record := range records {
+		// The exact type and value come back, so no precision is lost
+		if !reflect.DeepEqual(record.Value, values[i]) {
+			t.Errorf("record %d = %#v, want %#v", i, record.Value, values[i])
+		}
+		if record.Address != uint16(address(i)) || record.Flags != binlogFlagRetried || !record.Time.Equal(started.Add(1500*time.Millisecond)) {
+			t.Errorf("record %d address, flags, time = %d, %d, %v, want %d, %d, 1.5s after the start", i, record.Address, record.Flags, record.Time, address(i), binlogFlagRetried)
+		}
+	}
+
+	records, err = r.readBlock()
+	if err != nil {
+		t.Fatalf("readBlock: %v", err)
+	}
+	want := binlogRecord{Time: records[0].Time, Address: 100, Flags: binlogFlagBad | binlogFlagClockStep, Value: "i/o timeout"}
+	if len(records) != 1 || !reflect.DeepEqual(records[0], want) {
+		t.Errorf("error block = %+v, want %+v", records, want)
+	}
+	if !records[0].Time.Equal(started.Add(2500 * time.Millisecond)) {
+		t.Errorf("error block time = %v, want 2.5s after the start", records[0].Time)
+	}
+	if _, err := r.readBlock(); err != io.EOF {
+		t.Errorf("readBlock at the end = %v, want io.EOF", err)
+	}
+}
+
+func TestBinlogCRC(t *testing.T) {
+	args := &ModbusArgs{UnitID: 1, Operation: "read_coils"}
+	var log bytes.Buffer
+	w, err := newBinlogWriter(&log, args, realClock{})
+	if err != nil {
+		t.Fatalf("newBinlogWriter: %v", err)
+	}
+	address := func(i int) int { return i }
+	w.writeBlock([]interface{}{int16(1)}, address, nil, 0)
+	firstBlockEnd := log.Len()
+	w.writeBlock([]interface{}{int16(2)}, address, nil, 0)
+
+	// Flip a bit of the first value, just before the block's CRC; the
+	// second block still reads
+	data := log.Bytes()
+	data[firstBlockEnd-5] ^= 1
+	r, err := newBinlogReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("newBinlogReader: %v", err)
+	}
+	if _, err := r.readBlock(); !errors.Is(err, errBinlogCRC) {
+		t.Errorf("readBlock of a corrupt block = %v, want errBinlogCRC", err)
+	}
+	records, err := r.readBlock()
+	if err != nil || len(records) != 1 || records[0].Value != int16(2) {
+		t.Errorf("readBlock after a corrupt block = %v, %v, want the value 2", records, err)
+	}
+}
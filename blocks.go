@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// blockTables maps the table names of --block to read operations
+var blockTables = map[string]string{
+	"co": "read_coils",
+	"di": "read_discrete_inputs",
+	"hr": "read_holding_registers",
+	"ir": "read_input_registers",
+}
+
+// pollBlock is one block of coils, inputs or registers polled by --block
+type pollBlock struct {
+	text      string
+	operation string
+	start     uint16
+	count     uint16
+	interval  int
+}
+
+// parseBlock parses a --block of the form TABLE:START:COUNT:INTERVAL, such
+// as hr:0:10:1000, the interval being in milliseconds
+func parseBlock(text string) (pollBlock, error) {
+	fields := strings.Split(text, ":")
+	if len(fields) != 4 {
+		return pollBlock{}, fmt.Errorf("%q is not TABLE:START:COUNT:INTERVAL", text)
+	}
+	block := pollBlock{text: text, operation: blockTables[fields[0]]}
+	if block.operation == "" {
+		return pollBlock{}, fmt.Errorf("%q: unknown table %q (co, di, hr or ir)", text, fields[0])
+	}
+	start, err := strconv.ParseUint(fields[1], 0, 16)
+	if err != nil {
+		return pollBlock{}, fmt.Errorf("%q: invalid start %q", text, fields[1])
+	}
+	count, err := strconv.ParseUint(fields[2], 0, 16)
+	if err != nil || count == 0 {
+		return pollBlock{}, fmt.Errorf("%q: invalid count %q", text, fields[2])
+	}
+	interval, err := strconv.Atoi(fields[3])
+	if err != nil || interval < 0 {
+		return pollBlock{}, fmt.Errorf("%q: invalid interval %q", text, fields[3])
+	}
+	block.start, block.count, block.interval = uint16(start), uint16(count), interval
+	return block, nil
+}
+
+// sharedConnection guards the connection the --block goroutines share.
+// Operations hold it for reading and a reconnect for writing, so the handler
+// is never used while it is being redialled, and a loss seen by several
+// blocks at once is reconnected once: generation counts the reconnects, and
+// a block whose failed operation ran before the latest one just carries on.
+type sharedConnection struct {
+	sync.RWMutex
+	generation int
+}
+
+// pollBlocks polls every --block in its own goroutine, each at its own
+// interval and --repeat times, until all are done or the run is interrupted.
+// The blocks share the session's connection. Its transport lets one request
+// at a time onto the connection, so requests of different blocks queue
+// rather than interleave, and a slow block delays the others. Results are
+// prefixed with their block in text output.
+func pollBlocks(ctx context.Context, s *session) error {
+	sessions := make([]*session, len(s.args.Blocks))
+	errs := make([]error, len(s.args.Blocks))
+	shared := &sharedConnection{}
+	var wg sync.WaitGroup
+	for i, block := range s.args.Blocks {
+		blockArgs := *s.args
+		blockArgs.Blocks = nil
+		blockArgs.Operation, blockArgs.Start, blockArgs.Count, blockArgs.Interval = block.operation, block.start, block.count, block.interval
+		if err := parseOperationValues(&blockArgs); err != nil {
+			return fmt.Errorf("Invalid block %q: %v", block.text, err)
+		}
+		printer := *s.printer
+		printer.args, printer.label = &blockArgs, block.text+": "
+		sessions[i] = &session{args: &blockArgs, handler: s.handler, client: s.client, printer: &printer, started: s.started, stats: s.stats, shared: shared, clock: s.clock}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = runOperation(ctx, sessions[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var failed error
+	for i, bs := range sessions {
+		s.succeeded += bs.succeeded
+		s.failed += bs.failed
+		s.ambiguous += bs.ambiguous
+		if errs[i] != nil && failed == nil {
+			failed = errs[i]
+		}
+	}
+	return failed
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"time"
+)
+
+// clock is the source of time for the timing code: the repeat interval,
+// retry and reconnect delays, request round-trip times, the run summary, the
+// waves written with --pattern, the timestamps of results, reports and binary
+// logs, and the webhook's retry and drain waits. Runs use realClock; tests
+// substitute a fake clock, so timing behaviour can be checked without waiting
+// for it.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the system clock
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clockStepThreshold is how far the wall clock may drift from the monotonic
+// clock between two results before the difference counts as a step
+const clockStepThreshold = time.Second
+
+// clockWatch detects steps of the wall clock, such as NTP corrections, a
+// suspended laptop or a paused VM, by comparing it with the monotonic clock.
+// Intervals, timeouts and durations are all measured on the monotonic clock,
+// so only the timestamps printed with results are affected by a step.
+type clockWatch struct {
+	clock   clock
+	last    time.Time
+	steps   int
+	largest time.Duration
+}
+
+// check returns how far the wall clock stepped since the previous check, or 0
+// if it kept pace with the monotonic clock
+func (c *clockWatch) check() time.Duration {
+	now := c.clock.Now()
+	last := c.last
+	c.last = now
+	if last.IsZero() {
+		return 0
+	}
+
+	// Round(0) strips the monotonic reading, leaving wall clock arithmetic
+	step := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+	if step > -clockStepThreshold && step < clockStepThreshold {
+		return 0
+	}
+	step = step.Round(time.Millisecond)
+	c.steps++
+	if absDuration(step) > absDuration(c.largest) {
+		c.largest = step
+	}
+	logWarnf("Wall clock stepped by %v, timestamps before and after are not comparable", step)
+	return step
+}
+
+// logSummary logs the clock steps seen during the run, if there were any
+func (c *clockWatch) logSummary() {
+	if c.steps > 0 {
+		logWarnf("Clock: %d wall clock steps, largest %v", c.steps, c.largest)
+	}
+}
+
+// absDuration returns the absolute value of d
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
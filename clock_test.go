@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// fakeClock is a clock for tests that only moves when told to. Waiting on
+// After moves it on by the time waited straight away, so timing code runs
+// without delay while the waits are recorded in sleeps.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+// newFakeClock returns a fakeClock set to an arbitrary fixed time
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+	fired := make(chan time.Time, 1)
+	fired <- c.now
+	return fired
+}
+
+// Advance moves the clock on by d
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// waits returns the durations waited on After so far
+func (c *fakeClock) waits() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.sleeps...)
+}
+
+func TestRepeatInterval(t *testing.T) {
+	server := newTestServer(t)
+	server.clock, server.latency = newFakeClock(), 20*time.Millisecond
+	s, out := newTestSession(t, server, "-o", "read_holding_registers", "--count", "1", "--repeat", "3", "--interval", "500")
+
+	if err := performReadOperation(context.Background(), s, modbus.FuncCodeReadHoldingRegisters); err != nil {
+		t.Fatalf("performReadOperation: %v", err)
+	}
+	results := testResults(t, out)
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	// Results are timestamped on the session's clock, as each response arrives
+	for i, offset := range []time.Duration{20 * time.Millisecond, 540 * time.Millisecond, 1060 * time.Millisecond} {
+		if want := s.started.Add(offset).Format(time.RFC3339Nano); results[i].Timestamp != want {
+			t.Errorf("result %d timestamp = %s, want %s", i, results[i].Timestamp, want)
+		}
+	}
+	// The interval follows every attempt but the last
+	if waits := server.clock.waits(); !reflect.DeepEqual(waits, []time.Duration{500 * time.Millisecond, 500 * time.Millisecond}) {
+		t.Errorf("waits = %v, want two of 500ms", waits)
+	}
+	if elapsed := s.clock.Now().Sub(s.started); elapsed != 1060*time.Millisecond {
+		t.Errorf("run took %v, want 1.06s", elapsed)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	server := newTestServer(t)
+	server.clock = newFakeClock()
+	server.exception = modbus.ExceptionCodeServerDeviceBusy
+	s, _ := newTestSession(t, server, "-o", "read_holding_registers", "--count", "1", "--retries", "2", "--retry-delay", "250")
+
+	performReadOperation(context.Background(), s, modbus.FuncCodeReadHoldingRegisters)
+	// A busy device is asked again after each delay, then the read fails
+	if waits := server.clock.waits(); !reflect.DeepEqual(waits, []time.Duration{250 * time.Millisecond, 250 * time.Millisecond}) {
+		t.Errorf("waits = %v, want two of 250ms", waits)
+	}
+	if len(server.functionCodes) != 3 {
+		t.Errorf("sent %d requests, want 3", len(server.functionCodes))
+	}
+}
+
+func TestRetriedReadQuality(t *testing.T) {
+	server := newTestServer(t)
+	server.clock = newFakeClock()
+	server.exception, server.exceptionRequests = modbus.ExceptionCodeServerDeviceBusy, 1
+	server.holding[0] = 7
+	s, out := newTestSession(t, server, "-o", "read_holding_registers", "--count", "1", "--retries", "2", "--retry-delay", "250")
+
+	if err := performReadOperation(context.Background(), s, modbus.FuncCodeReadHoldingRegisters); err != nil {
+		t.Fatalf("performReadOperation: %v", err)
+	}
+	// The retry answered with current values: GOOD, but marked as retried
+	results := testResults(t, out)
+	if len(results) != 1 || results[0].Quality != qualityGood || !results[0].Retried || !reflect.DeepEqual(resultValues(results[0]), []interface{}{7.0}) {
+		t.Errorf("results = %+v, want one retried GOOD result of 7", results)
+	}
+}
+
+func TestRequestTiming(t *testing.T) {
+	server := newTestServer(t)
+	server.clock, server.latency = newFakeClock(), 40*time.Millisecond
+	// 300 registers take three requests, each timed on its own
+	s, _ := newTestSession(t, server, "-o", "read_holding_registers", "--count", "300", "--stats")
+
+	if err := performReadOperation(context.Background(), s, modbus.FuncCodeReadHoldingRegisters); err != nil {
+		t.Fatalf("performReadOperation: %v", err)
+	}
+	want := []time.Duration{40 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond}
+	if !reflect.DeepEqual(s.stats.samples, want) {
+		t.Errorf("samples = %v, want %v", s.stats.samples, want)
+	}
+	if s.requests.Load() != 3 || len(server.functionCodes) != 3 {
+		t.Errorf("counted %d requests, the server got %d, want 3", s.requests.Load(), len(server.functionCodes))
+	}
+}
+
+func TestReportTimestamps(t *testing.T) {
+	clock := newFakeClock()
+	path := filepath.Join(t.TempDir(), "report.md")
+	report, err := openSessionReport(path, &ModbusArgs{Server: "plc", Port: 502, UnitID: 1, Operation: "read_coils"}, clock)
+	if err != nil {
+		t.Fatalf("openSessionReport: %v", err)
+	}
+	clock.Advance(1500 * time.Millisecond)
+	report.addEntry("read_coils", 0, "[1]", nil)
+	clock.Advance(time.Second)
+	report.close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	for _, want := range []string{"# Modbus session 2024-03-01T12:00:00Z", "- `2024-03-01T12:00:01.500Z` **read_coils** @ 0: [1]", "- Duration: 2.5s"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("report lacks %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	var attempts atomic.Int32
+	posted := make(chan struct{}, 2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt only
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		posted <- struct{}{}
+	}))
+	defer receiver.Close()
+	clock := newFakeClock()
+	w := newWebhook(&ModbusArgs{WebhookURL: receiver.URL, WebhookRetries: 2}, clock)
+
+	w.post(jsonResult{Operation: "read_coils"})
+	<-posted
+	<-posted
+	w.close()
+	<-w.done
+	// The retry waited on the clock, not for a second of real time
+	if waits := clock.waits(); len(waits) < 1 || waits[0] != webhookRetryDelay {
+		t.Errorf("waits = %v, want %v first", waits, webhookRetryDelay)
+	}
+	if w.failed.Load() != 0 {
+		t.Errorf("failed = %d, want 0", w.failed.Load())
+	}
+}
+
+func TestWritePatternWave(t *testing.T) {
+	clock := newFakeClock()
+	args := &ModbusArgs{Pattern: "sine", Amplitude: 100, Period: 4 * time.Second, Scale: 1, PatternMin: -32768, PatternMax: 32767}
+	pattern := newWritePattern(args, clock)
+
+	// A quarter period apart, the sine is at its midpoint, top, midpoint and bottom
+	for _, want := range []int64{0, 100, 0, -100} {
+		if got := pattern.values(1)[0]; got != want {
+			t.Errorf("at %v: %d, want %d", clock.Now().Sub(pattern.started), got, want)
+		}
+		clock.Advance(time.Second)
+	}
+}
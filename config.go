@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/spf13/pflag"
+)
+
+// configExclusions are flags that replace one another: a setting is not
+// taken from the config file when one of these was given on the command line
+var configExclusions = map[string][]string{
+	"quiet":       {"log-level"},
+	"log-level":   {"quiet"},
+	"values":      {"values-file", "pattern"},
+	"values-file": {"values", "pattern"},
+	"value":       {"pattern"},
+	"pattern":     {"value", "values", "values-file"},
+	"point":       {"name"},
+	"name":        {"point"},
+}
+
+// applyConfig sets the flags not given on the command line from a JSON
+// config file of the form
+//
+//	{"server": "192.168.1.10", "port": 502, "unitid": 3, "type": "float32", "byteorder": "CDAB"}
+//
+// The keys are the long flag names. A flag given on the command line wins
+// over the file, and the file over the built-in default. That includes a
+// flag given under an alias, such as --datatype for type, and flags it
+// excludes, such as --quiet for log-level. Lists, such as values, may be
+// given as JSON arrays.
+func applyConfig(path string, flags *pflag.FlagSet) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var settings map[string]interface{}
+	if err := decoder.Decode(&settings); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	// Note what the command line set before the settings mark their flags as
+	// changed too
+	given := givenFlags(flags)
+
+	// Apply the settings in a fixed order, so errors are reported consistently
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		flag := flags.Lookup(name)
+		if flag == nil || name == "config" {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		values := []interface{}{settings[name]}
+		if list, ok := settings[name].([]interface{}); ok {
+			values = list
+		}
+		for _, value := range values {
+			if err := flags.Set(name, fmt.Sprint(value)); err != nil {
+				return fmt.Errorf("%s: %s: %v", path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// givenFlags returns the names of the flags given on the command line, with
+// their aliases (flags bound to the same variable) and the flags they exclude
+func givenFlags(flags *pflag.FlagSet) map[string]bool {
+	variables := make(map[uintptr]bool)
+	given := make(map[string]bool)
+	flags.Visit(func(flag *pflag.Flag) {
+		given[flag.Name] = true
+		if variable := flagVariable(flag); variable != 0 {
+			variables[variable] = true
+		}
+		for _, name := range configExclusions[flag.Name] {
+			given[name] = true
+		}
+	})
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if variable := flagVariable(flag); variable != 0 && variables[variable] {
+			given[flag.Name] = true
+		}
+	})
+	return given
+}
+
+// flagVariable returns the address of the variable a flag is bound to, or 0
+// if its value is not a plain pointer to one
+func flagVariable(flag *pflag.Flag) uintptr {
+	value := reflect.ValueOf(flag.Value)
+	if value.Kind() != reflect.Pointer {
+		return 0
+	}
+	return value.Pointer()
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// datatypeRegisters returns the number of registers a value of datatype
+// occupies, or 0 if the datatype is not supported. A string takes as many
+// registers as --count says, so its count stays in registers.
+func datatypeRegisters(datatype string) int {
+	switch datatype {
+	case "int16", "uint16", "bcd", "string":
+		return 1
+	case "int32", "uint32", "float32":
+		return 2
+	case "int64", "uint64", "float64":
+		return 4
+	}
+	return 0
+}
+
+// decodeValue converts one big-endian value of datatype into a Go value. A
+// bcd register holding a nibble above 9 has no value and is an error.
+func decodeValue(word []byte, datatype string) (interface{}, error) {
+	switch datatype {
+	case "uint16":
+		return binary.BigEndian.Uint16(word), nil
+	case "bcd":
+		raw := binary.BigEndian.Uint16(word)
+		if value, ok := decodeBCD(raw); ok {
+			return value, nil
+		}
+		return nil, fmt.Errorf("0x%04X is not valid BCD", raw)
+	case "int32":
+		return int32(binary.BigEndian.Uint32(word)), nil
+	case "uint32":
+		return binary.BigEndian.Uint32(word), nil
+	case "int64":
+		return int64(binary.BigEndian.Uint64(word)), nil
+	case "uint64":
+		return binary.BigEndian.Uint64(word), nil
+	case "float32":
+		return math.Float32frombits(binary.BigEndian.Uint32(word)), nil
+	case "float64":
+		return math.Float64frombits(binary.BigEndian.Uint64(word)), nil
+	}
+	return int16(binary.BigEndian.Uint16(word)), nil
+}
+
+// encodeValue parses text as a value of datatype and returns it big-endian
+// together with the parsed value
+func encodeValue(text, datatype string) ([]byte, interface{}, error) {
+	text = strings.TrimSpace(text)
+	switch datatype {
+	case "int16":
+		n, err := parseSigned(text, 16)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s is not a valid int16", text)
+		}
+		return binary.BigEndian.AppendUint16(nil, uint16(n)), int16(n), nil
+	case "uint16":
+		n, err := strconv.ParseUint(text, 0, 16)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s is not a valid uint16", text)
+		}
+		return binary.BigEndian.AppendUint16(nil, uint16(n)), uint16(n), nil
+	case "bcd":
+		n, err := strconv.ParseUint(text, 0, 16)
+		if err != nil || n > 9999 {
+			return nil, nil, fmt.Errorf("%s does not fit in 4 BCD digits", text)
+		}
+		return binary.BigEndian.AppendUint16(nil, encodeBCD(uint16(n))), uint16(n), nil
+	case "int32":
+		n, err := parseSigned(text, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s is not a valid int32", text)
+		}
+		return binary.BigEndian.AppendUint32(nil, uint32(n)), int32(n), nil
+	case "uint32":
+		n, err := strconv.ParseUint(text, 0, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s is not a valid uint32", text)
+		}
+		return binary.BigEndian.AppendUint32(nil, uint32(n)), uint32(n), nil
+	case "int64":
+		n, err := parseSigned(text, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s is not a valid int64", text)
+		}
+		return binary.BigEndian.AppendUint64(nil, uint64(n)), n, nil
+	case "uint64":
+		n, err := strconv.ParseUint(text, 0, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s is not a valid uint64", text)
+		}
+		return binary.BigEndian.AppendUint64(nil, n), n, nil
+	case "float32":
+		f, err := strconv.ParseFloat(text, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s is not a valid float32", text)
+		}
+		return binary.BigEndian.AppendUint32(nil, math.Float32bits(float32(f))), float32(f), nil
+	case "float64":
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s is not a valid float64", text)
+		}
+		return binary.BigEndian.AppendUint64(nil, math.Float64bits(f)), f, nil
+	}
+	return nil, nil, fmt.Errorf("cannot encode values of type %s", datatype)
+}
+
+// parseSigned parses text as a signed integer of bitSize bits. Hex and binary
+// literals spell out the bits, as they do for untyped register values, so
+// 0xFFFF is -1 as an int16.
+func parseSigned(text string, bitSize int) (int64, error) {
+	if prefix := strings.ToLower(text); strings.HasPrefix(prefix, "0x") || strings.HasPrefix(prefix, "0b") {
+		n, err := strconv.ParseUint(text, 0, bitSize)
+		if err != nil {
+			return 0, err
+		}
+		// Move the value's sign bit to the top, then shift it back in
+		shift := 64 - bitSize
+		return int64(n<<shift) >> shift, nil
+	}
+	return strconv.ParseInt(text, 0, bitSize)
+}
+
+// decodeBCD decodes a register holding four packed BCD digits, so 0x1234 is
+// 1234. ok is false if a nibble is above 9.
+func decodeBCD(raw uint16) (value uint16, ok bool) {
+	for shift := 12; shift >= 0; shift -= 4 {
+		digit := raw >> shift & 0xF
+		if digit > 9 {
+			return 0, false
+		}
+		value = value*10 + digit
+	}
+	return value, true
+}
+
+// encodeBCD packs a value up to 9999 into four BCD digits
+func encodeBCD(value uint16) uint16 {
+	var raw uint16
+	for shift := 0; shift < 16; shift += 4 {
+		raw |= value % 10 << shift
+		value /= 10
+	}
+	return raw
+}
+
+// decodeString decodes registers holding two ASCII characters each, high
+// byte first unless swap is set. Trailing NULs and spaces are trimmed and
+// other non-printable bytes escaped as \xNN, so they cannot upset a terminal.
+func decodeString(data []byte, swap bool) string {
+	chars := make([]byte, 0, len(data))
+	for _, word := range splitWords(data, registerSize, "ABCD") {
+		if swap {
+			word[0], word[1] = word[1], word[0]
+		}
+		chars = append(chars, word...)
+	}
+	var text strings.Builder
+	for _, c := range bytes.TrimRight(chars, "\x00 ") {
+		if c < 0x20 || c > 0x7E {
+			fmt.Fprintf(&text, "\\x%02X", c)
+		} else {
+			text.WriteByte(c)
+		}
+	}
+	return text.String()
+}
+
+// encodeString is the inverse of decodeString: it packs text into registers
+// of two characters each, padding the final register with a NUL
+func encodeString(text string, swap bool) []byte {
+	data := []byte(text)
+	if len(data)%registerSize != 0 {
+		data = append(data, 0)
+	}
+	if swap {
+		for i := 0; i < len(data); i += registerSize {
+			data[i], data[i+1] = data[i+1], data[i]
+		}
+	}
+	return data
+}
+
+// toFloat64 converts a decoded value to float64. float32 values keep their
+// shortest decimal form, so 0.1 stays 0.1 rather than 0.10000000149011612.
+func toFloat64(value interface{}) float64 {
+	switch v := value.(type) {
+	case float32:
+		f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+		return f
+	case float64:
+		return v
+	case int16:
+		return float64(v)
+	case uint16:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	}
+	return 0
+}
+
+// effectiveType returns the --type datatype, or the 16-bit integer type
+// selected by --unsigned if no type was given. --type takes precedence;
+// parseFlags rejects --unsigned together with a signed or float type.
+func effectiveType(args *ModbusArgs) string {
+	switch {
+	case args.Type != "":
+		return args.Type
+	case args.Unsigned:
+		return "uint16"
+	}
+	return "int16"
+}
+
+// decodeTyped splits a register response into values of the effective
+// datatype. It fails if a value cannot be decoded, such as invalid BCD.
+func decodeTyped(response []byte, args *ModbusArgs) ([]interface{}, error) {
+	datatype := effectiveType(args)
+	width := datatypeRegisters(datatype) * registerSize
+	if len(response)%width != 0 {
+		return nil, fmt.Errorf("response has %d registers, which is not a whole number of %s values (%d registers each)",
+			len(response)/registerSize, datatype, width/registerSize)
+	}
+	var values []interface{}
+	for i, word := range splitWords(response, width, args.ByteOrder) {
+		value, err := decodeValue(word, datatype)
+		if err != nil {
+			return nil, fmt.Errorf("register %d: %v", int(args.Start)+i*width/registerSize, err)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// encodeTyped encodes write values of the --type datatype into register data
+// in device byte order, returning the parsed values alongside
+func encodeTyped(texts []string, args *ModbusArgs) ([]byte, []interface{}, error) {
+	if args.Type == "string" {
+		// Strings keep their text as given; --string-swap replaces --byteorder
+		text := strings.Join(texts, ",")
+		return encodeString(text, args.StringSwap), []interface{}{text}, nil
+	}
+	words := make([][]byte, len(texts))
+	values := make([]interface{}, len(texts))
+	for i, text := range texts {
+		word, value, err := encodeValue(text, args.Type)
+		if err != nil {
+			return nil, nil, err
+		}
+		words[i], values[i] = word, value
+	}
+	return joinWords(words, args.ByteOrder), values, nil
+}
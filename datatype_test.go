@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/goburrow/modbus"
+)
+
+func TestSplitWords16Bit(t *testing.T) {
+	data := []byte{0x12, 0x34, 0xAB, 0xCD, 0xFF}
+	tests := []struct {
+		byteOrder string
+		want      [][]byte
+	}{
+		// A single register has no word order, so CDAB leaves it as ABCD does
+		{"ABCD", [][]byte{{0x12, 0x34}, {0xAB, 0xCD}}},
+		{"CDAB", [][]byte{{0x12, 0x34}, {0xAB, 0xCD}}},
+		{"BADC", [][]byte{{0x34, 0x12}, {0xCD, 0xAB}}},
+		{"DCBA", [][]byte{{0x34, 0x12}, {0xCD, 0xAB}}},
+	}
+	for _, test := range tests {
+		words := splitWords(data, registerSize, test.byteOrder)
+		// The trailing odd byte is not a whole register and is dropped
+		if !reflect.DeepEqual(words, test.want) {
+			t.Errorf("splitWords(%s) = % X, want % X", test.byteOrder, words, test.want)
+		}
+		if joined := joinWords(words, test.byteOrder); !bytes.Equal(joined, data[:4]) {
+			t.Errorf("joinWords(splitWords(%s)) = % X, want % X", test.byteOrder, joined, data[:4])
+		}
+	}
+}
+
+func TestDecodeTyped16Bit(t *testing.T) {
+	response := []byte{0x00, 0x01, 0xFF, 0xFF, 0x80, 0x00, 0x7F, 0xFF}
+	tests := []struct {
+		name string
+		args ModbusArgs
+		want []interface{}
+	}{
+		{"signed by default", ModbusArgs{ByteOrder: "ABCD"}, []interface{}{int16(1), int16(-1), int16(-32768), int16(32767)}},
+		{"--unsigned", ModbusArgs{ByteOrder: "ABCD", Unsigned: true}, []interface{}{uint16(1), uint16(65535), uint16(32768), uint16(32767)}},
+		{"--type int16", ModbusArgs{ByteOrder: "ABCD", Type: "int16"}, []interface{}{int16(1), int16(-1), int16(-32768), int16(32767)}},
+		{"--type uint16", ModbusArgs{ByteOrder: "ABCD", Type: "uint16"}, []interface{}{uint16(1), uint16(65535), uint16(32768), uint16(32767)}},
+		{"byte swapped", ModbusArgs{ByteOrder: "BADC"}, []interface{}{int16(256), int16(-1), int16(128), int16(-129)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := decodeTyped(response, &test.args)
+			if err != nil {
+				t.Fatalf("decodeTyped: %v", err)
+			}
+			if !reflect.DeepEqual(values, test.want) {
+				t.Errorf("decodeTyped = %v, want %v", values, test.want)
+			}
+		})
+	}
+}
+
+func TestEncodeTyped16Bit(t *testing.T) {
+	tests := []struct {
+		args  ModbusArgs
+		texts []string
+		want  []byte
+	}{
+		{ModbusArgs{ByteOrder: "ABCD", Type: "int16"}, []string{"1", "-1", "-32768", "32767"}, []byte{0x00, 0x01, 0xFF, 0xFF, 0x80, 0x00, 0x7F, 0xFF}},
+		{ModbusArgs{ByteOrder: "ABCD", Type: "uint16"}, []string{"0", "65535", "0x1234"}, []byte{0x00, 0x00, 0xFF, 0xFF, 0x12, 0x34}},
+		{ModbusArgs{ByteOrder: "DCBA", Type: "uint16"}, []string{"0x1234"}, []byte{0x34, 0x12}},
+		{ModbusArgs{ByteOrder: "ABCD", Type: "bcd"}, []string{"1234", "9999"}, []byte{0x12, 0x34, 0x99, 0x99}},
+	}
+	for _, test := range tests {
+		data, _, err := encodeTyped(test.texts, &test.args)
+		if err != nil {
+			t.Errorf("encodeTyped(%v, %s): %v", test.texts, test.args.Type, err)
+			continue
+		}
+		if !bytes.Equal(data, test.want) {
+			t.Errorf("encodeTyped(%v, %s, %s) = % X, want % X", test.texts, test.args.Type, test.args.ByteOrder, data, test.want)
+		}
+		// Decoding gives back the registers' values, one per text
+		values, err := decodeTyped(data, &test.args)
+		if err != nil || len(values) != len(test.texts) {
+			t.Errorf("decodeTyped(% X) = %v, %v, want %d values", data, values, err, len(test.texts))
+		}
+	}
+}
+
+func TestEncodeSignedBitPatterns(t *testing.T) {
+	tests := []struct {
+		datatype string
+		text     string
+		want     interface{}
+		data     []byte
+	}{
+		// Hex and binary literals spell out the bits of a signed value
+		{"int16", "0xFFFF", int16(-1), []byte{0xFF, 0xFF}},
+		{"int16", "0x8000", int16(-32768), []byte{0x80, 0x00}},
+		{"int16", "0b1111111111111110", int16(-2), []byte{0xFF, 0xFE}},
+		{"int16", "0x7FFF", int16(32767), []byte{0x7F, 0xFF}},
+		{"int16", "-0x1", int16(-1), []byte{0xFF, 0xFF}},
+		{"int32", "0xFFFFFFFF", int32(-1), []byte{0xFF, 0xFF, 0xFF, 0xFF}},
+		{"int32", "0x80000000", int32(math.MinInt32), []byte{0x80, 0x00, 0x00, 0x00}},
+		{"int64", "0xFFFFFFFFFFFFFFFE", int64(-2), []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE}},
+	}
+	for _, test := range tests {
+		data, value, err := encodeValue(test.text, test.datatype)
+		if err != nil {
+			t.Errorf("encodeValue(%s, %s): %v", test.text, test.datatype, err)
+			continue
+		}
+		if value != test.want || !bytes.Equal(data, test.data) {
+			t.Errorf("encodeValue(%s, %s) = % X, %v, want % X, %v", test.text, test.datatype, data, value, test.data, test.want)
+		}
+	}
+
+	// Decimal values keep the signed range, and literals must fit the width
+	for _, test := range []struct{ datatype, text string }{
+		{"int16", "65535"}, {"int16", "0x10000"}, {"int32", "4294967295"}, {"int32", "0x1FFFFFFFF"},
+	} {
+		if _, _, err := encodeValue(test.text, test.datatype); err == nil {
+			t.Errorf("encodeValue(%s, %s) succeeded, want an error", test.text, test.datatype)
+		}
+	}
+}
+
+func TestDatatypeRegisters(t *testing.T) {
+	for datatype, want := range map[string]int{
+		"int16": 1, "uint16": 1, "bcd": 1, "string": 1,
+		"int32": 2, "uint32": 2, "float32": 2,
+		"int64": 4, "uint64": 4, "float64": 4,
+		"int8": 0,
+	} {
+		if got := datatypeRegisters(datatype); got != want {
+			t.Errorf("datatypeRegisters(%s) = %d, want %d", datatype, got, want)
+		}
+	}
+}
+
+func TestInt32(t *testing.T) {
+	tests := []struct {
+		name      string
+		datatype  string
+		byteOrder string
+		raw       []byte
+		want      interface{}
+	}{
+		{"negative", "int32", "ABCD", []byte{0xFF, 0xFF, 0xFF, 0xFE}, int32(-2)},
+		{"most negative", "int32", "ABCD", []byte{0x80, 0x00, 0x00, 0x00}, int32(-2147483648)},
+		{"negative word swapped", "int32", "CDAB", []byte{0xFF, 0xFE, 0xFF, 0xFF}, int32(-2)},
+		{"word swapped", "int32", "CDAB", []byte{0x56, 0x78, 0x12, 0x34}, int32(0x12345678)},
+		{"unsigned", "uint32", "ABCD", []byte{0xFF, 0xFF, 0xFF, 0xFE}, uint32(4294967294)},
+		{"unsigned word swapped", "uint32", "CDAB", []byte{0x00, 0x01, 0x00, 0x00}, uint32(1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := &ModbusArgs{Type: test.datatype, ByteOrder: test.byteOrder}
+			values, err := decodeTyped(test.raw, args)
+			if err != nil {
+				t.Fatalf("decodeTyped: %v", err)
+			}
+			if !reflect.DeepEqual(values, []interface{}{test.want}) {
+				t.Errorf("decodeTyped(% X) = %v, want %v", test.raw, values, test.want)
+			}
+			data, _, err := encodeTyped([]string{fmt.Sprint(test.want)}, args)
+			if err != nil || !bytes.Equal(data, test.raw) {
+				t.Errorf("encodeTyped(%v) = % X, %v, want % X", test.want, data, err, test.raw)
+			}
+		})
+	}
+
+	// A register pair that does not hold a whole value is an error
+	if _, err := decodeTyped([]byte{0x00, 0x01, 0x00, 0x02, 0x00, 0x03}, &ModbusArgs{Type: "int32", ByteOrder: "ABCD"}); err == nil {
+		t.Errorf("decodeTyped of 3 registers as int32 succeeded, want an error")
+	}
+	for _, text := range []string{"2147483648", "-2147483649"} {
+		if _, _, err := encodeTyped([]string{text}, &ModbusArgs{Type: "int32", ByteOrder: "ABCD"}); err == nil {
+			t.Errorf("encodeTyped(%s) as int32 succeeded, want an error", text)
+		}
+	}
+}
+
+func TestFloat32ByteOrders(t *testing.T) {
+	// The same register pair, 0x4049 0x0FDB, read from devices of each order
+	raw := []byte{0x40, 0x49, 0x0F, 0xDB}
+	tests := []struct {
+		byteOrder string
+		bits      uint32
+	}{
+		{"ABCD", 0x40490FDB}, // pi
+		{"CDAB", 0x0FDB4049},
+		{"BADC", 0x4940DB0F},
+		{"DCBA", 0xDB0F4940},
+	}
+	for _, test := range tests {
+		t.Run(test.byteOrder, func(t *testing.T) {
+			args := &ModbusArgs{Type: "float32", ByteOrder: test.byteOrder}
+			values, err := decodeTyped(raw, args)
+			if err != nil {
+				t.Fatalf("decodeTyped: %v", err)
+			}
+			want := math.Float32frombits(test.bits)
+			if len(values) != 1 || values[0] != want {
+				t.Errorf("decodeTyped(% X, %s) = %v, want %v", raw, test.byteOrder, values, want)
+			}
+			// Laid out in this order by the device, pi decodes as pi
+			stored := orderBytes([]byte{0x40, 0x49, 0x0F, 0xDB}, test.byteOrder)
+			if values, err := decodeTyped(stored, args); err != nil || values[0] != float32(math.Pi) {
+				t.Errorf("decodeTyped(% X, %s) = %v, %v, want pi", stored, test.byteOrder, values, err)
+			}
+			// Encoding the value in the same order gives back the registers
+			data, _, err := encodeTyped([]string{strconv.FormatFloat(float64(want), 'g', -1, 32)}, args)
+			if err != nil || !bytes.Equal(data, raw) {
+				t.Errorf("encodeTyped(%v, %s) = % X, %v, want % X", want, test.byteOrder, data, err, raw)
+			}
+		})
+	}
+}
+
+func TestInvalidBCDRead(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+	}{
+		{"typed", nil},
+		// Scaling must not turn the invalid register into offset + 0
+		{"scaled", []string{"--scale", "0.1", "--offset", "5"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t)
+			server.holding[30], server.holding[31] = 0x1234, 0x12AB
+			flags := append([]string{"-o", "read_holding_registers", "--start", "30", "--count", "2", "--type", "bcd"}, test.flags...)
+			s, out := newTestSession(t, server, flags...)
+
+			err := performReadOperation(context.Background(), s, modbus.FuncCodeReadHoldingRegisters)
+			if !errors.Is(err, errReported) {
+				t.Fatalf("performReadOperation = %v, want errReported", err)
+			}
+			if s.lastErr == nil || !strings.Contains(s.lastErr.Error(), "register 31: 0x12AB is not valid BCD") {
+				t.Errorf("error = %v, want register 31 not valid BCD", s.lastErr)
+			}
+			if results := testResults(t, out); len(results) != 0 {
+				t.Errorf("printed %v, want no results", results)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/goburrow/modbus"
+)
+
+const (
+	// funcCodeEncapsulatedInterface is the Modbus Encapsulated Interface Transport function (FC43)
+	funcCodeEncapsulatedInterface = 0x2B
+	// meiReadDeviceID is the MEI type of Read Device Identification
+	meiReadDeviceID = 0x0E
+	// readDeviceIDBasic requests the basic objects (vendor, product code, revision)
+	readDeviceIDBasic = 0x01
+)
+
+// deviceObjectNames are the standard device identification object ids
+var deviceObjectNames = map[byte]string{
+	0x00: "VendorName",
+	0x01: "ProductCode",
+	0x02: "MajorMinorRevision",
+	0x03: "VendorUrl",
+	0x04: "ProductName",
+	0x05: "ModelName",
+	0x06: "UserApplicationName",
+}
+
+// deviceObject is one object returned by Read Device Identification
+type deviceObject struct {
+	ID    byte   `json:"id"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// readDeviceID reads the basic device identification objects with FC43/14.
+// goburrow's Client does not expose this function, so the request is built
+// and sent through the handler directly. Responses marked "more follows" are
+// continued from the next object id until all objects have been returned.
+func readDeviceID(handler clientHandler) ([]deviceObject, error) {
+	var objects []deviceObject
+	objectID := byte(0)
+	for {
+		request := &modbus.ProtocolDataUnit{
+			FunctionCode: funcCodeEncapsulatedInterface,
+			Data:         []byte{meiReadDeviceID, readDeviceIDBasic, objectID},
+		}
+		response, err := sendPDU(handler, request)
+		if err != nil {
+			return nil, err
+		}
+
+		// MEI type, read device id code, conformity level, more follows,
+		// next object id, number of objects, then id/length/value per object
+		data := response.Data
+		if len(data) < 6 || data[0] != meiReadDeviceID {
+			return nil, fmt.Errorf("invalid device identification response: % x", data)
+		}
+		moreFollows, nextID, count := data[3], data[4], int(data[5])
+		data = data[6:]
+		for i := 0; i < count; i++ {
+			if len(data) < 2 || len(data) < 2+int(data[1]) {
+				return nil, fmt.Errorf("device identification response truncated after %d objects", len(objects))
+			}
+			id, length := data[0], int(data[1])
+			name, ok := deviceObjectNames[id]
+			if !ok {
+				name = fmt.Sprintf("Object0x%02X", id)
+			}
+			objects = append(objects, deviceObject{ID: id, Name: name, Value: string(data[2 : 2+length])})
+			data = data[2+length:]
+		}
+
+		if moreFollows != 0xFF {
+			return objects, nil
+		}
+		if nextID <= objectID {
+			return nil, fmt.Errorf("device identification did not advance past object 0x%02X", objectID)
+		}
+		objectID = nextID
+	}
+}
+
+// sendPDU sends a request through the handler and returns the response PDU,
+// for functions goburrow's Client does not expose or does not decode
+// correctly. An exception response is returned as a *modbus.ModbusError.
+func sendPDU(handler clientHandler, request *modbus.ProtocolDataUnit) (*modbus.ProtocolDataUnit, error) {
+	aduRequest, err := handler.Encode(request)
+	if err != nil {
+		return nil, err
+	}
+	aduResponse, err := handler.Send(aduRequest)
+	if err != nil {
+		return nil, err
+	}
+	if err = handler.Verify(aduRequest, aduResponse); err != nil {
+		return nil, err
+	}
+	response, err := handler.Decode(aduResponse)
+	if err != nil {
+		return nil, err
+	}
+	if response.FunctionCode != request.FunctionCode {
+		if response.FunctionCode == request.FunctionCode|0x80 && len(response.Data) > 0 {
+			return nil, &modbus.ModbusError{FunctionCode: response.FunctionCode, ExceptionCode: response.Data[0]}
+		}
+		return nil, fmt.Errorf("modbus: response function code '%v' does not match request '%v'", response.FunctionCode, request.FunctionCode)
+	}
+	return response, nil
+}
+
+// readDeviceIdentification prints the identification objects of the device
+func readDeviceIdentification(ctx context.Context, s *session) error {
+	printer := s.printer
+
+	return s.repeat(ctx, func() error {
+		objects, err := readDeviceID(s.handler)
+		if err != nil {
+			printer.printError("read", err)
+			return err
+		}
+		lines := make([]string, len(objects))
+		for i, object := range objects {
+			lines[i] = fmt.Sprintf("  0x%02X %s: %s", object.ID, object.Name, object.Value)
+		}
+		printer.printValues("Device identification:\n"+strings.Join(lines, "\n"), valueList(objects))
+		return nil
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/goburrow/modbus"
+)
+
+const (
+	// funcCodeDiagnostics is the Diagnostics function (FC08)
+	funcCodeDiagnostics = 0x08
+	// diagReturnQueryData echoes the request data back (loopback)
+	diagReturnQueryData = 0x0000
+	// diagForceListenOnly puts the device into listen only mode, which it
+	// does not answer
+	diagForceListenOnly = 0x0004
+)
+
+// diagnosticsSubFunctions names the standard sub-functions of Diagnostics
+var diagnosticsSubFunctions = map[uint16]string{
+	0x0000: "Return Query Data",
+	0x0001: "Restart Communications Option",
+	0x0002: "Return Diagnostic Register",
+	0x0003: "Change ASCII Input Delimiter",
+	0x0004: "Force Listen Only Mode",
+	0x000A: "Clear Counters and Diagnostic Register",
+	0x000B: "Return Bus Message Count",
+	0x000C: "Return Bus Communication Error Count",
+	0x000D: "Return Bus Exception Error Count",
+	0x000E: "Return Server Message Count",
+	0x000F: "Return Server No Response Count",
+	0x0010: "Return Server NAK Count",
+	0x0011: "Return Server Busy Count",
+	0x0012: "Return Bus Character Overrun Count",
+	0x0014: "Clear Overrun Counter and Flag",
+}
+
+// diagnosticsCounters are the sub-functions that return one 16-bit counter
+// or register, printed as a number as well as raw data
+var diagnosticsCounters = map[uint16]bool{
+	0x0002: true, 0x000B: true, 0x000C: true, 0x000D: true, 0x000E: true,
+	0x000F: true, 0x0010: true, 0x0011: true, 0x0012: true,
+}
+
+// parseHexBytes parses hex digits, optionally prefixed with 0x and
+// separated by spaces, such as "0x1234", "12 34" or "1234"
+func parseHexBytes(text string) ([]byte, error) {
+	digits := strings.Join(strings.Fields(text), "")
+	digits = strings.TrimPrefix(strings.TrimPrefix(digits, "0x"), "0X")
+	if len(digits)%2 != 0 {
+		return nil, fmt.Errorf("odd number of hex digits in %q", text)
+	}
+	data, err := hex.DecodeString(digits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex in %q", text)
+	}
+	return data, nil
+}
+
+// diagnosticsName returns the name of a sub-function, or its code in hex if
+// it is not a standard one
+func diagnosticsName(subFunction uint16) string {
+	if name, ok := diagnosticsSubFunctions[subFunction]; ok {
+		return fmt.Sprintf("0x%04X %s", subFunction, name)
+	}
+	return fmt.Sprintf("0x%04X", subFunction)
+}
+
+// sendDiagnostics sends one FC08 request and returns the data of the
+// response after its sub-function, which must match the request's.
+// goburrow's Client does not expose this function, so the request is sent
+// through the handler directly.
+func sendDiagnostics(handler clientHandler, subFunction uint16, data []byte) ([]byte, error) {
+	request := &modbus.ProtocolDataUnit{
+		FunctionCode: funcCodeDiagnostics,
+		Data:         append(binary.BigEndian.AppendUint16(nil, subFunction), data...),
+	}
+	response, err := sendPDU(handler, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Data) < 2 {
+		return nil, fmt.Errorf("invalid diagnostics response: % x", response.Data)
+	}
+	if echoed := binary.BigEndian.Uint16(response.Data); echoed != subFunction {
+		return nil, fmt.Errorf("diagnostics response is for sub-function 0x%04X, not 0x%04X", echoed, subFunction)
+	}
+	return response.Data[2:], nil
+}
+
+// runDiagnostics sends the --subfunction of Diagnostics with --data and
+// prints the returned data in hex, with the count of the counter
+// sub-functions as a number. A loopback whose echo differs from the data
+// sent fails.
+func runDiagnostics(ctx context.Context, s *session) error {
+	args, printer := s.args, s.printer
+	name := diagnosticsName(args.SubFunction)
+	if args.DryRun {
+		// Some sub-functions restart the device's communications or clear its counters
+		logWarnf("Dry run, not sent: FC08 Diagnostics: sub-function %s, data % X", name, args.Data)
+		return nil
+	}
+	if args.SubFunction == diagForceListenOnly {
+		logWarnf("The device does not answer %s, expect a timeout", name)
+	}
+
+	return s.repeat(ctx, func() error {
+		data, err := sendDiagnostics(s.handler, args.SubFunction, args.Data)
+		if err == nil && args.SubFunction == diagReturnQueryData && !bytes.Equal(data, args.Data) {
+			err = fmt.Errorf("echo mismatch: sent % X, received % X", args.Data, data)
+		}
+		if err != nil {
+			printer.printError("read", err)
+			return err
+		}
+
+		if diagnosticsCounters[args.SubFunction] && len(data) == registerSize {
+			count := binary.BigEndian.Uint16(data)
+			printer.printValues(fmt.Sprintf("Diagnostics %s: %d (data % X)", name, count, data), valueList([]uint16{count}))
+			return nil
+		}
+		words := make([]uint16, len(data)/registerSize)
+		for i := range words {
+			words[i] = binary.BigEndian.Uint16(data[i*registerSize:])
+		}
+		printer.printValues(fmt.Sprintf("Diagnostics %s: data % X", name, data), valueList(words))
+		return nil
+	})
+}
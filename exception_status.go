@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/goburrow/modbus"
+)
+
+// funcCodeReadExceptionStatus is the Read Exception Status function (FC07)
+const funcCodeReadExceptionStatus = 0x07
+
+// readExceptionStatus reads the eight exception status outputs with FC07.
+// goburrow's Client does not expose this function, so the request is sent
+// through the handler directly.
+func readExceptionStatus(handler clientHandler) (byte, error) {
+	response, err := sendPDU(handler, &modbus.ProtocolDataUnit{FunctionCode: funcCodeReadExceptionStatus})
+	if err != nil {
+		return 0, err
+	}
+	if len(response.Data) != 1 {
+		return 0, fmt.Errorf("invalid exception status response: % x", response.Data)
+	}
+	return response.Data[0], nil
+}
+
+// printExceptionStatus prints the exception status outputs, output 0 being
+// the least significant bit. Their meaning is defined by the device, so each
+// is reported by its number rather than an address.
+func printExceptionStatus(ctx context.Context, s *session) error {
+	printer := s.printer
+	printer.addresses = []int{0, 1, 2, 3, 4, 5, 6, 7}
+	defer func() { printer.addresses = nil }()
+
+	return s.repeat(ctx, func() error {
+		status, err := readExceptionStatus(s.handler)
+		if err != nil {
+			printer.printError("read", err)
+			return err
+		}
+		bits := make([]uint8, 8)
+		labels := make([]string, 8)
+		for i := range bits {
+			bits[i] = (status >> i) & 1
+			labels[i] = fmt.Sprintf("%d=%d", i, bits[i])
+		}
+		printer.printValues(fmt.Sprintf("Exception status 0x%02X: outputs %s", status, strings.Join(labels, " ")), valueList(bits))
+		return nil
+	})
+}
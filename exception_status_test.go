@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/goburrow/modbus"
+)
+
+func TestPrintExceptionStatus(t *testing.T) {
+	server := newTestServer(t)
+	server.exceptionStatus = 0xA5
+	s, out := newTestSession(t, server, "-o", "read_exception_status")
+
+	if err := printExceptionStatus(context.Background(), s); err != nil {
+		t.Fatalf("printExceptionStatus: %v", err)
+	}
+	results := testResults(t, out)
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	// Output 0 is the least significant bit, and each is reported by its number
+	want := []jsonValue{{0, 1.0}, {1, 0.0}, {2, 1.0}, {3, 0.0}, {4, 0.0}, {5, 1.0}, {6, 0.0}, {7, 1.0}}
+	if !reflect.DeepEqual(results[0].Values, want) {
+		t.Errorf("values = %v, want %v", results[0].Values, want)
+	}
+	if !reflect.DeepEqual(server.functionCodes, []byte{funcCodeReadExceptionStatus}) {
+		t.Errorf("function codes = %v, want only FC07", server.functionCodes)
+	}
+}
+
+func TestPrintExceptionStatusException(t *testing.T) {
+	server := newTestServer(t)
+	server.exception = modbus.ExceptionCodeIllegalFunction
+	s, out := newTestSession(t, server, "-o", "read_exception_status")
+
+	err := printExceptionStatus(context.Background(), s)
+	if !errors.Is(err, errReported) {
+		t.Fatalf("printExceptionStatus = %v, want errReported", err)
+	}
+	var modbusErr *modbus.ModbusError
+	if !errors.As(s.lastErr, &modbusErr) || modbusErr.ExceptionCode != modbus.ExceptionCodeIllegalFunction {
+		t.Errorf("error = %v, want Illegal Function", s.lastErr)
+	}
+	if results := testResults(t, out); len(results) != 0 {
+		t.Errorf("printed %v, want no results", results)
+	}
+	if s.printer.addresses != nil {
+		t.Errorf("addresses = %v, want them reset", s.printer.addresses)
+	}
+}
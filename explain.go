@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// explainer collects the lines printed by --explain
+type explainer struct {
+	out io.Writer
+}
+
+// section starts a titled group of lines
+func (e *explainer) section(title string) {
+	fmt.Fprintf(e.out, "\n%s:\n", title)
+}
+
+// line prints one indented line of the current section
+func (e *explainer) line(format string, v ...interface{}) {
+	fmt.Fprintf(e.out, "  "+format+"\n", v...)
+}
+
+// explain prints what the configured run would do, without connecting: the
+// connection, the requests made in each cycle, how responses are decoded and
+// where results go. It uses the same helpers as the operations themselves
+// (request planning, value encoding, byte ordering), so the requests and
+// register data shown are the ones that would be sent.
+func explain(args *ModbusArgs, out io.Writer) error {
+	e := &explainer{out: out}
+	if args.Script != "" {
+		fmt.Fprintf(out, "Explanation of script %s (nothing is sent)\n", args.Script)
+	} else {
+		fmt.Fprintf(out, "Explanation of %s (nothing is sent)\n", args.Operation)
+	}
+
+	e.section("Connection")
+	e.line("Server %s, unit id %d", net.JoinHostPort(args.Server, strconv.FormatUint(uint64(args.Port), 10)), args.UnitID)
+	switch {
+	case args.TLS && args.TLSInsecure:
+		e.line("Modbus/TCP Security (TLS), server certificate not verified")
+	case args.TLS:
+		e.line("Modbus/TCP Security (TLS)")
+	case args.Framing == "rtu-over-tcp":
+		e.line("RTU frames with CRC over TCP")
+	default:
+		e.line("Modbus TCP (MBAP header)")
+	}
+	e.line("Connect timeout %v, response timeout %v", explainTimeout(args.ConnectTimeout), explainTimeout(args.ResponseTimeout))
+	if args.MaxReconnectAttempts == 0 {
+		e.line("A lost connection is re-established every %v until interrupted", args.ReconnectDelay)
+	} else {
+		e.line("A lost connection is re-established up to %d times, %v apart", args.MaxReconnectAttempts, args.ReconnectDelay)
+	}
+	if args.PayloadTransform != "" {
+		e.line("Payload data is scrambled with %s, keyed by holding register %d read in clear", args.PayloadTransform, args.PayloadKeyRegister)
+	}
+
+	e.section("Requests")
+	if args.DryRun {
+		e.line("Dry run: writes, raw and diagnostics requests are logged instead of sent")
+	}
+	if args.Preflight && args.Script == "" && !readOnlyOperations[args.Operation] {
+		e.line("Once before the first cycle: preflight read and write-back of %s", explainPreflight(args))
+	}
+	if args.Script != "" {
+		steps, err := loadScript(args.Script, args)
+		if err != nil {
+			return fmt.Errorf("Error loading script: %v", err)
+		}
+		preflighted := !args.Preflight
+		for i, step := range steps {
+			if !preflighted && !readOnlyOperations[step.Operation] {
+				preflighted = true
+				e.line("Once before step %d: preflight read and write-back of %s", i+1, explainPreflight(step.args))
+			}
+			e.line("Step %d, %s:", i+1, step.Operation)
+			if err := explainRequests(e, step.args); err != nil {
+				return err
+			}
+			if step.delay > 0 {
+				e.line("Wait %v", step.delay)
+			}
+		}
+		if args.StopOnError {
+			e.line("The script stops at the first failed step")
+		}
+	} else if err := explainRequests(e, args); err != nil {
+		return err
+	}
+	if args.Verify {
+		e.line("After each successful write: read back the written values and warn about differences")
+	}
+	if args.Report != "" && !readOnlyOperations[args.Operation] {
+		e.line("Around each write: read the target values before and after for the report")
+	}
+	switch {
+	case args.RepeatSuccess > 0:
+		limit := "no attempt limit"
+		if args.MaxAttempts > 0 {
+			limit = fmt.Sprintf("at most %d attempts", args.MaxAttempts)
+		}
+		e.line("Cycles: until %d succeed (%s), %dms apart", args.RepeatSuccess, limit, args.Interval)
+	case args.Repeat == 0:
+		e.line("Cycles: until interrupted, %dms apart", args.Interval)
+	default:
+		e.line("Cycles: %d, %dms apart", args.Repeat, args.Interval)
+	}
+	if args.Retries > 0 {
+		e.line("Failed requests are retried up to %d times, %dms apart", args.Retries, args.RetryDelay)
+		if !args.RetryNonIdempotent && !idempotentOperations[args.Operation] {
+			e.line("Requests that may already have taken effect (timeout or lost connection) are not retried")
+		}
+	}
+
+	if readOnlyOperations[args.Operation] || args.Operation == "read_write_multiple_registers" {
+		e.section("Decoding")
+		explainDecoding(e, args)
+	}
+
+	e.section("Results")
+	explainResults(e, args)
+	return nil
+}
+
+// explainTimeout formats a timeout, where 0 means no timeout
+func explainTimeout(timeout time.Duration) string {
+	if timeout == 0 {
+		return "none"
+	}
+	return timeout.String()
+}
+
+// explainPreflight describes the probe written back by --preflight
+func explainPreflight(args *ModbusArgs) string {
+	switch args.Operation {
+	case "write_single_coil", "write_multiple_coils", "coil_pattern":
+		return fmt.Sprintf("coil %d: FC01 Read Coils, then FC05 Write Single Coil", args.PreflightAddress)
+	}
+	return fmt.Sprintf("holding register %d: FC03 Read Holding Registers, then %s", args.PreflightAddress, explainRegisterWrite(args, writeSingle, 1))
+}
+
+// explainPattern describes the values a --pattern writes
+func explainPattern(args *ModbusArgs) string {
+	if waveforms[args.Pattern] != nil {
+		text := fmt.Sprintf("%s wave of amplitude %v around %v, period %v, sampled at each write", strings.ToUpper(args.Pattern[:1])+args.Pattern[1:], args.Amplitude, args.Midpoint, args.Period)
+		if args.Phase != 0 {
+			text += fmt.Sprintf(", each register %v degrees behind the one before", args.Phase)
+		}
+		if args.Type == "" {
+			text += fmt.Sprintf(", clamped to %d to %d", args.PatternMin, args.PatternMax)
+		}
+		return text
+	}
+	if args.Pattern == "random" {
+		return fmt.Sprintf("Random values within %d to %d, new ones each cycle, seed %d", args.PatternMin, args.PatternMax, args.Seed)
+	}
+	limit := "wrapping around"
+	if args.PatternClamp {
+		limit = "clamped"
+	}
+	return fmt.Sprintf("Ramp from %d in steps of %d, one per cycle, %s within %d to %d", args.PatternStart, args.PatternStep, limit, args.PatternMin, args.PatternMax)
+}
+
+// explainRegisterWrite describes the function code used to write count
+// registers with --write-strategy, when preferred is the operation's own
+// strategy
+func explainRegisterWrite(args *ModbusArgs, preferred string, count int) string {
+	describe := func(strategy string) string {
+		if strategy == writeMultiple {
+			if chunk := writeChunkRegisters(args); count > chunk {
+				return fmt.Sprintf("%d x FC16 Write Multiple Registers (at most %d registers each)", (count+chunk-1)/chunk, chunk)
+			}
+			return "FC16 Write Multiple Registers"
+		}
+		if count > 1 {
+			return fmt.Sprintf("%d x FC06 Write Single Register", count)
+		}
+		return "FC06 Write Single Register"
+	}
+	if args.WriteStrategy != "auto" {
+		return describe(args.WriteStrategy)
+	}
+	fallback := writeMultiple
+	if preferred == writeMultiple {
+		fallback = writeSingle
+	}
+	return fmt.Sprintf("%s (%s if the device answers Illegal Function)", describe(preferred), describe(fallback))
+}
+
+// explainReadChunks describes how a read of quantity items is split into
+// several requests, or returns "" if one request carries it
+func explainReadChunks(functionCode byte, args *ModbusArgs, quantity int) string {
+	valueRegisters := 1
+	if args.Type != "" {
+		valueRegisters = datatypeRegisters(args.Type)
+	}
+	chunk := readChunkSize(functionCode, valueRegisters)
+	if quantity <= chunk {
+		return ""
+	}
+	return fmt.Sprintf(", in %d requests of at most %d", (quantity+chunk-1)/chunk, chunk)
+}
+
+// explainRequests lists the requests made in each cycle
+func explainRequests(e *explainer, args *ModbusArgs) error {
+	registers := int(args.Count)
+	if args.Type != "" && args.Type != "string" {
+		registers *= datatypeRegisters(args.Type)
+	}
+	switch args.Operation {
+	case "read_coils":
+		e.line("FC01 Read Coils: address %d, quantity %d%s", args.Start, args.Count, explainReadChunks(modbus.FuncCodeReadCoils, args, int(args.Count)))
+	case "read_discrete_inputs":
+		e.line("FC02 Read Discrete Inputs: address %d, quantity %d%s", args.Start, args.Count,
+			explainReadChunks(modbus.FuncCodeReadDiscreteInputs, args, int(args.Count)))
+	case "read_holding_registers":
+		e.line("FC03 Read Holding Registers: address %d, quantity %d%s", args.Start, registers,
+			explainReadChunks(modbus.FuncCodeReadHoldingRegisters, args, registers))
+	case "read_input_registers":
+		e.line("FC04 Read Input Registers: address %d, quantity %d%s", args.Start, registers,
+			explainReadChunks(modbus.FuncCodeReadInputRegisters, args, registers))
+	case "write_single_coil":
+		if writePatterns[args.Pattern] != nil {
+			e.line("FC05 Write Single Coil: address %d, state from --pattern %s", args.Start, args.Pattern)
+			e.line("%s", explainPattern(args))
+			break
+		}
+		e.line("FC05 Write Single Coil: address %d, value 0x%04X", args.Start, args.Value)
+	case "write_multiple_coils":
+		states := make([]bool, len(args.Values))
+		for i, value := range args.Values {
+			states[i] = value != 0
+		}
+		if writePatterns[args.Pattern] != nil {
+			e.line("FC15 Write Multiple Coils: address %d, quantity %d, states from --pattern %s", args.Start, len(states), args.Pattern)
+			e.line("%s", explainPattern(args))
+		} else if len(states) > maxWriteCoils {
+			e.line("%d x FC15 Write Multiple Coils: address %d, quantity %d, at most %d coils each", (len(states)+maxWriteCoils-1)/maxWriteCoils,
+				args.Start, len(states), maxWriteCoils)
+		} else {
+			e.line("FC15 Write Multiple Coils: address %d, quantity %d, data % X", args.Start, len(states), packCoils(states))
+		}
+	case "write_single_register", "write_multiple_registers":
+		var data []byte
+		preferred := writeMultiple
+		switch {
+		case args.Type == "string" || (args.Type != "" && args.Operation == "write_single_register"):
+			var err error
+			if data, _, err = encodeTyped([]string{args.ValueText}, args); err != nil {
+				return err
+			}
+		case args.Type != "":
+			var err error
+			if data, _, err = encodeTyped(args.ValueTexts, args); err != nil {
+				return err
+			}
+		case args.Operation == "write_single_register":
+			data = orderBytes(binary.BigEndian.AppendUint16(nil, args.Value), args.ByteOrder)
+		default:
+			words := make([][]byte, len(args.Values))
+			for i, value := range args.Values {
+				words[i] = binary.BigEndian.AppendUint16(nil, value)
+			}
+			data = joinWords(words, args.ByteOrder)
+		}
+		count := len(data) / registerSize
+		if args.Operation == "write_single_register" && count == 1 {
+			preferred = writeSingle
+		}
+		if writePatterns[args.Pattern] != nil {
+			e.line("%s: address %d, quantity %d, registers from --pattern %s", explainRegisterWrite(args, preferred, count), args.Start, count, args.Pattern)
+			e.line("%s", explainPattern(args))
+			break
+		}
+		e.line("%s: address %d, quantity %d, registers %s", explainRegisterWrite(args, preferred, count), args.Start, count, formatRegisters(data))
+	case "read_write_multiple_registers":
+		var data []byte
+		if args.Type != "" {
+			var err error
+			if data, _, err = encodeTyped(args.ValueTexts, args); err != nil {
+				return err
+			}
+		} else {
+			words := make([][]byte, len(args.Values))
+			for i, value := range args.Values {
+				words[i] = binary.BigEndian.AppendUint16(nil, value)
+			}
+			data = joinWords(words, args.ByteOrder)
+		}
+		e.line("FC23 Read/Write Multiple Registers: read address %d, quantity %d; write address %d, quantity %d, registers %s",
+			args.Start, registers, args.WriteStart, len(data)/registerSize, formatRegisters(data))
+	case "mask_write_register":
+		e.line("FC22 Mask Write Register: address %d, and-mask 0x%04X, or-mask 0x%04X", args.Start, args.AndMask, args.OrMask)
+	case "set_bits", "clear_bits", "toggle_bits":
+		mask, _ := bitMask(args.Bits)
+		e.line("FC03 Read Holding Registers: address %d, quantity 1", args.Start)
+		e.line("then, unless the register already holds the result, %s: address %d, the value read with mask 0x%04X applied (%s)",
+			explainRegisterWrite(args, writeSingle, 1), args.Start, mask, args.Operation)
+		e.line("Not atomic: a change made by another client between the read and the write is lost")
+	case "read":
+		points, err := resolvePoints(args)
+		if err != nil {
+			return err
+		}
+		functionCodes := map[string]string{"coil": "FC01", "discrete": "FC02", "holding": "FC03", "input": "FC04"}
+		for _, read := range planPointReads(points) {
+			names := make([]string, len(read.points))
+			for i, point := range read.points {
+				names[i] = point.Name
+			}
+			e.line("%s (%s): address %d, quantity %d, for %s", functionCodes[read.table], read.table, read.start, read.size, strings.Join(names, ", "))
+		}
+	case "scan_units":
+		probe := fmt.Sprintf("FC03 Read Holding Registers: address %d, quantity 1", args.Start)
+		if args.Probe == "device_id" {
+			probe = "FC43/14 Read Device Identification"
+		}
+		e.line("%s, to each unit id from %d to %d, %dms apart, waiting %v for each answer", probe, args.UnitStart, args.UnitEnd, args.Interval, args.ProbeTimeout)
+		if args.Parallel > 1 {
+			e.line("%d unit ids probed at once, each over its own connection", args.Parallel)
+		}
+	case "scan_registers":
+		last := int(args.Start) + int(args.Count) - 1
+		if args.End != 0 {
+			last = int(args.End)
+		}
+		e.line("FC%02d reads of the %s table: quantity %d, from address %d to %d, %dms apart, doubling after a timeout",
+			scanTables[args.Table].functionCode, args.Table, args.Chunk, args.Start, last, args.Interval)
+		e.line("A chunk answered with an exception is read again one address at a time")
+	case "read_device_id":
+		e.line("FC43/14 Read Device Identification: basic objects (vendor, product code, revision)")
+	case "read_exception_status":
+		e.line("FC07 Read Exception Status: the eight exception status outputs")
+	case "diagnostics":
+		e.line("FC08 Diagnostics: sub-function %s, data % X", diagnosticsName(args.SubFunction), args.Data)
+	case "raw":
+		e.line("Function code 0x%02X: data % X, sent as given", args.PDU[0], args.PDU[1:])
+	case "read_fifo_queue":
+		e.line("FC24 Read FIFO Queue: pointer address %d, up to %d entries", args.Start, maxFIFOCount)
+	case "coil_pattern":
+		cycles := "until interrupted"
+		if args.Cycles > 0 {
+			cycles = fmt.Sprintf("%d cycle(s)", args.Cycles)
+		}
+		e.line("FC15 Write Multiple Coils: address %d, quantity %d, %d %s step(s) per cycle, %s", args.Start, args.Count,
+			patternSteps(args.Pattern, int(args.Count)), args.Pattern, cycles)
+		if !args.LeaveAsIs {
+			e.line("At the end: FC15 switching coils %d to %d off", args.Start, int(args.Start)+int(args.Count)-1)
+		}
+	default:
+		return fmt.Errorf("Invalid operation: %s", args.Operation)
+	}
+	return nil
+}
+
+// explainDecoding describes the steps that turn response data into the
+// printed values
+func explainDecoding(e *explainer, args *ModbusArgs) {
+	switch args.Operation {
+	case "read_coils", "read_discrete_inputs":
+		e.line("One bit per coil or input, printed as 0 or 1")
+		return
+	case "read_device_id":
+		e.line("Object values printed as text")
+		return
+	case "read_exception_status":
+		e.line("One bit per output, output 0 first, printed as 0 or 1")
+		return
+	case "diagnostics":
+		e.line("Returned data printed in hex, counters also as a number")
+		return
+	case "raw":
+		e.line("Response PDU printed in hex, exception responses as their exception")
+		return
+	case "read":
+		e.line("Each point: registers in %s order, decoded as its datatype, multiplied by its scale, printed with its unit", args.ByteOrder)
+		return
+	}
+
+	if args.Format == "hex" {
+		e.line("Raw register words printed in hex, without decoding")
+		return
+	}
+	switch {
+	case args.Type == "string":
+		swap := "high byte first"
+		if args.StringSwap {
+			swap = "low byte first"
+		}
+		e.line("Registers decoded as one string of two characters each, %s, trailing NULs and spaces removed", swap)
+		return
+	case args.Type != "":
+		e.line("Every %d register(s) reordered from %s to big-endian and decoded as %s", datatypeRegisters(args.Type), args.ByteOrder, args.Type)
+	case args.Unsigned:
+		e.line("Each register in %s order decoded as uint16", args.ByteOrder)
+	default:
+		e.line("Each register in %s order decoded as int16", args.ByteOrder)
+	}
+	if args.Scale != 1 {
+		e.line("Each value multiplied by %v", args.Scale)
+	}
+	if args.Offset != 0 {
+		e.line("%v added to each value", args.Offset)
+	}
+	if args.LookupFile != "" {
+		e.line("Values with a label in %s printed as the label", args.LookupFile)
+	}
+	if args.OnChange {
+		e.line("A repeated read is only printed when its response differs from the previous one")
+	}
+}
+
+// explainResults describes where results and log lines go
+func explainResults(e *explainer, args *ModbusArgs) {
+	destination := "stdout"
+	if args.Output != "" {
+		destination = args.Output
+	}
+	switch args.Format {
+	case "json":
+		e.line("One JSON object per result on %s, errors on stderr", destination)
+	case "csv":
+		e.line("CSV rows on %s", destination)
+	case "binlog":
+		e.line("Binary log records in %s (see readlog)", destination)
+	default:
+		e.line("Log lines on stderr (format %s)", args.Format)
+	}
+	if args.Report != "" {
+		e.line("Markdown record of every operation appended to %s", args.Report)
+	}
+	if args.WebhookURL != "" {
+		e.line("Each result posted as JSON to %s", args.WebhookURL)
+	}
+	for name, level := range logLevels {
+		if level == minLogLevel {
+			e.line("Log level %s", name)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// explainedRequests returns the lines of the Requests section of an
+// explanation, without their indent
+func explainedRequests(explanation string) []string {
+	var lines []string
+	inRequests := false
+	for _, line := range strings.Split(explanation, "\n") {
+		switch {
+		case line == "Requests:":
+			inRequests = true
+		case !strings.HasPrefix(line, "  "):
+			inRequests = false
+		case inRequests:
+			lines = append(lines, strings.TrimPrefix(line, "  "))
+		}
+	}
+	return lines
+}
+
+func TestExplainRequests(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		want  []string
+	}{
+		{"read split across requests", []string{"-o", "read_holding_registers", "--start", "0", "--count", "300"}, []string{
+			"FC03 Read Holding Registers: address 0, quantity 300, in 3 requests of at most 125",
+			"Cycles: 1, 1000ms apart",
+		}},
+		{"typed write", []string{"-o", "write_multiple_registers", "--start", "10", "--type", "float32", "--values", "1.5,-2"}, []string{
+			"FC16 Write Multiple Registers (4 x FC06 Write Single Register if the device answers Illegal Function): address 10, quantity 4, registers 0x3FC0 0x0000 0xC000 0x0000",
+			"Cycles: 1, 1000ms apart",
+		}},
+		{"typed single register write", []string{"-o", "write_single_register", "--start", "3", "--type", "int16", "--value", "-2"}, []string{
+			"FC06 Write Single Register (FC16 Write Multiple Registers if the device answers Illegal Function): address 3, quantity 1, registers 0xFFFE",
+			"Cycles: 1, 1000ms apart",
+		}},
+		{"verify and preflight", []string{"-o", "write_single_register", "--start", "4", "--value", "7", "--verify", "--preflight"}, []string{
+			"Once before the first cycle: preflight read and write-back of holding register 4: FC03 Read Holding Registers, then FC06 Write Single Register (FC16 Write Multiple Registers if the device answers Illegal Function)",
+			"FC06 Write Single Register (FC16 Write Multiple Registers if the device answers Illegal Function): address 4, quantity 1, registers 0x0007",
+			"After each successful write: read back the written values and warn about differences",
+			"Cycles: 1, 1000ms apart",
+		}},
+		{"dry run", []string{"-o", "write_multiple_registers", "--start", "4", "--values", "1,2", "--dry-run"}, []string{
+			"Dry run: writes, raw and diagnostics requests are logged instead of sent",
+			"FC16 Write Multiple Registers (2 x FC06 Write Single Register if the device answers Illegal Function): address 4, quantity 2, registers 0x0001 0x0002",
+			"Cycles: 1, 1000ms apart",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args, err := parseTestFlags(t, append([]string{"-s", "plc", "--explain"}, test.flags...)...)
+			if err != nil {
+				t.Fatalf("parseFlags: %v", err)
+			}
+			var out bytes.Buffer
+			if err := explain(args, &out); err != nil {
+				t.Fatalf("explain: %v", err)
+			}
+			if got := explainedRequests(out.String()); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("requests =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
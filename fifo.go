@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/goburrow/modbus"
+)
+
+// maxFIFOCount is the most entries a FC24 Read FIFO Queue response may carry
+const maxFIFOCount = 31
+
+// readFIFO reads the FIFO queue at the pointer address with FC24 and returns
+// the queued registers. goburrow's ReadFIFOQueue compares the byte count with
+// the wrong length and rejects correct responses, so the request is sent
+// through the handler directly.
+func readFIFO(handler clientHandler, address uint16) ([]byte, error) {
+	request := &modbus.ProtocolDataUnit{
+		FunctionCode: modbus.FuncCodeReadFIFOQueue,
+		Data:         binary.BigEndian.AppendUint16(nil, address),
+	}
+	response, err := sendPDU(handler, request)
+	if err != nil {
+		return nil, err
+	}
+
+	// Byte count, FIFO count, then the queued registers. The byte count
+	// includes the two bytes of the FIFO count.
+	data := response.Data
+	if len(data) < 4 {
+		return nil, fmt.Errorf("invalid FIFO response: % x", data)
+	}
+	byteCount, count := int(binary.BigEndian.Uint16(data)), int(binary.BigEndian.Uint16(data[2:]))
+	if count > maxFIFOCount {
+		return nil, fmt.Errorf("invalid FIFO count %d, more than the %d a queue may hold", count, maxFIFOCount)
+	}
+	if byteCount != len(data)-2 || byteCount != 2+count*registerSize {
+		return nil, fmt.Errorf("invalid FIFO response: byte count %d for %d entries in %d bytes", byteCount, count, len(data)-2)
+	}
+	return data[4:], nil
+}
+
+// readFIFOQueue prints the number of entries in the FIFO queue at --start
+// followed by the queued values, decoded like a register read. An empty
+// queue is a result, not an error.
+func readFIFOQueue(ctx context.Context, s *session) error {
+	args, printer := s.args, s.printer
+	registers := 1
+	if args.Type != "" {
+		registers = datatypeRegisters(args.Type)
+	}
+
+	return s.repeat(ctx, func() error {
+		response, err := readFIFO(s.handler, args.Start)
+		if err == nil {
+			err = printFIFO(s, response, registers)
+		}
+		if err != nil {
+			printer.printError("read", err)
+		}
+		return err
+	})
+}
+
+// printFIFO prints the entries of a FIFO response. Every value is read from
+// the pointer address, so that is the address reported for each.
+func printFIFO(s *session, response []byte, registers int) error {
+	args, printer := s.args, s.printer
+	entries := len(response) / registerSize
+	if entries == 0 {
+		printer.printValues(fmt.Sprintf("FIFO queue at %d: 0 entries", args.Start), nil)
+		return nil
+	}
+	if entries%registers != 0 {
+		return fmt.Errorf("%d FIFO entries do not make whole %s values", entries, args.Type)
+	}
+	logInfof("FIFO queue at %d: %d entries", args.Start, entries)
+
+	// Decode the entries as a read of entries registers
+	fifoArgs := *args
+	fifoArgs.Count = uint16(entries / registers)
+	addresses := make([]int, fifoArgs.Count)
+	for i := range addresses {
+		addresses[i] = int(args.Start)
+	}
+	s.args, printer.args, printer.addresses = &fifoArgs, &fifoArgs, addresses
+	defer func() {
+		s.args, printer.args, printer.addresses = args, args, nil
+	}()
+	return printReadResponse(s, modbus.FuncCodeReadHoldingRegisters, response, nil)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// decodeJSONList decodes the list under key in a JSON file holding one
+// object, such as {"points": [...]}, calling element with a function that
+// decodes the next entry of the list. Other keys are ignored. Every error is prefixed with path and the
+// line it was found on, so mistakes in hand-written files are easy to find.
+func decodeJSONList(path string, data []byte, key string, element func(decode func(interface{}) error) error) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	line := func(offset int64) int {
+		return bytes.Count(data[:offset], []byte("\n")) + 1
+	}
+	located := func(err error, offset int64) error {
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) && syntax.Offset > 0 {
+			offset = syntax.Offset - 1
+		}
+		return fmt.Errorf("%s:%d: %v", path, line(offset), err)
+	}
+	delim := func(want json.Delim) error {
+		token, err := decoder.Token()
+		if err != nil {
+			return located(err, decoder.InputOffset())
+		}
+		if token != want {
+			return fmt.Errorf("%s:%d: expected %v, found %v", path, line(decoder.InputOffset()), want, token)
+		}
+		return nil
+	}
+
+	if err := delim('{'); err != nil {
+		return err
+	}
+	for decoder.More() {
+		name, err := decoder.Token()
+		if err != nil {
+			return located(err, decoder.InputOffset())
+		}
+		if name != key {
+			var ignored json.RawMessage
+			if err := decoder.Decode(&ignored); err != nil {
+				return located(err, decoder.InputOffset())
+			}
+			continue
+		}
+		if err := delim('['); err != nil {
+			return err
+		}
+		for decoder.More() {
+			// The decoder stops after the previous entry; skip to this one
+			offset := decoder.InputOffset()
+			for offset < int64(len(data)) && bytes.IndexByte([]byte(" \t\r\n,"), data[offset]) >= 0 {
+				offset++
+			}
+			if err := element(decoder.Decode); err != nil {
+				return located(err, offset)
+			}
+		}
+		if err := delim(']'); err != nil {
+			return err
+		}
+	}
+	return delim('}')
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// logLevel is the severity of a log line. Lines below the level selected
+// with --log-level are dropped.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logLevels maps the --log-level names to levels
+var logLevels = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// minLogLevel is the lowest level that is logged
+var minLogLevel = levelInfo
+
+// logf logs a line at the given level. Fatal errors keep using log.Fatal,
+// which is never suppressed.
+func logf(level logLevel, format string, v ...interface{}) {
+	if level >= minLogLevel {
+		log.Output(3, fmt.Sprintf(format, v...))
+	}
+}
+
+// logDebugf logs details enabled with --verbose or --log-level debug
+func logDebugf(format string, v ...interface{}) { logf(levelDebug, format, v...) }
+
+// logInfof logs progress and per-operation results
+func logInfof(format string, v ...interface{}) { logf(levelInfo, format, v...) }
+
+// logWarnf logs problems the run recovers from
+func logWarnf(format string, v ...interface{}) { logf(levelWarn, format, v...) }
+
+// logErrorf logs failed operations and other errors
+func logErrorf(format string, v ...interface{}) { logf(levelError, format, v...) }
+
+// setTimestampFormat applies --timestamp-format to every log line: default
+// keeps the log package's local date and time, rfc3339 uses UTC with
+// microseconds, unix the seconds since the epoch with microseconds and none
+// no timestamp at all
+func setTimestampFormat(format string) error {
+	switch format {
+	case "default":
+	case "none":
+		log.SetFlags(0)
+	case "rfc3339", "unix":
+		log.SetFlags(0)
+		log.SetOutput(&timestampWriter{out: os.Stderr, format: format})
+	default:
+		return fmt.Errorf("Invalid timestamp format: %s", format)
+	}
+	return nil
+}
+
+// timestampWriter prefixes each line written by the log package, which
+// writes one line per call, with the current time
+type timestampWriter struct {
+	out    io.Writer
+	format string
+}
+
+func (w *timestampWriter) Write(line []byte) (int, error) {
+	now := time.Now()
+	stamp := now.UTC().Format("2006-01-02T15:04:05.000000Z07:00")
+	if w.format == "unix" {
+		stamp = fmt.Sprintf("%d.%06d", now.Unix(), now.Nanosecond()/1000)
+	}
+	// One write per line, so lines from several goroutines do not mix
+	if _, err := w.out.Write(append([]byte(stamp+" "), line...)); err != nil {
+		return 0, err
+	}
+	return len(line), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadLookupFile reads a CSV file of raw,label pairs used to translate raw
+// register values into labels. Raw values may be decimal or 0x-prefixed hex.
+// An optional header row and lines starting with # are ignored.
+func loadLookupFile(path string) (map[int64]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	lookup := make(map[int64]string)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		raw, err := strconv.ParseInt(strings.TrimSpace(record[0]), 0, 64)
+		if err != nil {
+			if line == 1 {
+				// Header row
+				continue
+			}
+			return nil, fmt.Errorf("%s: invalid raw value %q", path, record[0])
+		}
+		lookup[raw] = strings.TrimSpace(record[1])
+	}
+	return lookup, nil
+}
+
+// applyLookup translates each value into its label, or unknown(N) if it has none
+func applyLookup[T int16 | uint16](values []T, lookup map[int64]string) []string {
+	labels := make([]string, len(values))
+	for i, value := range values {
+		label, ok := lookup[int64(value)]
+		if !ok {
+			label = fmt.Sprintf("unknown(%d)", value)
+		}
+		labels[i] = label
+	}
+	return labels
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsShutdownTimeout is how long close waits for scrapes in progress
+const metricsShutdownTimeout = 2 * time.Second
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram buckets
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// labelEscaper escapes label values for the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricPoint identifies a value by its table and address and, for register
+// map points, its name
+type metricPoint struct {
+	table   string
+	address int
+	name    string
+}
+
+// metrics serves the last read values and operation counters in the
+// Prometheus text format on --metrics-addr, turning a polling run into a
+// small exporter. It is updated by the result printer and the session and
+// read by the HTTP server, so every access holds mu. Scrapes only report what
+// the poll loop last saw; they never cause Modbus traffic.
+type metrics struct {
+	server *http.Server
+	labels string
+
+	mu         sync.Mutex
+	operations uint64
+	errors     uint64
+	values     map[metricPoint]float64
+
+	// up is 1 while the device answers requests, with data or an exception
+	up float64
+
+	// buckets counts the requests up to each of latencyBuckets, cumulatively
+	// as they are written
+	buckets      []uint64
+	latencyCount uint64
+	latencySum   float64
+}
+
+// startMetrics listens on addr and serves /metrics in the background. The
+// listener is opened here, so a busy port is reported before polling starts.
+func startMetrics(addr string, args *ModbusArgs) (*metrics, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m := &metrics{
+		labels:  fmt.Sprintf(`server="%s",unit="%d"`, labelEscaper.Replace(net.JoinHostPort(args.Server, strconv.FormatUint(uint64(args.Port), 10))), args.UnitID),
+		values:  make(map[metricPoint]float64),
+		buckets: make([]uint64, len(latencyBuckets)),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	m.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := m.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logErrorf("Error serving metrics: %v", err)
+		}
+	}()
+	logInfof("Serving metrics on http://%s/metrics", listener.Addr())
+	return m, nil
+}
+
+// record counts one operation result. The values of successful reads replace
+// the previous values of their points, point(i) being that of the i-th value;
+// coils and inputs count as 0 or 1, and values that are not numbers, such as
+// strings, are left out.
+func (m *metrics) record(read bool, values []interface{}, point func(int) metricPoint, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.operations++
+	if err != nil {
+		m.errors++
+		return
+	}
+	if !read {
+		return
+	}
+	for i, value := range values {
+		if number, ok := numeric(value); ok {
+			m.values[point(i)] = number
+		}
+	}
+}
+
+// observe adds the round-trip time of one request to the latency histogram
+func (m *metrics) observe(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			m.buckets[i]++
+		}
+	}
+	m.latencyCount++
+	m.latencySum += seconds
+}
+
+// setUp records whether the device answered the latest request
+func (m *metrics) setUp(up bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.up = 0
+	if up {
+		m.up = 1
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP modbus_client_up Whether the device answered the latest request.")
+	fmt.Fprintln(w, "# TYPE modbus_client_up gauge")
+	fmt.Fprintf(w, "modbus_client_up{%s} %v\n", m.labels, m.up)
+	fmt.Fprintln(w, "# HELP modbus_client_operations_total Operations performed, including failed ones.")
+	fmt.Fprintln(w, "# TYPE modbus_client_operations_total counter")
+	fmt.Fprintf(w, "modbus_client_operations_total{%s} %d\n", m.labels, m.operations)
+	fmt.Fprintln(w, "# HELP modbus_client_errors_total Operations that failed.")
+	fmt.Fprintln(w, "# TYPE modbus_client_errors_total counter")
+	fmt.Fprintf(w, "modbus_client_errors_total{%s} %d\n", m.labels, m.errors)
+
+	fmt.Fprintln(w, "# HELP modbus_client_request_duration_seconds Round-trip time of requests, including failed ones.")
+	fmt.Fprintln(w, "# TYPE modbus_client_request_duration_seconds histogram")
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "modbus_client_request_duration_seconds_bucket{%s,le=\"%v\"} %d\n", m.labels, bound, m.buckets[i])
+	}
+	fmt.Fprintf(w, "modbus_client_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", m.labels, m.latencyCount)
+	fmt.Fprintf(w, "modbus_client_request_duration_seconds_sum{%s} %v\n", m.labels, m.latencySum)
+	fmt.Fprintf(w, "modbus_client_request_duration_seconds_count{%s} %d\n", m.labels, m.latencyCount)
+
+	points := make([]metricPoint, 0, len(m.values))
+	for point := range m.values {
+		points = append(points, point)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].table != points[j].table {
+			return points[i].table < points[j].table
+		}
+		if points[i].address != points[j].address {
+			return points[i].address < points[j].address
+		}
+		return points[i].name < points[j].name
+	})
+	fmt.Fprintln(w, "# HELP modbus_client_value Last value read from each address of each table, scaled as with --scale or the register map; coils and inputs are 0 or 1.")
+	fmt.Fprintln(w, "# TYPE modbus_client_value gauge")
+	for _, point := range points {
+		labels := fmt.Sprintf(`%s,table="%s",address="%d"`, m.labels, point.table, point.address)
+		if point.name != "" {
+			labels += fmt.Sprintf(`,name="%s"`, labelEscaper.Replace(point.name))
+		}
+		fmt.Fprintf(w, "modbus_client_value{%s} %v\n", labels, m.values[point])
+	}
+}
+
+// close stops the server, giving scrapes in progress a moment to finish
+func (m *metrics) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+	defer cancel()
+	if err := m.server.Shutdown(ctx); err != nil {
+		logErrorf("Error stopping metrics server: %v", err)
+	}
+}
@@ -1,11 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/goburrow/modbus"
 	"github.com/spf13/pflag"
@@ -24,211 +36,2084 @@ type ModbusArgs struct {
 	Repeat    int
 	Interval  int
 	Unsigned  bool
+	AllowWrap bool
+	Verbose   bool
+	LogLevel  string
+	Quiet     bool
+	ByteOrder string
+	Framing   string
+	Format    string
+	Output    string
+
+	RepeatSuccess int
+	MaxAttempts   int
+	Retries       int
+	RetryDelay    int
+	OnChange      bool
+
+	RetryNonIdempotent bool
+
+	TLS         bool
+	TLSCA       string
+	TLSCert     string
+	TLSKey      string
+	TLSInsecure bool
+
+	ConnectTimeout  time.Duration
+	ResponseTimeout time.Duration
+
+	ReconnectDelay       time.Duration
+	MaxReconnectAttempts int
+
+	Report     string
+	LookupFile string
+
+	PayloadTransform   string
+	PayloadKeyRegister uint16
+
+	WebhookURL     string
+	WebhookHeaders []string
+	WebhookRetries int
+
+	Pattern   string
+	Cycles    int
+	LeaveAsIs bool
+
+	PatternStart int64
+	PatternStep  int64
+	PatternMin   int64
+	PatternMax   int64
+	PatternClamp bool
+	Seed         int64
+	Amplitude    float64
+	Midpoint     float64
+	Period       time.Duration
+	Phase        float64
+
+	WriteStrategy string
+	Verify        bool
+	WriteStart    uint16
+	AndMask       uint16
+	Bits          []int
+	OrMask        uint16
+
+	Preflight           bool
+	PreflightAddress    uint16
+	PreflightAddressSet bool
+
+	Map    string
+	Points []string
+
+	Type       string
+	StringSwap bool
+	ValueText  string
+	ValueTexts []string
+	ValuesFile string
+
+	Scale  float64
+	Offset float64
+
+	Explain bool
+
+	Script      string
+	StopOnError bool
+	Interactive bool
+
+	MetricsAddr string
+
+	UnitStart    uint8
+	UnitEnd      uint8
+	Probe        string
+	ProbeTimeout time.Duration
+	Parallel     int
+
+	Table string
+	End   uint16
+	Chunk uint16
+	Dump  string
+
+	Stats      bool
+	StatsEvery int
+
+	TimestampFormat string
+
+	Raw bool
+
+	DryRun bool
+
+	SubFunction uint16
+	DataText    string
+	Data        []byte
+
+	PDUText string
+	PDU     []byte
+
+	Config string
+
+	BlockTexts []string
+	Blocks     []pollBlock
+}
+
+// parseFlags parses the command-line arguments and returns a ModbusArgs struct,
+// or an error describing the first invalid argument. Exiting is left to main.
+func parseFlags() (*ModbusArgs, error) {
+	args := &ModbusArgs{}
+
+	pflag.StringVarP(&args.Server, "server", "s", "", "The IP address or hostname of the Modbus TCP server.")
+	pflag.UintVarP(&args.Port, "port", "p", 502, "The port number of the Modbus TCP server.")
+	pflag.Uint8VarP(&args.UnitID, "unitid", "d", 1, "The unit id of the Modbus TCP server.")
+	pflag.Uint8VarP(&args.UnitStart, "unit-start", "", 1, "The first unit id tried by scan_units.")
+	pflag.Uint8VarP(&args.UnitEnd, "unit-end", "", 247, "The last unit id tried by scan_units.")
+	pflag.StringVarP(&args.Probe, "probe", "", "register", "The request scan_units sends to each unit id. \nregister (FC03 read of --start)/device_id (FC43 Read Device Identification)")
+	pflag.DurationVarP(&args.ProbeTimeout, "probe-timeout", "", 500*time.Millisecond, "How long scan_units waits for each unit id to answer, e.g. 200ms.")
+	pflag.StringVarP(&args.Table, "table", "", "holding", "The table scan_registers reads. \nholding/input/coil/discrete")
+	pflag.Uint16VarP(&args.End, "end", "", 0, "The last address scan_registers reads, instead of --count.")
+	pflag.Uint16VarP(&args.Chunk, "chunk", "", 1, "The number of addresses scan_registers reads per request. A chunk answered with an exception is read again one address at a time.")
+	pflag.StringVarP(&args.Dump, "dump", "", "", "Write the values scan_registers finds to this CSV file.")
+	pflag.IntVarP(&args.Parallel, "parallel", "", 1, "The number of unit ids scan_units probes at once, each over its own connection.")
+	pflag.Uint16VarP(&args.SubFunction, "subfunction", "", 0, "The sub-function sent by diagnostics, e.g. 0 (echo), 0x0B (bus message count) or 0x0C (CRC error count).")
+	pflag.StringVarP(&args.DataText, "data", "", "0000", "The data sent by diagnostics, in hex.")
+	pflag.StringVarP(&args.PDUText, "pdu", "", "", "The request sent by raw: function code and data in hex, e.g. 0x41 0001.")
+	pflag.StringVarP(&args.Operation, "operation", "o", "", "The operation to perform. \nread_coils/read_discrete_inputs/read_holding_registers/read_input_registers\nwrite_single_coil/write_single_register/write_multiple_coils/write_multiple_registers\nread_write_multiple_registers/mask_write_register/read_device_id/coil_pattern\nset_bits/clear_bits/toggle_bits (change --bits of the holding register at --start by reading and writing it back)\nread_fifo_queue (the FIFO queue at pointer address --start)/read_exception_status\ndiagnostics (FC08 --subfunction with --data)/raw (any request given with --pdu)\nscan_units (find the unit ids that answer a read of --start)/scan_registers (find the readable addresses of --table from --start to --end)\nread (named --point values from --map)/repl (same as --interactive)")
+	pflag.IntVarP(&args.Repeat, "repeat", "r", 1, "The number of times the operation should be repeated. If set to 0, repeat until interrupted.")
+	pflag.IntVarP(&args.RepeatSuccess, "repeat-success", "", 0, "Repeat the operation until this many attempts have succeeded, retrying failures. Overrides --repeat.")
+	pflag.IntVarP(&args.MaxAttempts, "max-attempts", "", 0, "The maximum number of attempts allowed with --repeat-success. If set to 0, there is no limit.")
+	pflag.IntVarP(&args.Retries, "retries", "", 0, "The number of times a failed operation is retried before it counts as failed.")
+	pflag.IntVarP(&args.RetryDelay, "retry-delay", "", 100, "The delay (in milliseconds) before each retry.")
+	pflag.BoolVarP(&args.RetryNonIdempotent, "retry-non-idempotent", "", false, "Also resend operations that are not safe to repeat after a timeout or lost connection, when the first request may have been applied.")
+	pflag.IntVarP(&args.Interval, "interval", "i", 1000, "The interval (in milliseconds) between operation repeats.")
+	pflag.BoolVarP(&args.OnChange, "on-change", "", false, "Only print a repeated read when its values differ from the previous successful read.")
+	pflag.BoolVarP(&args.Unsigned, "unsigned", "u", false, "Interpret read/write values as unsigned integers. Redundant with --type uint16, uint32, uint64 or bcd, and an error with any other --type.")
+	pflag.BoolVarP(&args.AllowWrap, "allow-wrap", "", false, "Accept write values outside the range of the selected signedness and send them as 16-bit two's complement, e.g. 65535 as -1.")
+	pflag.BoolVarP(&args.Verbose, "verbose", "v", false, "Log the raw register values transmitted by write operations, and payload data before and after --payload-transform. Same as --log-level debug.")
+	pflag.StringVarP(&args.LogLevel, "log-level", "", "info", "The lowest level of log lines shown. \ndebug (as --verbose)/info (results and progress)/warn (recovered problems such as retries and reconnects)/error (failed operations)")
+	pflag.StringVarP(&args.TimestampFormat, "timestamp-format", "", "default", "The timestamp of log lines, including the results of text output. \ndefault (local date and time)/rfc3339 (UTC with microseconds)/unix (seconds since 1970 with microseconds)/none")
+	pflag.BoolVarP(&args.Quiet, "quiet", "q", false, "Only log warnings and errors, not the result of every successful operation. Same as --log-level warn.")
+	pflag.StringVarP(&args.ByteOrder, "byteorder", "", "ABCD", "The byte/word order of register values on the device. \nABCD (big-endian)/DCBA (little-endian)/BADC (byte-swapped)/CDAB (word-swapped, registers in reverse order for 32- and 64-bit values)")
+	pflag.StringVarP(&args.ByteOrder, "byte-order", "", "ABCD", "Alias for --byteorder.")
+	pflag.StringVarP(&args.Framing, "framing", "", "tcp", "The framing used on the TCP connection. \ntcp (Modbus TCP, MBAP header)/rtu-over-tcp (raw RTU frames with CRC, e.g. serial-to-ethernet converters)")
+	pflag.StringVarP(&args.Framing, "transport", "", "tcp", "Alias for --framing; rtuovertcp is accepted for rtu-over-tcp.")
+	pflag.BoolVarP(&args.TLS, "tls", "", false, "Use Modbus/TCP Security (TLS). The default port becomes 802.")
+	pflag.StringVarP(&args.TLSCA, "tls-ca", "", "", "The PEM file of CA certificates used to verify the server. Defaults to the system roots.")
+	pflag.StringVarP(&args.TLSCert, "tls-cert", "", "", "The PEM file of the client certificate.")
+	pflag.StringVarP(&args.TLSKey, "tls-key", "", "", "The PEM file of the client private key.")
+	pflag.BoolVarP(&args.TLSInsecure, "tls-insecure", "", false, "Skip verification of the server certificate.")
+	pflag.DurationVarP(&args.ConnectTimeout, "connect-timeout", "", 10*time.Second, "The timeout for establishing the connection, e.g. 500ms or 3s. If set to 0, wait forever.")
+	pflag.DurationVarP(&args.ResponseTimeout, "response-timeout", "", 10*time.Second, "The timeout for each request/response exchange, e.g. 500ms or 3s. If set to 0, wait forever.")
+	var timeoutMs int
+	pflag.IntVarP(&timeoutMs, "timeout", "", 0, "The connect and response timeout in milliseconds, unless set separately. If set to 0, the default of 10s is used.")
+	pflag.DurationVarP(&args.ReconnectDelay, "reconnect-delay", "", time.Second, "The delay before each attempt to re-establish a lost connection.")
+	pflag.IntVarP(&args.MaxReconnectAttempts, "max-reconnect-attempts", "", 3, "The number of reconnect attempts before giving up. If set to 0, retry until interrupted.")
+	pflag.StringVarP(&args.Format, "format", "", "text", "The output format for operation results. \ntext (log lines)/hex (log lines with raw register words or coil bytes in hex)/json (one JSON object per line on stdout, errors on stderr)/csv (header row, then one row per result on stdout)\nbinlog (compact binary records in the --output file, see readlog)")
+	pflag.StringVarP(&args.Output, "output", "", "", "Write json or csv results to this file instead of stdout.")
+	pflag.StringVarP(&args.PayloadTransform, "payload-transform", "", "", "Scramble request and response data for devices that obfuscate payloads. \nxor (XOR with a session key read from --payload-key-register)")
+	pflag.Uint16VarP(&args.PayloadKeyRegister, "payload-key-register", "", 0, "The holding register read in clear to obtain the session key for --payload-transform xor.")
+	pflag.StringVarP(&args.WebhookURL, "webhook-url", "", "", "POST each result as JSON to this URL. Results are queued so a slow receiver does not stall polling.")
+	pflag.StringArrayVarP(&args.WebhookHeaders, "webhook-header", "", nil, "An HTTP header sent with every webhook post, e.g. \"Authorization: Bearer TOKEN\". Repeat for several headers.")
+	pflag.IntVarP(&args.WebhookRetries, "webhook-retries", "", 2, "The number of times a failed webhook post is retried before the result is given up.")
+	pflag.StringVarP(&args.MetricsAddr, "metrics-addr", "", "", "Serve the last read values and operation counters for Prometheus on this address, e.g. :9100, at /metrics.")
+	pflag.StringVarP(&args.MetricsAddr, "exporter", "", "", "Run as a Prometheus exporter on this address, e.g. :9602: like --metrics-addr, but polling until interrupted and reconnecting for as long as it takes.")
+	pflag.StringVarP(&args.Report, "report", "", "", "Append a Markdown record of every operation and a summary to this file.")
+	pflag.StringVarP(&args.Map, "map", "", "", "A JSON register map of named points (name, table, address, datatype, scale, unit).")
+	pflag.StringArrayVarP(&args.Points, "point", "", nil, "A register map point read by the read operation, which is the default with --point. Repeat to read several points.")
+	// --name is bound apart from --point, as two array flags sharing a slice
+	// would each replace the other's values; parseFlags merges them
+	var names []string
+	pflag.StringArrayVarP(&names, "name", "", nil, "Alias for --point.")
+	pflag.StringVarP(&args.LookupFile, "lookup-file", "", "", "A CSV file of raw,label pairs used to translate read values into labels.")
+	pflag.StringVarP(&args.Pattern, "pattern", "", "chase", "The pattern written by coil_pattern, or by each repeat of a register write. \nchase (one coil on)/walking_zero (one coil off)/blink (all on, then all off)\nramp (register values from --pattern-start in --pattern-step steps)/random (random register values or coil states)\nsine/triangle/sawtooth (a wave of --amplitude around --midpoint every --period)")
+	pflag.Int64VarP(&args.PatternStart, "pattern-start", "", 0, "The first value written by --pattern ramp.")
+	pflag.Int64VarP(&args.PatternStep, "pattern-step", "", 1, "The change of the value written by --pattern ramp in each repeat. May be negative.")
+	pflag.Int64VarP(&args.PatternMin, "pattern-min", "", 0, "The lowest register value --pattern ramp or random writes. Defaults to the lowest of the register's signedness.")
+	pflag.Int64VarP(&args.PatternMax, "pattern-max", "", 0, "The highest register value --pattern ramp or random writes. Defaults to the highest of the register's signedness.")
+	pflag.Int64VarP(&args.Seed, "seed", "", 0, "The seed of the values written by --pattern random, to repeat an earlier run. Defaults to a new seed, which is logged.")
+	pflag.Float64VarP(&args.Amplitude, "amplitude", "", 1, "The amplitude of a --pattern sine, triangle or sawtooth wave, in scaled units.")
+	pflag.Float64VarP(&args.Midpoint, "midpoint", "", 0, "The value a --pattern sine, triangle or sawtooth wave swings around, in scaled units.")
+	pflag.DurationVarP(&args.Period, "period", "", time.Minute, "The period of a --pattern sine, triangle or sawtooth wave.")
+	pflag.Float64VarP(&args.Phase, "phase", "", 0, "The phase lag, in degrees, of each register of a wave written by write_multiple_registers behind the one before.")
+	pflag.BoolVarP(&args.PatternClamp, "pattern-clamp", "", false, "Stay at --pattern-min or --pattern-max once a ramp reaches it, instead of wrapping around to the other.")
+	pflag.IntVarP(&args.Cycles, "cycles", "", 0, "The number of complete pattern cycles written by coil_pattern. If set to 0, run until interrupted.")
+	pflag.BoolVarP(&args.LeaveAsIs, "leave-as-is", "", false, "Leave the coils in their last pattern state instead of switching them off when coil_pattern ends.")
+	pflag.StringVarP(&args.WriteStrategy, "write-strategy", "", "auto", "The function codes used for register writes. \nauto (the operation's own code, falling back to the other on Illegal Function)/single (FC06 per register)/multiple (FC16)")
+	pflag.BoolVarP(&args.Verify, "verify", "", false, "Read back the coils or registers after each write and warn if they differ from the written values.")
+	pflag.BoolVarP(&args.Preflight, "preflight", "", false, "Before a write operation, read one coil or holding register and write the same value back, and stop if the device rejects it.")
+	pflag.Uint16VarP(&args.PreflightAddress, "preflight-address", "", 0, "The coil or holding register used by --preflight. Defaults to the first write target.")
+	pflag.Uint16VarP(&args.Start, "start", "", 0, "The starting address for read or write operations.")
+	pflag.Uint16VarP(&args.Count, "count", "", 1, "The number of registers to read.")
+	pflag.Uint16VarP(&args.AndMask, "and-mask", "", 0xFFFF, "The AND mask for mask_write_register. Bits cleared here are replaced by the OR mask.")
+	pflag.Uint16VarP(&args.OrMask, "or-mask", "", 0, "The OR mask for mask_write_register.")
+	pflag.IntSliceVarP(&args.Bits, "bits", "", nil, "The comma-separated bit numbers, 0 (least significant) to 15, changed by set_bits, clear_bits and toggle_bits. Example: 3,7")
+	pflag.Uint16VarP(&args.WriteStart, "write-start", "", 0, "The starting address for the write part of read_write_multiple_registers.")
+	pflag.Uint16VarP(&args.Start, "read-start", "", 0, "Alias for --start, the starting address for the read part of read_write_multiple_registers.")
+	pflag.Uint16VarP(&args.Count, "read-count", "", 1, "Alias for --count, the number of registers (or --type values) read by read_write_multiple_registers.")
+	pflag.StringVarP(&args.Type, "type", "", "", "The datatype of register values. Counts and write values refer to whole values of this type. \nint16/uint16/bcd (4 packed decimal digits, 0x1234 = 1234) (1 register)/int32/uint32 (2 registers)/int64/uint64 (4 registers)\nfloat32 (IEEE-754, 2 registers)/float64 (IEEE-754 double, 4 registers)\nstring (--count registers of two ASCII characters each; writes take the string from --value)\nIf not set, registers are 16-bit integers (see --unsigned).")
+	pflag.StringVarP(&args.Type, "datatype", "", "", "Alias for --type.")
+	pflag.BoolVarP(&args.StringSwap, "string-swap", "", false, "Decode --type string registers low byte first.")
+	pflag.Float64VarP(&args.Scale, "scale", "", 1, "Multiply read register values by this factor, e.g. 0.1. Register write values are divided by it.")
+	pflag.Float64VarP(&args.Offset, "offset", "", 0, "Add this offset to read register values after scaling. It is subtracted from register write values before.")
+	pflag.StringVarP(&args.ValueText, "value", "", "0", "The value for single write operations, in decimal or as a 0x hex or 0b binary literal. A single coil takes on/off, true/false or 1/0.")
+	pflag.StringSliceVarP(&args.ValueTexts, "values", "", nil, "The comma-separated values for multiple write operations. Example: 1,0x10,0b101")
+	pflag.StringVarP(&args.ValuesFile, "values-file", "", "", "Read the values for multiple write operations from this file, or from stdin if -, separated by commas or newlines. Replaces --values.")
+	pflag.StringVarP(&args.Script, "script", "", "", "A JSON file of steps (operation, start, count, value(s), delay) run in order over one connection, instead of --operation. --repeat and --interval apply to the whole sequence.")
+	pflag.BoolVarP(&args.StopOnError, "stop-on-error", "", false, "Stop a --script at the first failed step.")
+	pflag.BoolVarP(&args.Interactive, "interactive", "", false, "Keep the connection open and read commands such as \"rh 100 4\" or \"wr 200 1234\" from stdin. Type help for a list.")
+	pflag.BoolVarP(&args.Explain, "explain", "", false, "Print the connection, the requests of each cycle, how responses are decoded and where results go, then exit without connecting.")
+
+	pflag.BoolVarP(&args.DryRun, "dry-run", "", false, "Log the function code, address, quantity and data of every write instead of sending it. Reads are still sent.")
+	pflag.BoolVarP(&args.Raw, "raw", "", false, "Also log the data of every read response as a hex dump, e.g. 00 0A FF 01, before it is decoded.")
+	pflag.BoolVarP(&args.Stats, "stats", "", false, "Time every request and log min/avg/max, standard deviation and p50/p95/p99 latency at the end of the run.")
+	pflag.IntVarP(&args.StatsEvery, "stats-every", "", 0, "Also log the latency statistics every this many requests. Implies --stats.")
+	pflag.StringArrayVarP(&args.BlockTexts, "block", "", nil, "A block polled concurrently with the others, as TABLE:START:COUNT:INTERVAL with table co, di, hr or ir and the interval in ms, e.g. hr:0:10:1000. Repeat for several blocks; replaces --operation.")
+	pflag.StringVarP(&args.Config, "config", "", "", "A JSON file of default settings keyed by long flag name, e.g. {\"server\": \"10.0.0.5\", \"unitid\": 3}. Flags given on the command line override it.")
+
+	pflag.Parse()
+
+	// Settings from --config apply to the flags not given on the command line
+	if args.Config != "" {
+		if err := applyConfig(args.Config, pflag.CommandLine); err != nil {
+			return nil, fmt.Errorf("Error loading config: %v", err)
+		}
+	}
+
+	// Timestamp the log lines from here on
+	if err := setTimestampFormat(args.TimestampFormat); err != nil {
+		return nil, err
+	}
+
+	// read_write_registers is the short name of read_write_multiple_registers
+	if args.Operation == "read_write_registers" {
+		args.Operation = "read_write_multiple_registers"
+	}
+	// -o repl is another way to ask for --interactive
+	if args.Operation == "repl" {
+		args.Operation, args.Interactive = "", true
+	}
+
+	// Named points are read with the read operation
+	args.Points = append(args.Points, names...)
+	if args.Operation == "" && len(args.Points) > 0 {
+		args.Operation = "read"
+	}
+	if len(args.Points) > 0 && args.Operation != "read" {
+		return nil, fmt.Errorf("--point only works with the read operation, not %s", args.Operation)
+	}
+
+	// Validate log level
+	level, ok := logLevels[strings.ToLower(args.LogLevel)]
+	if !ok {
+		return nil, fmt.Errorf("Invalid log level: %s", args.LogLevel)
+	}
+	if args.Quiet {
+		if pflag.CommandLine.Changed("log-level") {
+			return nil, errors.New("--quiet cannot be combined with --log-level")
+		}
+		level = levelWarn
+	}
+	if args.Verbose {
+		level = levelDebug
+	}
+	args.Verbose = level == levelDebug
+	minLogLevel = level
+
+	// Validate server address
+	if args.Server == "" {
+		return nil, errors.New("Server address is required")
+	}
+
+	// Validate byte order
+	args.ByteOrder = strings.ToUpper(args.ByteOrder)
+	switch args.ByteOrder {
+	case "ABCD", "DCBA", "BADC", "CDAB":
+	default:
+		return nil, fmt.Errorf("Invalid byte order: %s", args.ByteOrder)
+	}
+
+	// Validate framing
+	if args.Framing == "rtuovertcp" {
+		args.Framing = "rtu-over-tcp"
+	}
+	switch args.Framing {
+	case "tcp", "rtu-over-tcp":
+	default:
+		return nil, fmt.Errorf("Invalid framing: %s", args.Framing)
+	}
+
+	// Modbus/TCP Security uses MBAP framing on its own well-known port
+	if args.TLS {
+		if args.Framing != "tcp" {
+			return nil, fmt.Errorf("--tls cannot be combined with --framing %s", args.Framing)
+		}
+		if !pflag.CommandLine.Changed("port") {
+			args.Port = 802
+		}
+	}
+
+	// Validate payload transform
+	switch args.PayloadTransform {
+	case "", "xor":
+	default:
+		return nil, fmt.Errorf("Invalid payload transform: %s", args.PayloadTransform)
+	}
+
+	// Validate webhook URL
+	if args.WebhookURL != "" && !strings.HasPrefix(args.WebhookURL, "http://") && !strings.HasPrefix(args.WebhookURL, "https://") {
+		return nil, fmt.Errorf("Invalid webhook URL: %s", args.WebhookURL)
+	}
+	for _, header := range args.WebhookHeaders {
+		if name, _, ok := strings.Cut(header, ":"); !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("Invalid webhook header %q, expected \"Name: value\"", header)
+		}
+	}
+	if args.WebhookRetries < 0 {
+		return nil, errors.New("--webhook-retries must not be negative")
+	}
+
+	// Validate write strategy
+	switch args.WriteStrategy {
+	case "auto", writeSingle, writeMultiple:
+	default:
+		return nil, fmt.Errorf("Invalid write strategy: %s", args.WriteStrategy)
+	}
+
+	// Validate coil pattern
+	switch args.Pattern {
+	case "chase", "walking_zero", "blink":
+		if args.Operation == "coil_pattern" {
+			break
+		}
+		if pflag.CommandLine.Changed("pattern") {
+			return nil, fmt.Errorf("--pattern %s only works with coil_pattern", args.Pattern)
+		}
+	default:
+		if writePatterns[args.Pattern] == nil {
+			return nil, fmt.Errorf("Invalid pattern: %s", args.Pattern)
+		}
+		if err := validatePattern(args, pflag.CommandLine.Changed("pattern-min"), pflag.CommandLine.Changed("pattern-max")); err != nil {
+			return nil, err
+		}
+		if args.Pattern == "random" && !pflag.CommandLine.Changed("seed") {
+			args.Seed = time.Now().UnixNano()
+			logInfof("Random seed %d (repeat this run with --seed %d)", args.Seed, args.Seed)
+		}
+	}
+	if args.Cycles < 0 {
+		return nil, fmt.Errorf("Invalid cycles: %d", args.Cycles)
+	}
+
+	// --output used to select the format, which is still accepted for now
+	switch args.Output {
+	case "text", "hex", "json", "csv":
+		if pflag.CommandLine.Changed("format") && args.Format != args.Output {
+			return nil, fmt.Errorf("--output %s contradicts --format %s; --output takes a file name", args.Output, args.Format)
+		}
+		logWarnf("--output %s is deprecated, use --format %s (--output now takes a file name)", args.Output, args.Output)
+		args.Format, args.Output = args.Output, ""
+	case "binlog":
+		return nil, errors.New("--output takes a file name; use --format binlog --output FILE")
+	}
+
+	// Validate output format
+	switch args.Format {
+	case "text", "hex", "json", "csv":
+	case "binlog":
+		if args.Output == "" {
+			return nil, errors.New("--format binlog needs a file name in --output")
+		}
+	default:
+		return nil, fmt.Errorf("Invalid output format: %s", args.Format)
+	}
+
+	// Validate script and interactive mode
+	if args.Script != "" && args.Interactive {
+		return nil, errors.New("--script cannot be combined with --interactive")
+	}
+	if args.Script != "" || args.Interactive {
+		mode := "--script"
+		if args.Interactive {
+			mode = "--interactive"
+		}
+		switch {
+		case args.Operation != "":
+			return nil, fmt.Errorf("%s replaces --operation, give only one of them", mode)
+		case args.Format == "csv" || args.Format == "binlog":
+			return nil, fmt.Errorf("--format %s needs a single operation and cannot be used with %s", args.Format, mode)
+		case args.Preflight && args.Interactive:
+			return nil, errors.New("--preflight cannot be used with --interactive")
+		case args.RepeatSuccess > 0:
+			return nil, fmt.Errorf("--repeat-success cannot be used with %s", mode)
+		}
+	}
+
+	// Blocks are polled concurrently in place of --operation
+	if len(args.BlockTexts) > 0 {
+		switch {
+		case args.Operation != "" || args.Script != "" || args.Interactive:
+			return nil, errors.New("--block replaces --operation, --script and --interactive")
+		case args.Format == "csv" || args.Format == "binlog":
+			return nil, fmt.Errorf("--format %s needs a single operation and cannot be used with --block", args.Format)
+		case args.Report != "" || args.WebhookURL != "" || args.PayloadTransform != "":
+			return nil, errors.New("--report, --webhook-url and --payload-transform cannot be used with --block")
+		}
+		for _, text := range args.BlockTexts {
+			block, err := parseBlock(text)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid block: %v", err)
+			}
+			args.Blocks = append(args.Blocks, block)
+		}
+	}
+
+	// Validate scans
+	if args.Operation == "scan_units" && args.UnitStart > args.UnitEnd {
+		return nil, fmt.Errorf("Invalid unit range: %d to %d", args.UnitStart, args.UnitEnd)
+	}
+	if args.Operation == "scan_registers" {
+		if _, ok := scanTables[args.Table]; !ok {
+			return nil, fmt.Errorf("Invalid table: %s", args.Table)
+		}
+		if pflag.CommandLine.Changed("end") && args.End < args.Start {
+			return nil, fmt.Errorf("Invalid range: %d to %d", args.Start, args.End)
+		}
+		limit := maxReadRegisters
+		if args.Table == "coil" || args.Table == "discrete" {
+			limit = maxReadBits
+		}
+		if args.Chunk == 0 || int(args.Chunk) > limit {
+			return nil, fmt.Errorf("Invalid chunk: %d (must be 1 to %d)", args.Chunk, limit)
+		}
+	}
+	if args.Probe != "register" && args.Probe != "device_id" {
+		return nil, fmt.Errorf("Invalid probe: %s", args.Probe)
+	}
+	if args.ProbeTimeout <= 0 || args.Parallel < 1 {
+		return nil, errors.New("The probe timeout and --parallel must be positive")
+	}
+	if (args.Operation == "scan_units" || args.Operation == "scan_registers") && !pflag.CommandLine.Changed("interval") {
+		args.Interval = scanInterval
+	}
+
+	// Labels replace plain 16-bit register values, before any decoding
+	if args.LookupFile != "" {
+		switch {
+		case args.Operation != "read_holding_registers" && args.Operation != "read_input_registers":
+			return nil, fmt.Errorf("--lookup-file only applies to register reads, not %s", args.Operation)
+		case args.Type != "":
+			return nil, fmt.Errorf("--lookup-file labels raw 16-bit register values and cannot be combined with --type %s", args.Type)
+		case args.Scale != 1 || args.Offset != 0:
+			return nil, errors.New("--lookup-file labels raw register values and cannot be combined with --scale or --offset")
+		}
+	}
+
+	// Validate diagnostics
+	if args.Operation == "diagnostics" {
+		if args.Preflight {
+			return nil, errors.New("--preflight does not apply to diagnostics")
+		}
+		var err error
+		if args.Data, err = parseHexBytes(args.DataText); err != nil {
+			return nil, fmt.Errorf("Invalid data: %v", err)
+		}
+	}
+
+	// Validate raw requests
+	if args.Operation == "raw" {
+		if args.Preflight {
+			return nil, errors.New("--preflight does not apply to raw")
+		}
+		var err error
+		if args.PDU, err = parseHexBytes(args.PDUText); err != nil {
+			return nil, fmt.Errorf("Invalid PDU: %v", err)
+		}
+		if len(args.PDU) == 0 || args.PDU[0] == 0 || args.PDU[0] >= 0x80 {
+			return nil, errors.New("Invalid PDU: it must start with a function code from 0x01 to 0x7F")
+		}
+	}
+
+	// Probe the first write target unless told otherwise; a script probes
+	// that of its first write step
+	args.PreflightAddressSet = pflag.CommandLine.Changed("preflight-address")
+	if !args.PreflightAddressSet {
+		args.PreflightAddress = args.Start
+		if args.Operation == "read_write_multiple_registers" {
+			args.PreflightAddress = args.WriteStart
+		}
+	}
+
+	// An exporter keeps polling through connection losses, which modbus_client_up reports
+	if pflag.CommandLine.Changed("exporter") {
+		if !pflag.CommandLine.Changed("repeat") {
+			args.Repeat = 0
+		}
+		if !pflag.CommandLine.Changed("max-reconnect-attempts") {
+			args.MaxReconnectAttempts = 0
+		}
+	}
+
+	// Nothing is written in a dry run, so there is nothing to read back
+	if args.DryRun && args.Verify {
+		logWarnf("--verify is ignored with --dry-run")
+		args.Verify = false
+	}
+
+	// Validate the bits of set_bits, clear_bits and toggle_bits
+	if bitOperations[args.Operation] != nil {
+		if len(args.Bits) == 0 {
+			return nil, fmt.Errorf("%s needs --bits", args.Operation)
+		}
+		if _, err := bitMask(args.Bits); err != nil {
+			return nil, fmt.Errorf("Invalid bits: %v", err)
+		}
+	}
+
+	// Validate latency statistics
+	if args.StatsEvery < 0 {
+		return nil, errors.New("--stats-every must not be negative")
+	}
+	if args.StatsEvery > 0 {
+		args.Stats = true
+	}
+
+	// Validate retries
+	if args.Retries < 0 || args.RetryDelay < 0 {
+		return nil, errors.New("Retries and retry delay must not be negative")
+	}
+
+	// Validate timeouts
+	if timeoutMs > 0 {
+		if !pflag.CommandLine.Changed("connect-timeout") {
+			args.ConnectTimeout = time.Duration(timeoutMs) * time.Millisecond
+		}
+		if !pflag.CommandLine.Changed("response-timeout") {
+			args.ResponseTimeout = time.Duration(timeoutMs) * time.Millisecond
+		}
+	}
+	if timeoutMs < 0 || args.ConnectTimeout < 0 || args.ResponseTimeout < 0 {
+		return nil, errors.New("Timeouts must not be negative")
+	}
+
+	// Validate scaling
+	if args.Scale == 0 {
+		return nil, errors.New("Invalid scale: 0")
+	}
+
+	// Read the write values from a file or stdin
+	if args.ValuesFile != "" {
+		if pflag.CommandLine.Changed("values") {
+			return nil, errors.New("--values-file replaces --values, give only one of them")
+		}
+		values, err := readValuesFile(args.ValuesFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading values file: %v", err)
+		}
+		args.ValueTexts = values
+	}
+
+	// A write pattern generates the values, --count of them for the
+	// multiple writes
+	if writePatterns[args.Pattern] != nil {
+		if pflag.CommandLine.Changed("value") || pflag.CommandLine.Changed("values") || args.ValuesFile != "" {
+			return nil, fmt.Errorf("--pattern %s generates the write values, do not give any", args.Pattern)
+		}
+		if args.Operation == "write_multiple_registers" || args.Operation == "write_multiple_coils" {
+			args.ValueTexts = make([]string, args.Count)
+			for i := range args.ValueTexts {
+				args.ValueTexts[i] = "0"
+			}
+		}
+	}
+
+	if err := parseOperationValues(args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// parseOperationValues checks the datatype and count of the operation and
+// parses its write values into args.Value and args.Values
+func parseOperationValues(args *ModbusArgs) error {
+	// Validate datatype
+	if args.Type != "" && datatypeRegisters(args.Type) == 0 {
+		return fmt.Errorf("Invalid type: %s", args.Type)
+	}
+	if args.Unsigned && args.Type != "" && !strings.HasPrefix(args.Type, "uint") && args.Type != "bcd" {
+		return fmt.Errorf("--unsigned contradicts --type %s", args.Type)
+	}
+	if args.Type == "string" {
+		switch args.Operation {
+		case "read_holding_registers", "read_input_registers", "write_single_register", "write_multiple_registers":
+		default:
+			return errors.New("--type string is only supported by register reads and writes")
+		}
+	}
+
+	// Longer reads and writes are split into several requests, but must stay
+	// within the address range
+	switch args.Operation {
+	case "read_coils", "read_discrete_inputs", "read_holding_registers", "read_input_registers":
+		registers := int(args.Count)
+		if args.Type != "" && strings.HasSuffix(args.Operation, "_registers") {
+			registers *= datatypeRegisters(args.Type)
+		}
+		if args.Count == 0 {
+			limit, unit := maxReadBits, "coils or inputs"
+			if strings.HasSuffix(args.Operation, "_registers") {
+				limit, unit = maxReadRegisters, "registers"
+				if args.Type != "" && args.Type != "string" {
+					limit, unit = maxReadRegisters/datatypeRegisters(args.Type), args.Type+" values"
+				}
+			}
+			return fmt.Errorf("Invalid count: 0; %s reads 1 to %d %s per request, and splits longer reads into several requests", args.Operation, limit, unit)
+		}
+		if end := int(args.Start) + registers; end > 0x10000 {
+			return fmt.Errorf("Invalid count: reading %d values from %d goes past address 65535", args.Count, args.Start)
+		}
+	case "write_multiple_coils", "write_multiple_registers":
+		if args.Type == "string" {
+			// A string is one value, given with --value and checked below
+			break
+		}
+		registers := 1
+		if args.Type != "" && args.Operation == "write_multiple_registers" {
+			registers = datatypeRegisters(args.Type)
+		}
+		if len(args.ValueTexts) == 0 {
+			limit, unit := maxWriteCoils, "coils"
+			if args.Operation == "write_multiple_registers" {
+				limit, unit = writeChunkRegisters(args)/registers, "registers"
+				if registers > 1 {
+					unit = args.Type + " values"
+				}
+			}
+			return fmt.Errorf("Invalid values: none given; %s writes 1 to %d %s per request, and splits longer writes into several requests", args.Operation, limit, unit)
+		}
+		if end := int(args.Start) + len(args.ValueTexts)*registers; end > 0x10000 {
+			return fmt.Errorf("Invalid values: writing %d values from %d goes past address 65535", len(args.ValueTexts), args.Start)
+		}
+	}
+
+	// A string takes as many registers as its text needs, written in a
+	// single request
+	if args.Type == "string" && strings.HasPrefix(args.Operation, "write_") {
+		registers := len(encodeString(args.ValueText, false)) / registerSize
+		if registers == 0 {
+			return errors.New("Invalid value: the string is empty")
+		}
+		if registers > maxWriteRegisters {
+			return fmt.Errorf("Invalid value: the string takes %d registers, more than the %d a single write allows", registers, maxWriteRegisters)
+		}
+		if end := int(args.Start) + registers; end > 0x10000 {
+			return fmt.Errorf("Invalid value: writing %d registers from %d goes past address 65535", registers, args.Start)
+		}
+	}
+	if args.Type == "string" {
+		return nil
+	}
+
+	// FC23 carries the read and the write block in one request
+	if args.Operation == "read_write_multiple_registers" {
+		registers := 1
+		if args.Type != "" {
+			registers = datatypeRegisters(args.Type)
+		}
+		if read := int(args.Count) * registers; read == 0 || read > maxReadRegisters {
+			return fmt.Errorf("Invalid count: read_write_multiple_registers reads 1 to %d registers, not %d", maxReadRegisters, read)
+		}
+		if written := len(args.ValueTexts) * registers; written == 0 || written > maxReadWriteRegisters {
+			return fmt.Errorf("Invalid values: read_write_multiple_registers writes 1 to %d registers, not %d", maxReadWriteRegisters, written)
+		}
+	}
+
+	// Register write values are given in scaled units; convert them back
+	if args.Scale != 1 || args.Offset != 0 {
+		var err error
+		switch args.Operation {
+		case "write_single_register":
+			if args.ValueText, err = unscaleValue(args.ValueText, args); err != nil {
+				return err
+			}
+		case "write_multiple_registers", "read_write_multiple_registers":
+			for i, text := range args.ValueTexts {
+				if args.ValueTexts[i], err = unscaleValue(text, args); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// FC05 only knows two coil states
+	if args.Operation == "write_single_coil" {
+		value, err := parseCoilValue(args.ValueText)
+		if err != nil {
+			return fmt.Errorf("Invalid value: %v", err)
+		}
+		args.Value = value
+		return nil
+	}
+
+	// Parse the write values, checking them against the selected signedness
+	if args.Type != "" {
+		if _, _, err := encodeTyped(append([]string{args.ValueText}, args.ValueTexts...), args); err != nil {
+			return fmt.Errorf("Invalid value: %v", err)
+		}
+		return nil
+	}
+	value, err := parseRegisterValue(args.ValueText, args.Unsigned, args.AllowWrap)
+	if err != nil {
+		return fmt.Errorf("Invalid value: %v", err)
+	}
+	args.Value = value
+
+	// Convert the values from []string to []uint16
+	args.Values = make([]uint16, len(args.ValueTexts))
+	for i, valueStr := range args.ValueTexts {
+		value, err := parseRegisterValue(valueStr, args.Unsigned, args.AllowWrap)
+		if err != nil {
+			return fmt.Errorf("Invalid value in 'values': %v", err)
+		}
+		args.Values[i] = value
+	}
+
+	return nil
+}
+
+// readValuesFile reads write values separated by commas, spaces or newlines
+// from path, or from stdin if path is -
+func readValuesFile(path string) ([]string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	values := strings.FieldsFunc(string(data), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%s: no values", path)
+	}
+	return values, nil
+}
+
+// unscaleValue converts a write value given in scaled units back to the raw
+// value, (value-offset)/scale, rounded to an integer unless --type is a
+// float type
+func unscaleValue(text string, args *ModbusArgs) (string, error) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	if err != nil {
+		return "", fmt.Errorf("Invalid value: %s is not a number", text)
+	}
+	raw := removeScale(value-args.Offset, args.Scale)
+	var rawText string
+	switch args.Type {
+	case "float32", "float64":
+		rawText = strconv.FormatFloat(trimNoise(raw), 'g', -1, 64)
+	default:
+		rawText = strconv.FormatFloat(math.Round(raw), 'f', 0, 64)
+	}
+	if args.Verbose {
+		logDebugf("Scaled value %s is written as %s", text, rawText)
+	}
+	return rawText, nil
+}
+
+// parseRegisterValue parses a 16-bit write value, given in decimal or as a
+// 0x hex or 0b binary literal (0x0000..0xFFFF). Signed values must lie in
+// -32768..32767 and unsigned values in 0..65535. Values of the other
+// signedness, which would be reinterpreted on the wire, are only accepted with
+// allowWrap.
+func parseRegisterValue(valueStr string, unsigned, allowWrap bool) (uint16, error) {
+	valueStr = strings.TrimSpace(valueStr)
+	value, err := strconv.ParseInt(valueStr, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid integer", valueStr)
+	}
+	if value < -32768 || value > 65535 {
+		return 0, fmt.Errorf("%s does not fit in a 16-bit register", valueStr)
+	}
+	// Hex and binary literals spell out the register bits, so signedness
+	// does not change their meaning
+	if prefix := strings.ToLower(valueStr); strings.HasPrefix(prefix, "0x") || strings.HasPrefix(prefix, "0b") {
+		return uint16(value), nil
+	}
+	if unsigned && value < 0 && !allowWrap {
+		return 0, fmt.Errorf("%s is negative but --unsigned is set; it would be sent as %d (use --allow-wrap to accept)", valueStr, uint16(value))
+	}
+	if !unsigned && value > 32767 && !allowWrap {
+		return 0, fmt.Errorf("%s is above 32767 for a signed register; it would be sent as %d (use --unsigned or --allow-wrap)", valueStr, int16(value))
+	}
+	return uint16(value), nil
+}
+
+// parseCoilValue parses the state of a single coil write into the value FC05
+// sends: on, true, 1 or 0xFF00 switch the coil on, off, false or 0 switch it
+// off
+func parseCoilValue(valueStr string) (uint16, error) {
+	switch strings.ToLower(strings.TrimSpace(valueStr)) {
+	case "on", "true", "1", "0xff00":
+		return 0xFF00, nil
+	case "off", "false", "0", "0x0000", "0x0":
+		return 0x0000, nil
+	}
+	return 0, fmt.Errorf("%s is not a coil state; a single coil is switched with on/off, true/false or 1/0", valueStr)
+}
+
+// errReported is returned when a failure has already been reported and the
+// process only needs to exit non-zero
+var errReported = errors.New("failure already reported")
+
+// main is the entry point for the Modbus TCP client simulator
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "readlog" {
+		if err := runReadLog(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	args, err := parseFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if args.Explain {
+		if err := explain(args, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := run(args); err != nil {
+		if !errors.Is(err, errReported) {
+			log.Print(err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run connects to the server and executes the requested operation
+func run(args *ModbusArgs) error {
+	// Log lines share stderr with the JSON error records, so drop their
+	// prefixes unless a timestamp format was chosen
+	if args.Format == "json" && args.TimestampFormat == "default" {
+		log.SetFlags(0)
+	}
+
+	s := &session{args: args, clock: realClock{}}
+	printer := newResultPrinter(args, os.Stdout, s.clock)
+	if args.Output != "" {
+		file, err := os.Create(args.Output)
+		if err != nil {
+			return fmt.Errorf("Error opening output file: %v", err)
+		}
+		defer file.Close()
+		printer = newResultPrinter(args, file, s.clock)
+	}
+	if args.Format == "binlog" {
+		binlog, err := newBinlogWriter(printer.out, args, s.clock)
+		if err != nil {
+			return fmt.Errorf("Error writing binlog header: %v", err)
+		}
+		printer.binlog = binlog
+	}
+	if args.Report != "" {
+		report, err := openSessionReport(args.Report, args, s.clock)
+		if err != nil {
+			return fmt.Errorf("Error opening report: %v", err)
+		}
+		printer.report = report
+		defer report.close()
+	}
+	if args.WebhookURL != "" {
+		printer.webhook = newWebhook(args, s.clock)
+		defer printer.webhook.close()
+	}
+	if args.MetricsAddr != "" {
+		metrics, err := startMetrics(args.MetricsAddr, args)
+		if err != nil {
+			return fmt.Errorf("Error starting metrics server: %v", err)
+		}
+		printer.metrics = metrics
+		defer metrics.close()
+	}
+	s.printer = printer
+	s.started = s.clock.Now()
+	if args.Stats {
+		s.stats = &latencyStats{every: args.StatsEvery}
+	}
+
+	// Connect to the Modbus server
+	s.handler, s.client = createModbusClient(args, s.clock, s.observeRequest)
+	defer s.handler.Close()
+
+	// Stop cleanly on Ctrl-C or kill so the connection is closed properly. Once
+	// the first signal has arrived the default handling is restored, so a
+	// second Ctrl-C exits immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := runOperation(ctx, s)
+	if ctx.Err() != nil {
+		logInfof("Interrupted, closing connection")
+	}
+	s.logSummary()
+	return err
+}
+
+// runOperation executes the requested operation until it completes or ctx is cancelled
+func runOperation(ctx context.Context, s *session) error {
+	if s.args.Script != "" {
+		return runScript(ctx, s)
+	}
+	if s.args.Interactive {
+		return runInteractive(ctx, s)
+	}
+	if len(s.args.Blocks) > 0 {
+		return pollBlocks(ctx, s)
+	}
+	if s.args.Preflight && !readOnlyOperations[s.args.Operation] {
+		if err := preflight(s); err != nil {
+			return err
+		}
+	}
+
+	switch s.args.Operation {
+	case "read_coils":
+		return performReadOperation(ctx, s, modbus.FuncCodeReadCoils)
+	case "read_discrete_inputs":
+		return performReadOperation(ctx, s, modbus.FuncCodeReadDiscreteInputs)
+	case "read_holding_registers":
+		return performReadOperation(ctx, s, modbus.FuncCodeReadHoldingRegisters)
+	case "read_input_registers":
+		return performReadOperation(ctx, s, modbus.FuncCodeReadInputRegisters)
+	case "write_single_coil":
+		return writeSingleCoil(ctx, s)
+	case "write_single_register":
+		return writeSingleRegister(ctx, s)
+	case "write_multiple_coils":
+		return writeMultipleCoils(ctx, s)
+	case "write_multiple_registers":
+		return writeMultipleRegisters(ctx, s)
+	case "read_write_multiple_registers":
+		return readWriteMultipleRegisters(ctx, s)
+	case "mask_write_register":
+		return maskWriteRegister(ctx, s)
+	case "set_bits", "clear_bits", "toggle_bits":
+		return modifyBits(ctx, s)
+	case "read":
+		return readPoints(ctx, s)
+	case "read_device_id":
+		return readDeviceIdentification(ctx, s)
+	case "read_fifo_queue":
+		return readFIFOQueue(ctx, s)
+	case "read_exception_status":
+		return printExceptionStatus(ctx, s)
+	case "diagnostics":
+		return runDiagnostics(ctx, s)
+	case "raw":
+		return sendRaw(ctx, s)
+	case "scan_units":
+		return scanUnits(ctx, s)
+	case "scan_registers":
+		return scanRegisters(ctx, s)
+	case "coil_pattern":
+		return runCoilPattern(ctx, s)
+	default:
+		return fmt.Errorf("Invalid operation: %s", s.args.Operation)
+	}
+}
+
+// clientHandler is the transport handler returned by createModbusClient
+type clientHandler interface {
+	modbus.ClientHandler
+	Connect() error
+	Close() error
+}
+
+// session holds the connection and the per-run state shared by the operation helpers
+type session struct {
+	args    *ModbusArgs
+	handler clientHandler
+	client  modbus.Client
+	printer *resultPrinter
+
+	// reconnects counts reconnect attempts since a request last got through
+	reconnects int
+
+	// started, succeeded, failed and ambiguous are reported in the run
+	// summary; they count operations, of one or more requests each
+	started   time.Time
+	succeeded int
+	failed    int
+	ambiguous int
+
+	// notSent counts the write operations of --dry-run, which are neither
+	// successes nor failures
+	notSent int
+
+	// pending is the write of the latest operation, if it failed ambiguously
+	// and could not be checked on the spot (see resolveWrite)
+	pending *writeTarget
+
+	// requests counts the requests sent, across the --block goroutines
+	requests atomic.Int64
+
+	// shared is the connection shared with other --block goroutines, if
+	// any; generation is the shared.generation the latest operation ran on
+	shared     *sharedConnection
+	generation int
+
+	// writeStrategy is the register write strategy found to work with --write-strategy auto
+	writeStrategy string
+
+	// lastErr is the outcome of the most recent attempt made by repeat
+	lastErr error
+
+	// stats collects request round-trip times with --stats
+	stats *latencyStats
+
+	// clock times the run, its intervals and delays
+	clock clock
+}
+
+// logSummary logs the number of operations and requests made and how the
+// operations ended
+func (s *session) logSummary() {
+	operations := s.succeeded + s.failed + s.notSent
+	if operations == 0 {
+		return
+	}
+	outcomes := fmt.Sprintf("%d succeeded, %d failed", s.succeeded, s.failed)
+	if s.notSent > 0 {
+		outcomes += fmt.Sprintf(", %d not sent (dry run)", s.notSent)
+	}
+	logInfof("Summary: %d operations (%d requests), %s in %v",
+		operations, s.requests.Load(), outcomes, s.clock.Now().Sub(s.started).Round(time.Millisecond))
+	if s.ambiguous > 0 {
+		logWarnf("%d failed requests may still have taken effect (timeout or lost connection after sending)", s.ambiguous)
+	}
+	if s.stats != nil {
+		s.stats.log()
+	}
+	s.printer.steps.logSummary()
+}
+
+// createModbusClient creates a Modbus TCP client and connects to the server.
+// observe, if not nil, is given the round-trip time of every request.
+func createModbusClient(args *ModbusArgs, clock clock, observe func(time.Duration, error)) (clientHandler, modbus.Client) {
+	// Validate the server address
+	addr := net.JoinHostPort(args.Server, strconv.FormatUint(uint64(args.Port), 10))
+	var handler clientHandler
+	switch {
+	case args.TLS:
+		config, err := newTLSConfig(args)
+		if err != nil {
+			log.Fatalf("Invalid TLS configuration: %v", err)
+		}
+		packager := modbus.NewTCPClientHandler(addr)
+		packager.SlaveId = args.UnitID
+		handler = &tlsHandler{Packager: packager, Address: addr, Config: config}
+	case args.Framing == "rtu-over-tcp":
+		handler = &rtuOverTCPHandler{Address: addr, SlaveId: args.UnitID}
+	default:
+		tcpHandler := modbus.NewTCPClientHandler(addr)
+		tcpHandler.SlaveId = args.UnitID
+		handler = tcpHandler
+	}
+	if observe != nil {
+		// Inside the payload transform, so its handshake requests count too
+		handler = &timedHandler{clientHandler: handler, clock: clock, observe: observe}
+	}
+	if args.PayloadTransform != "" {
+		transform, err := newPayloadTransform(args)
+		if err != nil {
+			log.Fatalf("Invalid payload transform: %v", err)
+		}
+		handler = &transformHandler{clientHandler: handler, transform: transform, verbose: args.Verbose}
+	}
+
+	// Connect up front so connection problems are reported before the first request
+	started := clock.Now()
+	if err := connectHandler(handler, args); err != nil {
+		if args.TLS {
+			// Certificate problems will not go away by retrying
+			log.Fatalf("Error connecting to %s: %v", addr, describeTLSError(err))
+		}
+		logErrorf("Error connecting to %s after %v: %v", addr, clock.Now().Sub(started).Round(time.Millisecond), err)
+	}
+
+	client := modbus.NewClient(handler)
+	if args.DryRun {
+		return handler, &dryRunClient{Client: client}
+	}
+	return handler, client
 }
 
-// parseFlags parses the command-line arguments and returns a ModbusArgs struct
-func parseFlags() *ModbusArgs {
-	args := &ModbusArgs{}
+// connectHandler connects the handler using the connect timeout, then leaves
+// the response timeout in place for requests (and for any reconnect the
+// handler makes on its own)
+func connectHandler(handler clientHandler, args *ModbusArgs) error {
+	setHandlerTimeout(handler, args.ConnectTimeout)
+	defer setHandlerTimeout(handler, args.ResponseTimeout)
+	return handler.Connect()
+}
 
-	pflag.StringVarP(&args.Server, "server", "s", "", "The IP address or hostname of the Modbus TCP server.")
-	pflag.UintVarP(&args.Port, "port", "p", 502, "The port number of the Modbus TCP server.")
-	pflag.Uint8VarP(&args.UnitID, "unitid", "d", 1, "The unit id of the Modbus TCP server.")
-	pflag.StringVarP(&args.Operation, "operation", "o", "", "The operation to perform. \nread_coils/read_discrete_inputs/read_holding_registers/read_input_registers\nwrite_single_coil/write_single_register/write_multiple_coils/write_multiple_registers")
-	pflag.IntVarP(&args.Repeat, "repeat", "r", 1, "The number of times the operation should be repeated. If set to 0, repeat until interrupted.")
-	pflag.IntVarP(&args.Interval, "interval", "i", 1000, "The interval (in milliseconds) between operation repeats.")
-	pflag.BoolVarP(&args.Unsigned, "unsigned", "u", false, "Interpret read/write values as unsigned integers.")
-	pflag.Uint16VarP(&args.Start, "start", "", 0, "The starting address for read or write operations.")
-	pflag.Uint16VarP(&args.Count, "count", "", 1, "The number of registers to read.")
-	var valueStr string
-	pflag.StringVarP(&valueStr, "value", "", "0", "The value for single write operations.")
-	var values []string
-	pflag.StringSliceVarP(&values, "values", "", nil, "The comma-separated values for multiple write operations. Example: 1,2,3")
+// setHandlerTimeout sets the connect and I/O timeout of a handler. A timeout of 0 means wait forever.
+func setHandlerTimeout(handler clientHandler, timeout time.Duration) {
+	switch h := handler.(type) {
+	case *modbus.TCPClientHandler:
+		h.Timeout = timeout
+	case *rtuOverTCPHandler:
+		h.Timeout = timeout
+	case *tlsHandler:
+		h.Timeout = timeout
+	case *transformHandler:
+		setHandlerTimeout(h.clientHandler, timeout)
+	case *timedHandler:
+		setHandlerTimeout(h.clientHandler, timeout)
+	}
+}
 
-	pflag.Parse()
+// setHandlerUnit sets the unit id (slave id) the handler addresses requests to
+func setHandlerUnit(handler clientHandler, unitID byte) {
+	switch h := handler.(type) {
+	case *modbus.TCPClientHandler:
+		h.SlaveId = unitID
+	case *rtuOverTCPHandler:
+		h.SlaveId = unitID
+	case *tlsHandler:
+		if packager, ok := h.Packager.(*modbus.TCPClientHandler); ok {
+			packager.SlaveId = unitID
+		}
+	case *transformHandler:
+		setHandlerUnit(h.clientHandler, unitID)
+	case *timedHandler:
+		setHandlerUnit(h.clientHandler, unitID)
+	}
+}
 
-	// Validate server address
-	if args.Server == "" {
-		log.Fatal("Server address is required")
+// isTimeout reports whether err is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// exceptionNames are the exception codes defined by the Modbus application protocol
+var exceptionNames = map[byte]string{
+	0x01: "Illegal Function",
+	0x02: "Illegal Data Address",
+	0x03: "Illegal Data Value",
+	0x04: "Server Device Failure",
+	0x05: "Acknowledge",
+	0x06: "Server Device Busy",
+	0x08: "Memory Parity Error",
+	0x0A: "Gateway Path Unavailable",
+	0x0B: "Gateway Target Device Failed to Respond",
+}
+
+// exceptionError is a Modbus exception response described by name
+type exceptionError struct {
+	*modbus.ModbusError
+}
+
+func (e *exceptionError) Error() string {
+	name, ok := exceptionNames[e.ExceptionCode]
+	if !ok {
+		name = "Unknown Exception"
 	}
+	return fmt.Sprintf("%s (0x%02X) from function %d", name, e.ExceptionCode, e.FunctionCode&0x7F)
+}
 
-	// Conditionally parse the value based on the --unsigned flag
-	if args.Unsigned {
-		value, err := strconv.ParseUint(valueStr, 10, 16)
-		if err != nil {
-			log.Fatalf("Invalid value: %s", valueStr)
+func (e *exceptionError) Unwrap() error {
+	return e.ModbusError
+}
+
+// describeException replaces a Modbus exception with an error naming the
+// exception code. Other errors, including wrapped exceptions, are returned
+// unchanged.
+func describeException(err error) error {
+	if modbusErr, ok := err.(*modbus.ModbusError); ok {
+		return &exceptionError{modbusErr}
+	}
+	return err
+}
+
+// isConnectionError reports whether err means the connection itself is
+// unusable, as opposed to a Modbus exception or a timeout
+func isConnectionError(err error) bool {
+	var modbusErr *modbus.ModbusError
+	if err == nil || errors.As(err, &modbusErr) || isTimeout(err) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// reconnect closes the handler and dials again, waiting --reconnect-delay
+// before each attempt. Attempts are counted until a request gets through, so
+// a server that accepts connections and drops them straight away still uses
+// up --max-reconnect-attempts. It fails with ctx.Err() if ctx is cancelled
+// while waiting.
+func (s *session) reconnect(ctx context.Context, cause error) error {
+	if s.shared != nil {
+		s.shared.Lock()
+		defer s.shared.Unlock()
+		if s.shared.generation != s.generation {
+			// Another block has reconnected since this operation failed
+			return nil
 		}
-		args.Value = uint16(value)
-	} else {
-		value, err := strconv.ParseInt(valueStr, 10, 16)
-		if err != nil {
-			log.Fatalf("Invalid value: %s", valueStr)
+		s.shared.generation++
+	}
+	logWarnf("Connection lost: %v", cause)
+	s.handler.Close()
+	for s.args.MaxReconnectAttempts <= 0 || s.reconnects < s.args.MaxReconnectAttempts {
+		s.reconnects++
+		if !sleepContext(ctx, s.clock, s.args.ReconnectDelay) {
+			return ctx.Err()
 		}
-		args.Value = uint16(value & 0xFFFF)
+		if err := connectHandler(s.handler, s.args); err != nil {
+			logWarnf("Reconnect attempt %d failed: %v", s.reconnects, err)
+			continue
+		}
+		logInfof("Reconnected to %s after %d attempt(s)", net.JoinHostPort(s.args.Server, strconv.FormatUint(uint64(s.args.Port), 10)), s.reconnects)
+		return nil
 	}
+	return fmt.Errorf("Unable to reconnect after %d attempts", s.args.MaxReconnectAttempts)
+}
 
-	// Convert the values from []string to []uint16
-	args.Values = make([]uint16, len(values))
-	for i, valueStr := range values {
-		if args.Unsigned {
-			value, err := strconv.ParseUint(valueStr, 10, 16)
-			if err != nil {
-				log.Fatalf("Invalid value in 'values': %s", valueStr)
+// sleepContext waits for d on clock, returning false if ctx is cancelled first
+func sleepContext(ctx context.Context, clock clock, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-clock.After(d):
+		return true
+	}
+}
+
+// registerSize is the number of bytes in one Modbus register
+const registerSize = 2
+
+// maxReadRegisters and maxWriteRegisters are the most registers a single
+// FC03/FC04 read and FC16 write may carry; an FC23 request reads up to
+// maxReadRegisters and writes up to maxReadWriteRegisters
+const (
+	maxReadRegisters      = 125
+	maxWriteRegisters     = 123
+	maxReadWriteRegisters = 121
+)
+
+// splitWords splits register data into values of width bytes (a multiple of
+// registerSize), each converted from the device byte order to big-endian.
+// A trailing partial value is dropped.
+func splitWords(data []byte, width int, byteOrder string) [][]byte {
+	words := make([][]byte, 0, len(data)/width)
+	for i := 0; i+width <= len(data); i += width {
+		words = append(words, orderBytes(data[i:i+width], byteOrder))
+	}
+	return words
+}
+
+// joinWords is the inverse of splitWords: it converts big-endian values to the
+// device byte order and concatenates them
+func joinWords(words [][]byte, byteOrder string) []byte {
+	var data []byte
+	for _, word := range words {
+		data = append(data, orderBytes(word, byteOrder)...)
+	}
+	return data
+}
+
+// orderBytes converts the raw bytes of one register value between the device
+// byte order and big-endian (ABCD) order. Every supported order is its own
+// inverse, so the same function is used for decoding and encoding. raw holds
+// one or more whole registers: 2 bytes for 16-bit, 4 for 32-bit, 8 for 64-bit.
+func orderBytes(raw []byte, byteOrder string) []byte {
+	ordered := make([]byte, len(raw))
+	switch byteOrder {
+	case "DCBA":
+		for i := range raw {
+			ordered[i] = raw[len(raw)-1-i]
+		}
+	case "BADC":
+		for i := 0; i < len(raw); i += registerSize {
+			ordered[i], ordered[i+1] = raw[i+1], raw[i]
+		}
+	case "CDAB":
+		for i := 0; i < len(raw); i += registerSize {
+			copy(ordered[i:i+registerSize], raw[len(raw)-registerSize-i:len(raw)-i])
+		}
+	default:
+		copy(ordered, raw)
+	}
+	return ordered
+}
+
+// repeat runs operation according to the repeat settings, sleeping for the
+// configured interval after each attempt. With --repeat every attempt counts;
+// with --repeat-success only successful attempts count, and the number of
+// attempts needed is reported at the end. An attempt that fails because the
+// connection was lost is run again after reconnecting and is not counted,
+// unless it is unsafe to resend (see mayRetry). Cancelling ctx stops the loop after the request in flight has completed.
+func (s *session) repeat(ctx context.Context, operation func() error) error {
+	args := s.args
+	successes := 0
+	for attempt := 1; ctx.Err() == nil; attempt++ {
+		started := s.clock.Now()
+		err := s.retry(ctx, operation)
+		if isConnectionError(err) {
+			if err := s.reconnect(ctx, err); err != nil {
+				if errors.Is(err, context.Canceled) {
+					return nil
+				}
+				return err
+			}
+			if !s.mayRetry(err) {
+				err = s.resolvePending(err)
+			}
+			if err != nil && s.mayRetry(err) {
+				attempt--
+				continue
 			}
-			args.Values[i] = uint16(value)
 		} else {
-			value, err := strconv.ParseInt(valueStr, 10, 16)
-			if err != nil {
-				log.Fatalf("Invalid value in 'values': %s", valueStr)
+			s.reconnects = 0
+		}
+		s.lastErr = err
+		if err == nil {
+			successes++
+		} else if isTimeout(err) {
+			logWarnf("Request timed out after %v (response timeout %v)", s.clock.Now().Sub(started).Round(time.Millisecond), args.ResponseTimeout)
+		}
+
+		if args.RepeatSuccess > 0 {
+			if successes >= args.RepeatSuccess {
+				logInfof("Collected %d successful results in %d attempts", successes, attempt)
+				return nil
 			}
-			args.Values[i] = uint16(value & 0xFFFF)
+			if args.MaxAttempts > 0 && attempt >= args.MaxAttempts {
+				logErrorf("Giving up after %d attempts with %d of %d successful results", attempt, successes, args.RepeatSuccess)
+				return nil
+			}
+		} else if args.Repeat > 0 && attempt >= args.Repeat {
+			// Let scripts detect the failure of a single request
+			if args.Repeat == 1 && err != nil {
+				return errReported
+			}
+			return nil
+		}
+
+		// Wait between attempts, not after the last one
+		if !sleepContext(ctx, s.clock, time.Duration(args.Interval)*time.Millisecond) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// retry runs operation, retrying a failure up to --retries times with
+// --retry-delay between tries. Lost connections are returned straight away
+// so the caller can reconnect, as are Modbus exceptions other than busy
+// responses, which retrying will not change.
+func (s *session) retry(ctx context.Context, operation func() error) error {
+	call := func() error {
+		s.pending = nil
+		if s.shared != nil {
+			s.shared.RLock()
+			s.generation = s.shared.generation
+			defer s.shared.RUnlock()
 		}
+		err := operation()
+		if err == nil && s.args.DryRun && !readOnlyOperations[s.args.Operation] {
+			s.notSent++
+		} else if err == nil {
+			s.succeeded++
+		} else {
+			s.failed++
+		}
+		if s.isAmbiguous(err) {
+			s.ambiguous++
+		}
+		return err
 	}
 
-	return args
+	err := call()
+	// Results of a retried request are flagged as retried
+	defer func() { s.printer.retried = false }()
+	for retry := 1; retry <= s.args.Retries && isTransient(err) && s.mayRetry(err); retry++ {
+		logWarnf("Retrying (%d of %d)", retry, s.args.Retries)
+		if !sleepContext(ctx, s.clock, time.Duration(s.args.RetryDelay)*time.Millisecond) {
+			return err
+		}
+		s.printer.retried = true
+		err = call()
+	}
+	return err
 }
 
-// main is the entry point for the Modbus TCP client simulator
-func main() {
-	args := parseFlags()
+// readOnlyOperations cannot change the state of the device
+var readOnlyOperations = map[string]bool{
+	"read_coils":             true,
+	"read_discrete_inputs":   true,
+	"read_holding_registers": true,
+	"read_input_registers":   true,
+	"read":                   true,
+	"read_device_id":         true,
+	"read_fifo_queue":        true,
+	"read_exception_status":  true,
+	"scan_units":             true,
+	"scan_registers":         true,
+}
 
-	// Connect to the Modbus server
-	handler, client := createModbusClient(args.Server, args.Port, args.UnitID)
-	defer handler.Close()
+// idempotentOperations leave the device in the same state however often they
+// are sent: reads, and writes of absolute values. An operation missing here
+// is not resent after an ambiguous failure unless --retry-non-idempotent is
+// set, or reading its target back shows the write did not take effect (see
+// resolveWrite). read_fifo_queue is missing because a device may drain the
+// queue as it answers.
+var idempotentOperations = map[string]bool{
+	"read_coils":                    true,
+	"read_discrete_inputs":          true,
+	"read_holding_registers":        true,
+	"read_input_registers":          true,
+	"read":                          true,
+	"read_device_id":                true,
+	"read_exception_status":         true,
+	"write_single_coil":             true,
+	"write_single_register":         true,
+	"write_multiple_coils":          true,
+	"write_multiple_registers":      true,
+	"read_write_multiple_registers": true,
+	"mask_write_register":           true,
+	"set_bits":                      true,
+	"clear_bits":                    true,
+	"coil_pattern":                  true,
+}
 
-	// Execute the requested operation
-	switch args.Operation {
-	case "read_coils":
-		performReadOperation(client, modbus.FuncCodeReadCoils, args.Start, args.Count, args.Repeat, args.Interval, args.Unsigned)
-	case "read_discrete_inputs":
-		performReadOperation(client, modbus.FuncCodeReadDiscreteInputs, args.Start, args.Count, args.Repeat, args.Interval, args.Unsigned)
-	case "read_holding_registers":
-		performReadOperation(client, modbus.FuncCodeReadHoldingRegisters, args.Start, args.Count, args.Repeat, args.Interval, args.Unsigned)
-	case "read_input_registers":
-		performReadOperation(client, modbus.FuncCodeReadInputRegisters, args.Start, args.Count, args.Repeat, args.Interval, args.Unsigned)
-	case "write_single_coil":
-		writeSingleCoil(client, args.Start, args.Value, args.Repeat, args.Interval)
-	case "write_single_register":
-		writeSingleRegister(client, args.Start, args.Value, args.Repeat, args.Interval)
-	case "write_multiple_coils":
-		writeMultipleCoils(client, args.Start, args.Values, args.Repeat, args.Interval)
-	case "write_multiple_registers":
-		writeMultipleRegisters(client, args.Start, args.Values, args.Repeat, args.Interval)
-	default:
-		log.Fatalf("Invalid operation: %s", args.Operation)
+// isAmbiguous reports whether err leaves it unknown if the failed request
+// took effect: a write (or a FIFO read) may have been applied before a
+// timeout or a lost connection, though not if the connection was refused
+// outright
+func (s *session) isAmbiguous(err error) bool {
+	if readOnlyOperations[s.args.Operation] && idempotentOperations[s.args.Operation] || errors.Is(err, syscall.ECONNREFUSED) || isNotApplied(err) {
+		return false
 	}
+	return isTimeout(err) || isConnectionError(err)
 }
 
-// createModbusClient creates a Modbus TCP client and connects to the server
-func createModbusClient(server string, port uint, unitid uint8) (*modbus.TCPClientHandler, modbus.Client) {
-	// Validate the server address
-	addr := net.JoinHostPort(server, strconv.FormatUint(uint64(port), 10))
-	handler := modbus.NewTCPClientHandler(addr)
-	handler.SlaveId = byte(unitid)
-	client := modbus.NewClient(handler)
-	return handler, client
+// mayRetry reports whether the request that failed with err may be sent again
+func (s *session) mayRetry(err error) bool {
+	return !s.isAmbiguous(err) || idempotentOperations[s.args.Operation] || s.args.RetryNonIdempotent
+}
+
+// isTransient reports whether err might not recur on retrying the request
+func isTransient(err error) bool {
+	if err == nil || isConnectionError(err) {
+		return false
+	}
+	var modbusErr *modbus.ModbusError
+	if errors.As(err, &modbusErr) {
+		return modbusErr.ExceptionCode == modbus.ExceptionCodeServerDeviceBusy ||
+			modbusErr.ExceptionCode == modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond
+	}
+	return true
 }
 
 // performReadOperation is a helper function for read operations
-func performReadOperation(client modbus.Client, functionCode byte, start uint16, count uint16, repeat int, interval int, unsigned bool) {
-	for i := 0; repeat <= 0 || i < repeat; i++ {
+func performReadOperation(ctx context.Context, s *session, functionCode byte) error {
+	client, args, printer := s.client, s.args, s.printer
+	var lookup map[int64]string
+	if args.LookupFile != "" {
+		var err error
+		if lookup, err = loadLookupFile(args.LookupFile); err != nil {
+			return fmt.Errorf("Error loading lookup file: %v", err)
+		}
+	}
+
+	// With --type, --count is the number of values rather than registers
+	registers, typeRegisters := args.Count, 1
+	if args.Type != "" {
+		typeRegisters = datatypeRegisters(args.Type)
+		registers *= uint16(typeRegisters)
+	}
+
+	// previous holds the last response printed with --on-change. Equal
+	// responses decode to equal values, so the raw bytes are compared.
+	var previous []byte
+
+	return s.repeat(ctx, func() error {
 		var response []byte
 		var err error
 
+		switch functionCode {
+		case modbus.FuncCodeReadCoils, modbus.FuncCodeReadDiscreteInputs:
+			response, err = readBlock(client, functionCode, args.Start, args.Count, 1)
+		default:
+			response, err = readBlock(client, functionCode, args.Start, registers, typeRegisters)
+		}
+
+		if err == nil && args.OnChange {
+			if previous != nil && bytes.Equal(response, previous) {
+				return nil
+			}
+			previous = response
+		}
+		if err == nil {
+			err = printReadResponse(s, functionCode, response, lookup)
+		}
+		if err != nil {
+			// A failed read is not an unchanged one: print the next success
+			previous = nil
+			printer.printError("read", err)
+		}
+		return err
+	})
+}
+
+// readChunkSize is the most coils, inputs or registers read by one request of
+// functionCode. Register reads are rounded down to whole values of
+// valueRegisters registers, so that no value is split between two requests.
+// Bit reads are a multiple of eight, so the packed responses line up.
+func readChunkSize(functionCode byte, valueRegisters int) int {
+	if functionCode == modbus.FuncCodeReadCoils || functionCode == modbus.FuncCodeReadDiscreteInputs {
+		return maxReadBits
+	}
+	return maxReadRegisters - maxReadRegisters%valueRegisters
+}
+
+// readBlock reads quantity coils, inputs or registers from start with
+// functionCode, as several requests at increasing addresses when there are
+// more than one request may carry. The responses are concatenated, so the
+// result decodes like the response to a single read.
+func readBlock(client modbus.Client, functionCode byte, start, quantity uint16, valueRegisters int) ([]byte, error) {
+	read := func(address, n uint16) ([]byte, error) {
 		switch functionCode {
 		case modbus.FuncCodeReadCoils:
-			response, err = client.ReadCoils(start, count)
+			return client.ReadCoils(address, n)
 		case modbus.FuncCodeReadDiscreteInputs:
-			response, err = client.ReadDiscreteInputs(start, count)
-		case modbus.FuncCodeReadHoldingRegisters:
-			response, err = client.ReadHoldingRegisters(start, count)
+			return client.ReadDiscreteInputs(address, n)
 		case modbus.FuncCodeReadInputRegisters:
-			response, err = client.ReadInputRegisters(start, count)
+			return client.ReadInputRegisters(address, n)
 		}
+		return client.ReadHoldingRegisters(address, n)
+	}
+	chunk := readChunkSize(functionCode, valueRegisters)
+	if int(quantity) <= chunk {
+		return read(start, quantity)
+	}
 
+	bits := chunk == maxReadBits
+	var data []byte
+	for done := 0; done < int(quantity); done += chunk {
+		n := int(quantity) - done
+		if n > chunk {
+			n = chunk
+		}
+		first := start + uint16(done)
+		response, err := read(first, uint16(n))
 		if err != nil {
-			log.Printf("Error during read operation: %v", err)
+			if done == 0 {
+				return nil, err
+			}
+			return nil, fmt.Errorf("addresses %d to %d (%d of %d read): %w", first, int(first)+n-1, done, quantity, describeException(err))
+		}
+		size := n * registerSize
+		if bits {
+			size = (n + 7) / 8
+		}
+		if len(response) != size {
+			return nil, fmt.Errorf("addresses %d to %d: %d bytes in the response, expected %d", first, int(first)+n-1, len(response), size)
+		}
+		logDebugf("Read addresses %d to %d (%d of %d)", first, int(first)+n-1, done+n, quantity)
+		data = append(data, response...)
+	}
+	return data, nil
+}
+
+// printReadResponse decodes a read response and prints it, translating the
+// values through lookup if it is not nil. It returns an error, without
+// printing, if the response cannot be decoded.
+func printReadResponse(s *session, functionCode byte, response []byte, lookup map[int64]string) error {
+	args, printer := s.args, s.printer
+	if args.Raw {
+		logInfof("Raw response: % X", response)
+	}
+	coils := functionCode == modbus.FuncCodeReadCoils || functionCode == modbus.FuncCodeReadDiscreteInputs
+	if args.Format == "hex" {
+		// Signedness does not apply to raw words; coils are shown as the packed bytes
+		var fields []string
+		if coils {
+			for _, b := range response {
+				fields = append(fields, fmt.Sprintf("0x%02X", b))
+			}
 		} else {
-			if unsigned {
-				values := make([]uint16, count)
-				for i := 0; i < len(response); i += 2 {
-					values[i/2] = binary.BigEndian.Uint16(response[i : i+2])
-				}
-				log.Printf("Read response (unsigned): %v", values)
-			} else {
-				values := make([]int16, count)
-				for i := 0; i < len(response); i += 2 {
-					values[i/2] = int16(binary.BigEndian.Uint16(response[i : i+2]))
+			for i, word := range splitWords(response, registerSize, args.ByteOrder) {
+				fields = append(fields, fmt.Sprintf("addr=0x%04X val=0x%04X", int(args.Start)+i, binary.BigEndian.Uint16(word)))
+			}
+		}
+		printer.printValues(fmt.Sprintf("Read response (hex): %s", strings.Join(fields, ", ")), valueList(fields))
+	} else if coils {
+		// Coils are bit-packed, first coil in the least significant bit. JSON
+		// reports them as booleans, everything else as 0/1.
+		states := unpackCoils(response, args.Count)
+		if args.Format == "json" {
+			printer.printValues(fmt.Sprintf("Read response (coils): %v", states), valueList(states))
+		} else {
+			bits := make([]uint8, len(states))
+			for i, on := range states {
+				if on {
+					bits[i] = 1
 				}
-				log.Printf("Read response (signed): %v", values)
+			}
+			printer.printValues(fmt.Sprintf("Read response (coils): %v", bits), valueList(bits))
+		}
+	} else if args.Type == "string" {
+		text := decodeString(response, args.StringSwap)
+		printer.printValues(fmt.Sprintf("Read response (string): \"%s\"", text), valueList([]string{text}))
+	} else if args.Scale != 1 || args.Offset != 0 {
+		values, err := decodeTyped(response, args)
+		if err != nil {
+			return err
+		}
+		if args.Verbose {
+			logDebugf("Raw values before scaling: %v", values)
+		}
+		scaled := make([]float64, len(values))
+		for i, value := range values {
+			scaled[i] = trimNoise(applyScale(toFloat64(value), args.Scale) + args.Offset)
+		}
+		printer.printValues(fmt.Sprintf("Read response (scaled): %v", scaled), valueList(scaled))
+	} else if args.Type != "" {
+		values, err := decodeTyped(response, args)
+		if err != nil {
+			return err
+		}
+		printer.printValues(fmt.Sprintf("Read response (%s): %v", args.Type, values), values)
+	} else if args.Unsigned {
+		values := make([]uint16, args.Count)
+		for i, word := range splitWords(response, registerSize, args.ByteOrder) {
+			if i < len(values) {
+				values[i] = binary.BigEndian.Uint16(word)
+			}
+		}
+		if lookup != nil {
+			labels := applyLookup(values, lookup)
+			printer.printValues(fmt.Sprintf("Read response (unsigned): %v", labels), valueList(labels))
+		} else {
+			printer.printValues(fmt.Sprintf("Read response (unsigned): %v", values), valueList(values))
+		}
+	} else {
+		values := make([]int16, args.Count)
+		for i, word := range splitWords(response, registerSize, args.ByteOrder) {
+			if i < len(values) {
+				values[i] = int16(binary.BigEndian.Uint16(word))
 			}
 		}
+		if lookup != nil {
+			labels := applyLookup(values, lookup)
+			printer.printValues(fmt.Sprintf("Read response (signed): %v", labels), valueList(labels))
+		} else {
+			printer.printValues(fmt.Sprintf("Read response (signed): %v", values), valueList(values))
+		}
+	}
+	return nil
+}
 
-		time.Sleep(time.Duration(interval) * time.Millisecond)
+// readWriteMultipleRegisters writes --values from --write-start and reads
+// --count registers from --start in one FC23 request
+func readWriteMultipleRegisters(ctx context.Context, s *session) error {
+	client, args, printer := s.client, s.args, s.printer
+	var data []byte
+	readCount := args.Count
+	if args.Type != "" {
+		// With --type, the count and the values are whole values of the type
+		var err error
+		if data, _, err = encodeTyped(args.ValueTexts, args); err != nil {
+			return err
+		}
+		readCount *= uint16(datatypeRegisters(args.Type))
+	} else {
+		words := make([][]byte, len(args.Values))
+		for i, value := range args.Values {
+			words[i] = binary.BigEndian.AppendUint16(nil, value)
+		}
+		data = joinWords(words, args.ByteOrder)
 	}
+	if args.Verbose {
+		logDebugf("Transmitting register values: %s", formatRegisters(data))
+	}
+
+	return s.repeat(ctx, func() error {
+		response, err := client.ReadWriteMultipleRegisters(args.Start, readCount, args.WriteStart, uint16(len(data)/registerSize), data)
+		if err != nil {
+			err = s.resolveWrite(err, writesValues(false, args.WriteStart, registerValues(data, args.ByteOrder)))
+			if err == nil {
+				// The write took effect but its response was lost: read the read block again
+				response, err = readBlock(client, modbus.FuncCodeReadHoldingRegisters, args.Start, readCount, 1)
+			}
+		}
+		if err == nil {
+			err = printReadResponse(s, modbus.FuncCodeReadWriteMultipleRegisters, response, nil)
+		}
+		if err != nil {
+			printer.printError("read/write", err)
+		}
+		return err
+	})
 }
 
 // writeSingleCoil writes a single coil to the Modbus server
-func writeSingleCoil(client modbus.Client, address uint16, value uint16, repeat int, interval int) {
-	for i := 0; repeat <= 0 || i < repeat; i++ {
-		_, err := client.WriteSingleCoil(address, value)
+func writeSingleCoil(ctx context.Context, s *session) error {
+	client, args, printer := s.client, s.args, s.printer
+	var pattern *writePattern
+	if writePatterns[args.Pattern] != nil {
+		pattern = newWritePattern(args, s.clock)
+	}
+
+	return s.repeat(ctx, func() error {
+		if pattern != nil {
+			args.Value = 0
+			if pattern.values(1)[0] != 0 {
+				args.Value = 0xFF00
+			}
+		}
+		before := printer.snapshot(client, true, 1)
+		_, err := client.WriteSingleCoil(args.Start, args.Value)
+		err = s.resolveWrite(err, writesValues(true, args.Start, coilStates([]uint16{args.Value})))
 		if err != nil {
-			log.Printf("Error during write operation: %v", err)
+			printer.printError("write", err)
 		} else {
-			log.Printf("Successfully wrote single coil: %v", value)
+			state := "OFF"
+			if args.Value != 0 {
+				state = "ON"
+			}
+			printer.printWritten(fmt.Sprintf("single coil: %s", state), valueList([]uint16{args.Value}))
+			printer.printBeforeAfter(before, printer.snapshot(client, true, 1))
+			if args.Verify {
+				s.verifyWrite(true, coilStates([]uint16{args.Value}))
+			}
 		}
+		return err
+	})
+}
+
+// writeSingleRegister writes a single register to the Modbus server
+func writeSingleRegister(ctx context.Context, s *session) error {
+	client, args, printer := s.client, s.args, s.printer
+	if args.Type != "" {
+		return writeTypedRegisters(ctx, s, []string{args.ValueText})
+	}
+	data := orderBytes(binary.BigEndian.AppendUint16(nil, args.Value), args.ByteOrder)
+	if args.Verbose {
+		logDebugf("Transmitting register value: %s", formatRegisters(data))
+	}
 
-		time.Sleep(time.Duration(interval) * time.Millisecond)
+	var pattern *writePattern
+	if writePatterns[args.Pattern] != nil {
+		pattern = newWritePattern(args, s.clock)
 	}
+
+	return s.repeat(ctx, func() error {
+		var shown interface{} = args.Value
+		if pattern != nil {
+			value := pattern.values(1)[0]
+			args.Value, shown = uint16(value), value
+			data = orderBytes(binary.BigEndian.AppendUint16(nil, args.Value), args.ByteOrder)
+		}
+		before := printer.snapshot(client, false, 1)
+		err := s.writeRegisters(args.Start, data, writeSingle)
+		err = s.resolveWrite(err, writesValues(false, args.Start, []uint16{args.Value}))
+		if err != nil {
+			printer.printError("write", err)
+		} else {
+			printer.printWritten(fmt.Sprintf("single register: %v", shown), valueList([]uint16{args.Value}))
+			printer.printBeforeAfter(before, printer.snapshot(client, false, 1))
+			if args.Verify {
+				s.verifyWrite(false, []uint16{args.Value})
+			}
+		}
+		return err
+	})
 }
 
-// writeSingleRegister writes a single register to the Modbus server
-func writeSingleRegister(client modbus.Client, address uint16, value uint16, repeat int, interval int) {
-	for i := 0; repeat <= 0 || i < repeat; i++ {
-		_, err := client.WriteSingleRegister(address, value)
+// writeMultipleCoils writes multiple coils to the Modbus server
+func writeMultipleCoils(ctx context.Context, s *session) error {
+	client, args, printer := s.client, s.args, s.printer
+	// One bit per coil: any non-zero value switches the coil on
+	states := make([]bool, len(args.Values))
+	for i, value := range args.Values {
+		states[i] = value != 0
+	}
+	var pattern *writePattern
+	if writePatterns[args.Pattern] != nil {
+		pattern = newWritePattern(args, s.clock)
+	}
+
+	return s.repeat(ctx, func() error {
+		if pattern != nil {
+			args.Values = registerWords(pattern.values(len(args.Values)))
+			for i, value := range args.Values {
+				states[i] = value != 0
+			}
+		}
+		before := printer.snapshot(client, true, uint16(len(args.Values)))
+		err := writeCoils(client, args.Start, states)
+		err = s.resolveWrite(err, writesValues(true, args.Start, coilStates(args.Values)))
 		if err != nil {
-			log.Printf("Error during write operation: %v", err)
+			printer.printError("write", err)
 		} else {
-			log.Printf("Successfully wrote single register: %v", value)
+			printer.printWritten(fmt.Sprintf("multiple coils: %v", args.Values), valueList(args.Values))
+			printer.printBeforeAfter(before, printer.snapshot(client, true, uint16(len(args.Values))))
+			if args.Verify {
+				s.verifyWrite(true, coilStates(args.Values))
+			}
 		}
+		return err
+	})
+}
 
-		time.Sleep(time.Duration(interval) * time.Millisecond)
+// writeCoils writes states from address with FC15, as several requests at
+// increasing addresses when there are more than one request can carry. It
+// stops at the first failure.
+func writeCoils(client modbus.Client, address uint16, states []bool) error {
+	count := len(states)
+	chunks := (count + maxWriteCoils - 1) / maxWriteCoils
+	for written := 0; written < count; written += maxWriteCoils {
+		n := count - written
+		if n > maxWriteCoils {
+			n = maxWriteCoils
+		}
+		first := address + uint16(written)
+		if _, err := client.WriteMultipleCoils(first, uint16(n), packCoils(states[written:written+n])); err != nil {
+			if written == 0 {
+				return err
+			}
+			return fmt.Errorf("coils %d to %d (%d of %d written): %w", first, int(first)+n-1, written, count, describeException(err))
+		}
+		if chunks > 1 {
+			logInfof("Wrote coils %d to %d (%d of %d)", first, int(first)+n-1, written+n, count)
+		}
 	}
+	if chunks > 1 {
+		logInfof("Wrote %d coils in %d requests", count, chunks)
+	}
+	return nil
 }
 
-// writeMultipleCoils writes multiple coils to the Modbus server
-func writeMultipleCoils(client modbus.Client, start uint16, values []uint16, repeat int, interval int) {
-	data := make([]byte, len(values)*2)
-	for i, value := range values {
-		binary.BigEndian.PutUint16(data[i*2:i*2+2], value)
+// writeMultipleRegisters writes multiple registers to the Modbus server
+func writeMultipleRegisters(ctx context.Context, s *session) error {
+	client, args, printer := s.client, s.args, s.printer
+	if args.Type == "string" {
+		// A string is one value, given with --value
+		return writeTypedRegisters(ctx, s, []string{args.ValueText})
+	}
+	if args.Type != "" {
+		return writeTypedRegisters(ctx, s, args.ValueTexts)
+	}
+	words := make([][]byte, len(args.Values))
+	for i, value := range args.Values {
+		words[i] = binary.BigEndian.AppendUint16(nil, value)
+	}
+	data := joinWords(words, args.ByteOrder)
+	if args.Verbose {
+		logDebugf("Transmitting register values: %s", formatRegisters(data))
+	}
+
+	var pattern *writePattern
+	if writePatterns[args.Pattern] != nil {
+		pattern = newWritePattern(args, s.clock)
+	}
+
+	return s.repeat(ctx, func() error {
+		var shown interface{} = args.Values
+		if pattern != nil {
+			values := pattern.values(len(args.Values))
+			args.Values, shown = registerWords(values), values
+			for i, value := range args.Values {
+				words[i] = binary.BigEndian.AppendUint16(nil, value)
+			}
+			data = joinWords(words, args.ByteOrder)
+		}
+		before := printer.snapshot(client, false, uint16(len(args.Values)))
+		err := s.writeRegisters(args.Start, data, writeMultiple)
+		err = s.resolveWrite(err, writesValues(false, args.Start, args.Values))
+		if err != nil {
+			printer.printError("write", err)
+		} else {
+			printer.printWritten(fmt.Sprintf("multiple registers: %v", shown), valueList(args.Values))
+			printer.printBeforeAfter(before, printer.snapshot(client, false, uint16(len(args.Values))))
+			if args.Verify {
+				s.verifyWrite(false, args.Values)
+			}
+		}
+		return err
+	})
+}
+
+// writeTypedRegisters writes values of the --type datatype from --start,
+// each taking several registers. write_single_register of a value that fits
+// one register prefers FC06, as an untyped write does.
+func writeTypedRegisters(ctx context.Context, s *session, texts []string) error {
+	client, args, printer := s.client, s.args, s.printer
+	data, values, err := encodeTyped(texts, args)
+	if err != nil {
+		return err
+	}
+	registers := uint16(len(data) / registerSize)
+	preferred := writeMultiple
+	if args.Operation == "write_single_register" && registers == 1 {
+		preferred = writeSingle
+	}
+	if args.Verbose {
+		logDebugf("Transmitting register values: %s", formatRegisters(data))
+	}
+	var pattern *writePattern
+	if writePatterns[args.Pattern] != nil {
+		pattern = newWritePattern(args, s.clock)
 	}
 
-	for i := 0; repeat <= 0 || i < repeat; i++ {
-		_, err := client.WriteMultipleCoils(start, uint16(len(values)), data)
+	return s.repeat(ctx, func() error {
+		if pattern != nil {
+			if data, values, err = encodeTyped(pattern.texts(len(texts)), args); err != nil {
+				return err
+			}
+		}
+		before := printer.snapshot(client, false, registers)
+		err := s.writeRegisters(args.Start, data, preferred)
+		err = s.resolveWrite(err, writesValues(false, args.Start, registerValues(data, args.ByteOrder)))
+		if err != nil {
+			printer.printError("write", err)
+		} else {
+			printer.printWritten(fmt.Sprintf("%s values: %v", args.Type, values), values)
+			printer.printBeforeAfter(before, printer.snapshot(client, false, registers))
+			if args.Verify {
+				s.verifyWrite(false, registerValues(data, args.ByteOrder))
+			}
+		}
+		return err
+	})
+}
+
+// maskWriteRegister changes bits of a holding register in place with FC22:
+// result = (current AND and-mask) OR (or-mask AND NOT and-mask)
+func maskWriteRegister(ctx context.Context, s *session) error {
+	client, args, printer := s.client, s.args, s.printer
+
+	return s.repeat(ctx, func() error {
+		before := printer.snapshot(client, false, 1)
+		// The client checks that the echoed address and masks match the request
+		echo, err := client.MaskWriteRegister(args.Start, args.AndMask, args.OrMask)
+		err = s.resolveWrite(err, writeTarget{address: args.Start, count: 1, applied: func(values []uint16) bool {
+			// The bits cleared by the AND mask must hold those of the OR mask
+			return values[0]&^args.AndMask == args.OrMask&^args.AndMask
+		}})
+		if err == nil && !args.DryRun && len(echo) == 2*registerSize {
+			logInfof("Device echoed register %d, and-mask 0x%04X, or-mask 0x%04X",
+				args.Start, binary.BigEndian.Uint16(echo), binary.BigEndian.Uint16(echo[registerSize:]))
+		}
 		if err != nil {
-			log.Printf("Error during write operation: %v", err)
+			printer.printError("write", err)
 		} else {
-			log.Printf("Successfully wrote multiple coils: %v", values)
+			printer.printWritten(fmt.Sprintf("register %d with masks: and 0x%04X, or 0x%04X", args.Start, args.AndMask, args.OrMask), valueList([]uint16{args.AndMask, args.OrMask}))
+			printer.printBeforeAfter(before, printer.snapshot(client, false, 1))
 		}
+		return err
+	})
+}
 
-		time.Sleep(time.Duration(interval) * time.Millisecond)
+// formatRegisters formats register data as space-separated 0xNNNN words
+func formatRegisters(data []byte) string {
+	words := make([]string, 0, len(data)/registerSize)
+	for i := 0; i+registerSize <= len(data); i += registerSize {
+		words = append(words, fmt.Sprintf("0x%04X", binary.BigEndian.Uint16(data[i:])))
 	}
+	return strings.Join(words, " ")
 }
 
-// writeMultipleRegisters writes multiple registers to the Modbus server
-func writeMultipleRegisters(client modbus.Client, start uint16, values []uint16, repeat int, interval int) {
-	data := make([]byte, len(values)*2)
+// verifyWrite reads back the coils or registers written from --start and
+// warns about every one that differs from the written value
+func (s *session) verifyWrite(coils bool, written []uint16) {
+	values, err := readBack(s.client, s.args, coils, uint16(len(written)))
+	if err != nil {
+		logErrorf("Error reading back written values: %v", err)
+		return
+	}
+	mismatches := 0
+	for i, value := range written {
+		if values[i] != value {
+			logWarnf("Warning: address %d was written as %d but reads back as %d", int(s.args.Start)+i, value, values[i])
+			mismatches++
+		}
+	}
+	if mismatches == 0 {
+		logInfof("Verified %d written values", len(written))
+	}
+}
+
+// coilStates converts written coil values to the 0/1 states read back
+func coilStates(values []uint16) []uint16 {
+	states := make([]uint16, len(values))
 	for i, value := range values {
-		binary.BigEndian.PutUint16(data[i*2:i*2+2], value)
+		if value != 0 {
+			states[i] = 1
+		}
+	}
+	return states
+}
+
+// registerValues converts register data in device byte order to the
+// register values read back
+func registerValues(data []byte, byteOrder string) []uint16 {
+	words := splitWords(data, registerSize, byteOrder)
+	values := make([]uint16, len(words))
+	for i, word := range words {
+		values[i] = binary.BigEndian.Uint16(word)
 	}
+	return values
+}
+
+// readBack reads the coils or holding registers targeted by a write, in the
+// same representation as the written values
+func readBack(client modbus.Client, args *ModbusArgs, coils bool, count uint16) ([]uint16, error) {
+	return readBackAt(client, args.ByteOrder, coils, args.Start, count)
+}
 
-	for i := 0; repeat <= 0 || i < repeat; i++ {
-		_, err := client.WriteMultipleRegisters(start, uint16(len(values)), data)
+// readBackAt is readBack for a write to address
+func readBackAt(client modbus.Client, byteOrder string, coils bool, address, count uint16) ([]uint16, error) {
+	values := make([]uint16, count)
+	if coils {
+		response, err := readBlock(client, modbus.FuncCodeReadCoils, address, count, 1)
 		if err != nil {
-			log.Printf("Error during write operation: %v", err)
-		} else {
-			log.Printf("Successfully wrote multiple registers: %v", values)
+			return nil, err
+		}
+		if len(response) < (int(count)+7)/8 {
+			return nil, fmt.Errorf("short coil response: %d bytes for %d coils", len(response), count)
+		}
+		for i := range values {
+			if response[i/8]&(1<<(i%8)) != 0 {
+				values[i] = 1
+			}
 		}
+		return values, nil
+	}
 
-		time.Sleep(time.Duration(interval) * time.Millisecond)
+	response, err := readBlock(client, modbus.FuncCodeReadHoldingRegisters, address, count, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < int(count)*registerSize {
+		return nil, fmt.Errorf("short register response: %d bytes for %d registers", len(response), count)
+	}
+	for i, word := range splitWords(response[:int(count)*registerSize], registerSize, byteOrder) {
+		values[i] = binary.BigEndian.Uint16(word)
 	}
+	return values, nil
 }
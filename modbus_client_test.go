@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/goburrow/modbus"
+)
+
+func TestPerformReadOperation(t *testing.T) {
+	tests := []struct {
+		name         string
+		flags        []string
+		functionCode byte
+		want         []interface{}
+	}{
+		{"signed holding registers", []string{"-o", "read_holding_registers", "--start", "10", "--count", "3"},
+			modbus.FuncCodeReadHoldingRegisters, []interface{}{1.0, -1.0, 300.0}},
+		{"unsigned holding registers", []string{"-o", "read_holding_registers", "--start", "10", "--count", "3", "--unsigned"},
+			modbus.FuncCodeReadHoldingRegisters, []interface{}{1.0, 65535.0, 300.0}},
+		{"input registers", []string{"-o", "read_input_registers", "--start", "20", "--count", "1"},
+			modbus.FuncCodeReadInputRegisters, []interface{}{-2.0}},
+		{"coils", []string{"-o", "read_coils", "--start", "5", "--count", "3"},
+			modbus.FuncCodeReadCoils, []interface{}{true, false, true}},
+		{"discrete inputs", []string{"-o", "read_discrete_inputs", "--start", "0", "--count", "2"},
+			modbus.FuncCodeReadDiscreteInputs, []interface{}{false, true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t)
+			server.holding[10], server.holding[11], server.holding[12] = 1, 0xFFFF, 300
+			server.input[20] = 0xFFFE
+			server.coils[5], server.coils[7] = true, true
+			server.discreteInputs[1] = true
+			s, out := newTestSession(t, server, test.flags...)
+
+			if err := performReadOperation(context.Background(), s, test.functionCode); err != nil {
+				t.Fatalf("performReadOperation: %v", err)
+			}
+			results := testResults(t, out)
+			if len(results) != 1 {
+				t.Fatalf("got %d results, want 1", len(results))
+			}
+			if got := resultValues(results[0]); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("values = %v, want %v", got, test.want)
+			}
+			if results[0].Quality != qualityGood {
+				t.Errorf("quality = %s, want %s", results[0].Quality, qualityGood)
+			}
+			if s.succeeded != 1 || s.failed != 0 {
+				t.Errorf("succeeded, failed = %d, %d, want 1, 0", s.succeeded, s.failed)
+			}
+		})
+	}
+}
+
+func TestPerformReadOperationException(t *testing.T) {
+	tests := []struct {
+		name      string
+		flags     []string
+		exception byte
+		want      byte
+	}{
+		{"illegal data address", []string{"--start", "998", "--count", "5"}, 0, modbus.ExceptionCodeIllegalDataAddress},
+		{"server device failure", []string{"--start", "0", "--count", "1"}, modbus.ExceptionCodeServerDeviceFailure, modbus.ExceptionCodeServerDeviceFailure},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t)
+			server.exception = test.exception
+			s, out := newTestSession(t, server, append([]string{"-o", "read_holding_registers"}, test.flags...)...)
+
+			err := performReadOperation(context.Background(), s, modbus.FuncCodeReadHoldingRegisters)
+			if !errors.Is(err, errReported) {
+				t.Fatalf("performReadOperation = %v, want errReported", err)
+			}
+			var modbusErr *modbus.ModbusError
+			if !errors.As(s.lastErr, &modbusErr) || modbusErr.ExceptionCode != test.want {
+				t.Errorf("error = %v, want exception %d", s.lastErr, test.want)
+			}
+			if results := testResults(t, out); len(results) != 0 {
+				t.Errorf("printed %v, want no results", results)
+			}
+			if s.succeeded != 0 || s.failed != 1 || s.ambiguous != 0 {
+				t.Errorf("succeeded, failed, ambiguous = %d, %d, %d, want 0, 1, 0", s.succeeded, s.failed, s.ambiguous)
+			}
+		})
+	}
+}
+
+func TestWriteSingleRegister(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		want  uint16
+		// shown is the register value reported, which JSON gives unsigned
+		shown interface{}
+	}{
+		{"signed", []string{"--value", "-2"}, 0xFFFE, 65534.0},
+		{"unsigned", []string{"--value", "65535", "--unsigned"}, 0xFFFF, 65535.0},
+		{"byte swapped", []string{"--value", "258", "--byteorder", "BADC"}, 0x0201, 258.0},
+		// A typed value that fits one register is still written with FC06
+		{"--type int16", []string{"--type", "int16", "--value", "-2"}, 0xFFFE, -2.0},
+		{"--type bcd", []string{"--type", "bcd", "--value", "1234"}, 0x1234, 1234.0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t)
+			s, out := newTestSession(t, server, append([]string{"-o", "write_single_register", "--start", "4"}, test.flags...)...)
+
+			if err := writeSingleRegister(context.Background(), s); err != nil {
+				t.Fatalf("writeSingleRegister: %v", err)
+			}
+			if server.holding[4] != test.want {
+				t.Errorf("register 4 = 0x%04X, want 0x%04X", server.holding[4], test.want)
+			}
+			if !reflect.DeepEqual(server.functionCodes, []byte{modbus.FuncCodeWriteSingleRegister}) {
+				t.Errorf("function codes = %v, want only FC06", server.functionCodes)
+			}
+			results := testResults(t, out)
+			if len(results) != 1 || !reflect.DeepEqual(resultValues(results[0]), []interface{}{test.shown}) {
+				t.Errorf("results = %v, want one of %v", results, test.shown)
+			}
+		})
+	}
+}
+
+func TestWriteSingleRegisterException(t *testing.T) {
+	server := newTestServer(t)
+	server.exception = modbus.ExceptionCodeIllegalDataValue
+	s, out := newTestSession(t, server, "-o", "write_single_register", "--start", "4", "--value", "7")
+
+	err := writeSingleRegister(context.Background(), s)
+	if !errors.Is(err, errReported) {
+		t.Fatalf("writeSingleRegister = %v, want errReported", err)
+	}
+	var modbusErr *modbus.ModbusError
+	if !errors.As(s.lastErr, &modbusErr) || modbusErr.ExceptionCode != modbus.ExceptionCodeIllegalDataValue {
+		t.Errorf("error = %v, want Illegal Data Value", s.lastErr)
+	}
+	if server.holding[4] != 0 {
+		t.Errorf("register 4 = %d, want it unchanged", server.holding[4])
+	}
+	if results := testResults(t, out); len(results) != 0 {
+		t.Errorf("printed %v, want no results", results)
+	}
+	// An exception is a definite answer: the write is neither ambiguous nor retried
+	if s.failed != 1 || s.ambiguous != 0 {
+		t.Errorf("failed, ambiguous = %d, %d, want 1, 0", s.failed, s.ambiguous)
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		check func(*ModbusArgs) bool
+	}{
+		{"defaults", []string{"-s", "plc"}, func(args *ModbusArgs) bool {
+			return args.Port == 502 && args.UnitID == 1 && args.ByteOrder == "ABCD" && args.Format == "text" && args.Repeat == 1
+		}},
+		{"byte order alias", []string{"-s", "plc", "--byte-order", "cdab"}, func(args *ModbusArgs) bool {
+			return args.ByteOrder == "CDAB"
+		}},
+		{"short operation name", []string{"-s", "plc", "-o", "read_write_registers", "--values", "1"}, func(args *ModbusArgs) bool {
+			return args.Operation == "read_write_multiple_registers"
+		}},
+		{"negative register value", []string{"-s", "plc", "-o", "write_single_register", "--value", "-1"}, func(args *ModbusArgs) bool {
+			return args.Value == 0xFFFF
+		}},
+		{"unsigned register value", []string{"-s", "plc", "-o", "write_single_register", "--value", "65535", "-u"}, func(args *ModbusArgs) bool {
+			return args.Value == 0xFFFF
+		}},
+		{"quiet", []string{"-s", "plc", "-q"}, func(args *ModbusArgs) bool {
+			return minLogLevel == levelWarn && !args.Verbose
+		}},
+		{"timeout", []string{"-s", "plc", "--timeout", "250"}, func(args *ModbusArgs) bool {
+			return args.ConnectTimeout.Milliseconds() == 250 && args.ResponseTimeout.Milliseconds() == 250
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args, err := parseTestFlags(t, test.flags...)
+			if err != nil {
+				t.Fatalf("parseFlags(%q): %v", test.flags, err)
+			}
+			if !test.check(args) {
+				t.Errorf("parseFlags(%q) = %+v", test.flags, args)
+			}
+		})
+	}
+}
+
+func TestParseFlagsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		want  string
+	}{
+		{"no server", []string{"-o", "read_coils"}, "Server address is required"},
+		{"byte order", []string{"-s", "plc", "--byteorder", "ACBD"}, "Invalid byte order: ACBD"},
+		{"log level", []string{"-s", "plc", "--log-level", "loud"}, "Invalid log level: loud"},
+		{"quiet and log level", []string{"-s", "plc", "-q", "--log-level", "info"}, "--quiet cannot be combined with --log-level"},
+		{"value too large", []string{"-s", "plc", "-o", "write_single_register", "--value", "70000"}, "does not fit in a 16-bit register"},
+		{"signed overflow", []string{"-s", "plc", "-o", "write_single_register", "--value", "40000"}, "above 32767 for a signed register"},
+		{"interactive preflight", []string{"-s", "plc", "--interactive", "--preflight"}, "--preflight cannot be used with --interactive"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseTestFlags(t, test.flags...)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("parseFlags(%q) = %v, want an error containing %q", test.flags, err, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRegisterValueBoundaries(t *testing.T) {
+	// Each value is parsed as signed, --unsigned and with --allow-wrap, which
+	// accepts them all; the value of a mode that must fail is not checked
+	tests := []struct {
+		text                   string
+		signed, unsigned, wrap uint16
+		signedOK, unsignedOK   bool
+	}{
+		{"-32768", 0x8000, 0, 0x8000, true, false},
+		{"-1", 0xFFFF, 0, 0xFFFF, true, false},
+		{"0", 0, 0, 0, true, true},
+		{"32767", 0x7FFF, 0x7FFF, 0x7FFF, true, true},
+		{"65535", 0, 0xFFFF, 0xFFFF, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			for _, mode := range []struct {
+				name               string
+				unsigned, wrap, ok bool
+				want               uint16
+			}{
+				{"signed", false, false, test.signedOK, test.signed},
+				{"unsigned", true, false, test.unsignedOK, test.unsigned},
+				{"allow-wrap", false, true, true, test.wrap},
+			} {
+				got, err := parseRegisterValue(test.text, mode.unsigned, mode.wrap)
+				switch {
+				case mode.ok && err != nil:
+					t.Errorf("%s: %v", mode.name, err)
+				case mode.ok && got != mode.want:
+					t.Errorf("%s: got 0x%04X, want 0x%04X", mode.name, got, mode.want)
+				case !mode.ok && err == nil:
+					t.Errorf("%s: got 0x%04X, want an error", mode.name, got)
+				}
+			}
+		})
+	}
+
+	// Nothing outside the 16-bit range is accepted, even with --allow-wrap
+	for _, text := range []string{"-32769", "65536"} {
+		if got, err := parseRegisterValue(text, false, true); err == nil {
+			t.Errorf("parseRegisterValue(%s) = 0x%04X, want an error", text, got)
+		}
+	}
+}
+
+func TestParseFlagsBoundaryValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		want  []uint16
+	}{
+		{"signed --values", []string{"--values", "-32768,-1,0,32767"}, []uint16{0x8000, 0xFFFF, 0, 0x7FFF}},
+		{"unsigned --values", []string{"--values", "0,32767,65535", "-u"}, []uint16{0, 0x7FFF, 0xFFFF}},
+		{"wrapped --values", []string{"--values", "-1,65535", "--allow-wrap"}, []uint16{0xFFFF, 0xFFFF}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flags := append([]string{"-s", "plc", "-o", "write_multiple_registers"}, test.flags...)
+			args, err := parseTestFlags(t, flags...)
+			if err != nil {
+				t.Fatalf("parseFlags(%q): %v", flags, err)
+			}
+			if !reflect.DeepEqual(args.Values, test.want) {
+				t.Errorf("values = %04X, want %04X", args.Values, test.want)
+			}
+		})
+	}
+
+	// A value that would change meaning under masking is rejected in every path
+	for _, flags := range [][]string{
+		{"-o", "write_single_register", "--value", "65535"},
+		{"-o", "write_single_register", "--value", "-1", "-u"},
+		{"-o", "write_multiple_registers", "--values", "0,65535"},
+		{"-o", "write_multiple_registers", "--values", "-32768,0", "-u"},
+		{"-o", "write_multiple_registers", "--values", "65535", "--type", "int16"},
+		{"-o", "write_multiple_registers", "--values", "-1", "--type", "uint16"},
+	} {
+		flags = append([]string{"-s", "plc"}, flags...)
+		if _, err := parseTestFlags(t, flags...); err == nil {
+			t.Errorf("parseFlags(%q) succeeded, want an error", flags)
+		}
+	}
+}
+
+func TestReadCoilCounts(t *testing.T) {
+	// 1 coil fits a single byte, 9 coils spill into a second one
+	for _, count := range []int{1, 9} {
+		t.Run(strconv.Itoa(count), func(t *testing.T) {
+			server := newTestServer(t)
+			want := make([]interface{}, count)
+			for i := range want {
+				on := i%3 == 0
+				server.coils[30+i] = on
+				want[i] = on
+			}
+			server.coils[30+count] = true
+			s, out := newTestSession(t, server, "-o", "read_coils", "--start", "30", "--count", strconv.Itoa(count))
+
+			if err := performReadOperation(context.Background(), s, modbus.FuncCodeReadCoils); err != nil {
+				t.Fatalf("performReadOperation: %v", err)
+			}
+			results := testResults(t, out)
+			if len(results) != 1 || !reflect.DeepEqual(resultValues(results[0]), want) {
+				t.Errorf("results = %v, want %v", results, want)
+			}
+		})
+	}
+}
+
+func TestWriteMultipleCoilsRoundTrip(t *testing.T) {
+	// The byte boundary cases: one byte, a full byte, one more and two full bytes
+	for _, count := range []int{1, 8, 9, 16} {
+		t.Run(strconv.Itoa(count), func(t *testing.T) {
+			server := newTestServer(t)
+			values := make([]string, count)
+			want := make([]interface{}, count)
+			for i := range values {
+				on := i%2 == 0 || i == count-1
+				values[i], want[i] = "0", false
+				if on {
+					values[i], want[i] = "1", true
+				}
+			}
+			// Coils past the block stay as they are
+			server.coils[40+count] = true
+			s, _ := newTestSession(t, server, "-o", "write_multiple_coils", "--start", "40", "--values", strings.Join(values, ","))
+
+			// The server rejects a byte count other than ceil(count/8)
+			if err := writeMultipleCoils(context.Background(), s); err != nil {
+				t.Fatalf("writeMultipleCoils: %v", err)
+			}
+			for i, on := range want {
+				if server.coils[40+i] != on {
+					t.Errorf("coil %d = %v, want %v", 40+i, server.coils[40+i], on)
+				}
+			}
+			if !server.coils[40+count] {
+				t.Errorf("coil %d after the block was switched off", 40+count)
+			}
+
+			s, out := newTestSession(t, server, "-o", "read_coils", "--start", "40", "--count", strconv.Itoa(count))
+			if err := performReadOperation(context.Background(), s, modbus.FuncCodeReadCoils); err != nil {
+				t.Fatalf("performReadOperation: %v", err)
+			}
+			results := testResults(t, out)
+			if len(results) != 1 || !reflect.DeepEqual(resultValues(results[0]), want) {
+				t.Errorf("read back %v, want %v", results, want)
+			}
+		})
+	}
+}
+
+func TestInt32WordSwappedRoundTrip(t *testing.T) {
+	server := newTestServer(t)
+	s, _ := newTestSession(t, server, "-o", "write_multiple_registers", "--start", "50", "--type", "int32", "--byteorder", "CDAB",
+		"--values", "-2,-2147483648")
+	if err := writeMultipleRegisters(context.Background(), s); err != nil {
+		t.Fatalf("writeMultipleRegisters: %v", err)
+	}
+	// Low word first on a word-swapped device
+	want := []uint16{0xFFFE, 0xFFFF, 0x0000, 0x8000}
+	if got := server.holding[50:54]; !reflect.DeepEqual(got, want) {
+		t.Errorf("registers = %04X, want %04X", got, want)
+	}
+
+	s, out := newTestSession(t, server, "-o", "read_holding_registers", "--start", "50", "--count", "2", "--type", "int32", "--byteorder", "CDAB")
+	if err := performReadOperation(context.Background(), s, modbus.FuncCodeReadHoldingRegisters); err != nil {
+		t.Fatalf("performReadOperation: %v", err)
+	}
+	results := testResults(t, out)
+	if len(results) != 1 || !reflect.DeepEqual(resultValues(results[0]), []interface{}{-2.0, -2147483648.0}) {
+		t.Errorf("read back %v, want -2 and -2147483648", results)
+	}
+
+	// --unsigned contradicts a signed 32-bit type
+	if _, err := parseTestFlags(t, "-s", "plc", "-o", "read_holding_registers", "--type", "int32", "-u"); err == nil {
+		t.Errorf("parseFlags accepted --unsigned with --type int32")
+	}
+}
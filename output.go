@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// csvTimestampFormat is RFC3339 with millisecond precision
+const csvTimestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Quality flags attached to json, csv and binlog results
+const (
+	// qualityGood marks values freshly read from (or written to) the device,
+	// whether at the first try or by retrying the request
+	qualityGood = "GOOD"
+	// qualityUncertain marks values obtained just after a wall clock step,
+	// whose timestamp cannot be compared with those before
+	qualityUncertain = "UNCERTAIN"
+	// qualityBad marks a result without usable values
+	qualityBad = "BAD"
+)
+
+// resultQuality returns the quality flag of a result with the given error. A
+// retried request still answered with current values, so it does not lower
+// the quality; results report it separately.
+func resultQuality(err error, clockStep bool) string {
+	switch {
+	case err != nil:
+		return qualityBad
+	case clockStep:
+		return qualityUncertain
+	}
+	return qualityGood
+}
+
+// operationTables name the table the values of each read come from, as
+// register maps do
+var operationTables = map[string]string{
+	"read_coils":                    "coil",
+	"read_discrete_inputs":          "discrete",
+	"read_holding_registers":        "holding",
+	"read_input_registers":          "input",
+	"read_write_multiple_registers": "holding",
+	"read_fifo_queue":               "holding",
+	"read_exception_status":         "exception_status",
+}
+
+// jsonResult is the line printed for each operation in json output mode
+type jsonResult struct {
+	Timestamp string      `json:"timestamp"`
+	Operation string      `json:"operation"`
+	UnitID    byte        `json:"unit_id"`
+	Start     uint16      `json:"start"`
+	Quality   string      `json:"quality"`
+	Values    []jsonValue `json:"values,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	ClockStep string      `json:"clock_step,omitempty"`
+	// Retried marks a result only obtained by retrying the request, so later
+	// than the cycle was due
+	Retried bool `json:"retried,omitempty"`
+}
+
+// jsonValue is one value of a jsonResult with its address
+type jsonValue struct {
+	Address int         `json:"address"`
+	Value   interface{} `json:"value"`
+}
+
+// resultPrinter prints operation results in the format selected with --format
+// and records them in the session report and webhook, if they are in use
+type resultPrinter struct {
+	args          *ModbusArgs
+	out           io.Writer
+	csvWriter     *csv.Writer
+	headerWritten bool
+	binlog        *binlogWriter
+	report        *sessionReport
+	webhook       *webhook
+	metrics       *metrics
+
+	// addresses overrides the addresses of the values of a result, for
+	// operations whose values are not consecutive
+	addresses []int
+
+	// names and tables are the register map point names and tables of the
+	// values of a result, if the operation reads named points
+	names  []string
+	tables []string
+
+	// label prefixes text results, telling the results of --block apart
+	label string
+
+	// clock timestamps the results; steps watches it for wall clock steps, and
+	// clockStep is the step detected just before the result being printed, if
+	// any
+	clock     clock
+	steps     clockWatch
+	clockStep time.Duration
+
+	// retried is set while the request of the result is being retried
+	retried bool
+}
+
+// newResultPrinter creates a resultPrinter that writes json and csv results to
+// out, timestamped with clock
+func newResultPrinter(args *ModbusArgs, out io.Writer, clock clock) *resultPrinter {
+	return &resultPrinter{args: args, out: out, csvWriter: csv.NewWriter(out), clock: clock, steps: clockWatch{clock: clock}}
+}
+
+// valueCount returns the number of values each result of the operation carries
+func (p *resultPrinter) valueCount() int {
+	if p.args.Type == "string" {
+		return 1
+	}
+	switch p.args.Operation {
+	case "write_single_coil", "write_single_register":
+		return 1
+	case "mask_write_register", "set_bits", "clear_bits", "toggle_bits":
+		return 2
+	case "read_exception_status":
+		return 8
+	case "diagnostics":
+		return len(p.args.Data) / registerSize
+	case "raw":
+		return 1
+	case "write_multiple_coils", "write_multiple_registers":
+		return len(p.args.ValueTexts)
+	}
+	return int(p.args.Count)
+}
+
+// address returns the address of the i-th value of a result. Values of a
+// multi-register --type take several addresses each.
+func (p *resultPrinter) address(i int) int {
+	if p.addresses != nil {
+		return p.addresses[i]
+	}
+	switch p.args.Operation {
+	case "read_holding_registers", "read_input_registers", "write_single_register", "write_multiple_registers",
+		"read_write_multiple_registers":
+		if p.args.Type != "" {
+			return int(p.args.Start) + i*datatypeRegisters(p.args.Type)
+		}
+	}
+	return int(p.args.Start) + i
+}
+
+// metricPoint returns the point the i-th value of a result is exported as
+func (p *resultPrinter) metricPoint(i int) metricPoint {
+	if p.names != nil {
+		return metricPoint{table: p.tables[i], address: p.address(i), name: p.names[i]}
+	}
+	return metricPoint{table: operationTables[p.args.Operation], address: p.address(i)}
+}
+
+// valueList converts decoded values into the form accepted by printValues
+func valueList[T any](values []T) []interface{} {
+	list := make([]interface{}, len(values))
+	for i, value := range values {
+		list[i] = value
+	}
+	return list
+}
+
+// printError reports a failed operation. kind is "read" or "write".
+func (p *resultPrinter) printError(kind string, err error) {
+	err = describeException(err)
+	p.clockStep = p.steps.check()
+	if p.report != nil {
+		p.report.addEntry(p.args.Operation, p.args.Start, "", err)
+	}
+	if p.webhook != nil {
+		p.webhook.post(p.newJSONResult(nil, err))
+	}
+	if p.metrics != nil {
+		p.metrics.record(false, nil, p.metricPoint, err)
+	}
+	switch p.args.Format {
+	case "json":
+		p.printJSON(nil, err)
+		return
+	case "csv":
+		// Keep the row so the columns stay aligned with successful polls
+		p.printCSV(nil, err)
+	case "binlog":
+		p.binlog.writeBlock(nil, p.address, err, p.binlogFlags())
+	}
+	logErrorf("%sError during %s operation: %v", p.label, kind, err)
+}
+
+// printValues reports a successful operation. text is the log line used in
+// text mode; values are the decoded or written values.
+func (p *resultPrinter) printValues(text string, values []interface{}) {
+	p.clockStep = p.steps.check()
+	if p.report != nil {
+		p.report.addEntry(p.args.Operation, p.args.Start, text, nil)
+	}
+	if p.webhook != nil {
+		p.webhook.post(p.newJSONResult(values, nil))
+	}
+	if p.metrics != nil {
+		read := readOnlyOperations[p.args.Operation] || p.args.Operation == "read_write_multiple_registers"
+		p.metrics.record(read, values, p.metricPoint, nil)
+	}
+	switch p.args.Format {
+	case "json":
+		p.printJSON(values, nil)
+	case "csv":
+		p.printCSV(values, nil)
+	case "binlog":
+		p.binlog.writeBlock(values, p.address, nil, p.binlogFlags())
+	default:
+		logInfof("%s%s", p.label, text)
+	}
+}
+
+// printWritten reports a successful write of what, such as "single coil: ON".
+// In a dry run nothing was sent, so the write is only logged as what would
+// have been written, and left out of the report, webhook, metrics and json,
+// csv or binlog output.
+func (p *resultPrinter) printWritten(what string, values []interface{}) {
+	if p.args.DryRun {
+		logInfof("%sDry run, would write %s", p.label, what)
+		return
+	}
+	p.printValues("Successfully wrote "+what, values)
+}
+
+// newJSONResult builds the JSON form of one operation result
+func (p *resultPrinter) newJSONResult(values []interface{}, err error) jsonResult {
+	result := jsonResult{
+		Timestamp: p.clock.Now().Format(time.RFC3339Nano),
+		Operation: p.args.Operation,
+		UnitID:    p.args.UnitID,
+		Start:     p.args.Start,
+		Quality:   resultQuality(err, p.clockStep != 0),
+		Retried:   p.retried,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if p.clockStep != 0 {
+		result.ClockStep = p.clockStep.String()
+	}
+	for i, value := range values {
+		result.Values = append(result.Values, jsonValue{Address: p.address(i), Value: value})
+	}
+	return result
+}
+
+// printJSON prints the result of one operation as a single line of JSON,
+// on stdout (or the --output file) for results and on stderr for errors
+func (p *resultPrinter) printJSON(values []interface{}, err error) {
+	out := p.out
+	if err != nil {
+		out = os.Stderr
+	}
+	line, err := json.Marshal(p.newJSONResult(values, err))
+	if err != nil {
+		logErrorf("Error encoding JSON result: %v", err)
+		return
+	}
+	fmt.Fprintln(out, string(line))
+}
+
+// printCSV prints one CSV row, preceded by the header row the first time.
+// Every row has a timestamp, one column per address, a quality column, an
+// error column and a clock_step column set on the first row after a wall
+// clock step; the value cells of a failed operation are left empty.
+func (p *resultPrinter) printCSV(values []interface{}, err error) {
+	count := p.valueCount()
+	if !p.headerWritten {
+		header := []string{"timestamp"}
+		for i := 0; i < count; i++ {
+			header = append(header, "addr_"+strconv.Itoa(p.address(i)))
+		}
+		p.csvWriter.Write(append(header, "quality", "error", "clock_step"))
+		p.headerWritten = true
+	}
+
+	row := make([]string, count+4)
+	row[0] = p.clock.Now().Format(csvTimestampFormat)
+	for i, value := range values {
+		if i < count {
+			row[i+1] = fmt.Sprint(value)
+		}
+	}
+	row[count+1] = resultQuality(err, p.clockStep != 0)
+	if err != nil {
+		row[count+2] = err.Error()
+	}
+	if p.clockStep != 0 {
+		row[count+3] = p.clockStep.String()
+	}
+	p.csvWriter.Write(row)
+	// Flush every row so the stream can be followed while polling
+	p.csvWriter.Flush()
+	if err := p.csvWriter.Error(); err != nil {
+		logErrorf("Error writing CSV output: %v", err)
+	}
+}
+
+// binlogFlags returns the binlog record flags of the result being printed
+func (p *resultPrinter) binlogFlags() byte {
+	var flags byte
+	if p.clockStep != 0 {
+		flags |= binlogFlagClockStep
+	}
+	if p.retried {
+		flags |= binlogFlagRetried
+	}
+	return flags
+}
+
+// snapshot reads the current values of a write target for the session report.
+// It returns nil when no report is being kept or the read fails.
+func (p *resultPrinter) snapshot(client modbus.Client, coils bool, count uint16) []uint16 {
+	if p.report == nil {
+		return nil
+	}
+	values, err := readBack(client, p.args, coils, count)
+	if err != nil {
+		logErrorf("Error reading write target for report: %v", err)
+		return nil
+	}
+	return values
+}
+
+// printBeforeAfter records the target values read around a successful write
+func (p *resultPrinter) printBeforeAfter(before, after []uint16) {
+	if p.report != nil {
+		p.report.addBeforeAfter(before, after)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// maxWriteCoils is the largest number of coils one FC15 request can carry
+const maxWriteCoils = 1968
+
+// patternSteps returns the number of steps in one cycle of pattern over count coils
+func patternSteps(pattern string, count int) int {
+	if pattern == "blink" {
+		return 2
+	}
+	return count
+}
+
+// coilPattern computes the coil states for one step of pattern. The step
+// wraps at the end of the cycle, so any step number is valid.
+//
+//	chase:        one coil on, moving along the block
+//	walking_zero: one coil off, moving along the block
+//	blink:        the whole block on, then off
+func coilPattern(pattern string, step, count int) []bool {
+	states := make([]bool, count)
+	step %= patternSteps(pattern, count)
+	for i := range states {
+		switch pattern {
+		case "chase":
+			states[i] = i == step
+		case "walking_zero":
+			states[i] = i != step
+		case "blink":
+			states[i] = step == 0
+		}
+	}
+	return states
+}
+
+// packCoils packs coil states into the FC15 wire format, eight coils per
+// byte with the first coil in the least significant bit
+func packCoils(states []bool) []byte {
+	data := make([]byte, (len(states)+7)/8)
+	for i, on := range states {
+		if on {
+			data[i/8] |= 1 << (i % 8)
+		}
+	}
+	return data
+}
+
+// unpackCoils expands a packed coil or discrete input response into count
+// states. Missing bytes in a short response read as off.
+func unpackCoils(data []byte, count uint16) []bool {
+	states := make([]bool, count)
+	for i := range states {
+		if i/8 < len(data) {
+			states[i] = data[i/8]&(1<<(i%8)) != 0
+		}
+	}
+	return states
+}
+
+// runCoilPattern writes a coil pattern across --count coils from --start,
+// one step per interval, for --cycles cycles (or until interrupted). Unless
+// --leave-as-is is given, the block is switched off afterwards.
+func runCoilPattern(ctx context.Context, s *session) error {
+	client, args, printer := s.client, s.args, s.printer
+	count := int(args.Count)
+	if count < 1 || count > maxWriteCoils {
+		return fmt.Errorf("Invalid count for coil_pattern: %d (must be 1 to %d)", count, maxWriteCoils)
+	}
+	steps := patternSteps(args.Pattern, count)
+	args.Repeat = args.Cycles * steps
+	args.RepeatSuccess = 0
+
+	step := 0
+	err := s.repeat(ctx, func() error {
+		states := coilPattern(args.Pattern, step, count)
+		step++
+		_, err := client.WriteMultipleCoils(args.Start, args.Count, packCoils(states))
+		if err != nil {
+			printer.printError("write", err)
+		} else {
+			printer.printWritten(fmt.Sprintf("%s step %d/%d: %v", args.Pattern, (step-1)%steps+1, steps, states), valueList(states))
+		}
+		return err
+	})
+
+	if !args.LeaveAsIs {
+		if _, offErr := client.WriteMultipleCoils(args.Start, args.Count, packCoils(make([]bool, count))); offErr != nil {
+			logErrorf("Error switching coils off: %v", offErr)
+		} else {
+			logInfof("Switched off coils %d to %d", args.Start, int(args.Start)+count-1)
+		}
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestPackCoils(t *testing.T) {
+	tests := []struct {
+		name   string
+		states []bool
+		want   []byte
+	}{
+		{"1 coil", []bool{true}, []byte{0x01}},
+		{"8 coils", []bool{true, false, false, false, false, false, false, true}, []byte{0x81}},
+		// The final byte is padded with zeros
+		{"9 coils", []bool{false, false, false, false, false, false, false, false, true}, []byte{0x00, 0x01}},
+		{"16 coils", []bool{true, true, false, false, false, false, false, false, false, false, false, false, false, false, true, true}, []byte{0x03, 0xC0}},
+	}
+	for _, test := range tests {
+		data := packCoils(test.states)
+		if !bytes.Equal(data, test.want) {
+			t.Errorf("%s: packCoils = % X, want % X", test.name, data, test.want)
+		}
+		if states := unpackCoils(data, uint16(len(test.states))); !reflect.DeepEqual(states, test.states) {
+			t.Errorf("%s: unpackCoils(packCoils) = %v, want %v", test.name, states, test.states)
+		}
+	}
+}
+
+func TestUnpackCoils(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		count uint16
+		want  []bool
+	}{
+		{"1 coil", []byte{0x01}, 1, []bool{true}},
+		{"1 coil off", []byte{0xFE}, 1, []bool{false}},
+		{"9 coils", []byte{0x81, 0x01}, 9, []bool{true, false, false, false, false, false, false, true, true}},
+		// Missing bytes of a short response read as off
+		{"short response", []byte{0xFF}, 9, []bool{true, true, true, true, true, true, true, true, false}},
+	}
+	for _, test := range tests {
+		if got := unpackCoils(test.data, test.count); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: unpackCoils(% X, %d) = %v, want %v", test.name, test.data, test.count, got, test.want)
+		}
+	}
+}
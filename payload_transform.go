@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/goburrow/modbus"
+)
+
+// payloadTransform scrambles the data field of request PDUs and unscrambles
+// the data field of responses, for devices that obfuscate their payloads
+type payloadTransform interface {
+	// Handshake establishes the session state the transform needs. handler
+	// sends requests without the transform applied.
+	Handshake(handler modbus.ClientHandler) error
+	// Encode returns the scrambled form of request data
+	Encode(data []byte) []byte
+	// Decode returns the clear form of response data
+	Decode(data []byte) []byte
+}
+
+// newPayloadTransform creates the transform selected with --payload-transform
+func newPayloadTransform(args *ModbusArgs) (payloadTransform, error) {
+	switch args.PayloadTransform {
+	case "xor":
+		return &xorTransform{KeyRegister: args.PayloadKeyRegister}, nil
+	}
+	return nil, fmt.Errorf("unknown payload transform %q", args.PayloadTransform)
+}
+
+// transformHandler applies a payloadTransform around another handler. The
+// handshake runs before the first request on each connection.
+type transformHandler struct {
+	clientHandler
+	transform payloadTransform
+	verbose   bool
+
+	established bool
+}
+
+// Encode runs the handshake if needed and scrambles the request data
+func (h *transformHandler) Encode(pdu *modbus.ProtocolDataUnit) ([]byte, error) {
+	if !h.established {
+		if err := h.transform.Handshake(h.clientHandler); err != nil {
+			return nil, fmt.Errorf("payload transform handshake failed: %w", err)
+		}
+		h.established = true
+	}
+	scrambled := h.transform.Encode(pdu.Data)
+	if h.verbose {
+		logDebugf("Request data: clear % X, scrambled % X", pdu.Data, scrambled)
+	}
+	return h.clientHandler.Encode(&modbus.ProtocolDataUnit{FunctionCode: pdu.FunctionCode, Data: scrambled})
+}
+
+// Decode unscrambles the response data. Exception responses are passed
+// through unchanged.
+func (h *transformHandler) Decode(adu []byte) (*modbus.ProtocolDataUnit, error) {
+	pdu, err := h.clientHandler.Decode(adu)
+	if err != nil || pdu.FunctionCode&0x80 != 0 {
+		return pdu, err
+	}
+	clear := h.transform.Decode(pdu.Data)
+	if h.verbose {
+		logDebugf("Response data: scrambled % X, clear % X", pdu.Data, clear)
+	}
+	return &modbus.ProtocolDataUnit{FunctionCode: pdu.FunctionCode, Data: clear}, nil
+}
+
+// Close closes the connection; the next connection repeats the handshake
+func (h *transformHandler) Close() error {
+	h.established = false
+	return h.clientHandler.Close()
+}
+
+// xorTransform XORs the data field with a session key read in clear from a
+// holding register during the handshake. The key bytes are applied in turn,
+// high byte first.
+type xorTransform struct {
+	KeyRegister uint16
+
+	key []byte
+}
+
+// Handshake reads the session key register
+func (t *xorTransform) Handshake(handler modbus.ClientHandler) error {
+	key, err := modbus.NewClient(handler).ReadHoldingRegisters(t.KeyRegister, 1)
+	if err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return errors.New("empty response reading the session key")
+	}
+	t.key = key
+	return nil
+}
+
+// Encode XORs data with the session key
+func (t *xorTransform) Encode(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ t.key[i%len(t.key)]
+	}
+	return out
+}
+
+// Decode XORs data with the session key, which undoes Encode
+func (t *xorTransform) Decode(data []byte) []byte {
+	return t.Encode(data)
+}
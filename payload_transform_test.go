@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/goburrow/modbus"
+)
+
+func TestXORTransformRoundTrip(t *testing.T) {
+	transform := &xorTransform{key: []byte{0xA5, 0x5A}}
+	for _, data := range [][]byte{
+		{},
+		{0x00},
+		{0x00, 0x0A, 0x00, 0x03},
+		{0x00, 0x10, 0x00, 0x02, 0x04, 0xFF, 0xFF, 0x80, 0x00},
+	} {
+		scrambled := transform.Encode(data)
+		if len(data) > 0 && bytes.Equal(scrambled, data) {
+			t.Errorf("Encode(% X) left the data in clear", data)
+		}
+		if clear := transform.Decode(scrambled); !bytes.Equal(clear, data) {
+			t.Errorf("Decode(Encode(% X)) = % X", data, clear)
+		}
+	}
+}
+
+func TestPayloadTransformAgainstServer(t *testing.T) {
+	server := newTestServer(t)
+	keyRegister := uint16(9)
+	server.holding[keyRegister] = 0xA55A
+	server.xorKeyRegister = &keyRegister
+	transform := []string{"--payload-transform", "xor", "--payload-key-register", "9"}
+
+	// The server unscrambles what it stores, so the registers hold the clear values
+	flags := append([]string{"-o", "write_multiple_registers", "--start", "20", "--values", "-32768,-1,0,32767"}, transform...)
+	s, _ := newTestSession(t, server, flags...)
+	if err := writeMultipleRegisters(context.Background(), s); err != nil {
+		t.Fatalf("writeMultipleRegisters: %v", err)
+	}
+	want := []uint16{0x8000, 0xFFFF, 0, 0x7FFF}
+	if got := server.holding[20:24]; !reflect.DeepEqual(got, want) {
+		t.Errorf("registers = %04X, want %04X", got, want)
+	}
+
+	// and reading them back through the transform returns the values written
+	flags = append([]string{"-o", "read_holding_registers", "--start", "20", "--count", "4"}, transform...)
+	s, out := newTestSession(t, server, flags...)
+	if err := performReadOperation(context.Background(), s, modbus.FuncCodeReadHoldingRegisters); err != nil {
+		t.Fatalf("performReadOperation: %v", err)
+	}
+	results := testResults(t, out)
+	if len(results) != 1 || !reflect.DeepEqual(resultValues(results[0]), []interface{}{-32768.0, -1.0, 0.0, 32767.0}) {
+		t.Errorf("results = %v, want the values written", results)
+	}
+}
+
+func TestPayloadTransformScrambles(t *testing.T) {
+	// Without the transform the server reads the request data as scrambled,
+	// so the read asks for other registers than it names
+	server := newTestServer(t)
+	keyRegister := uint16(9)
+	server.holding[keyRegister] = 0xA55A
+	server.xorKeyRegister = &keyRegister
+	s, _ := newTestSession(t, server, "-o", "read_holding_registers", "--start", "0", "--count", "1")
+	// The first request is taken as the handshake, in clear
+	if _, err := s.client.ReadHoldingRegisters(0, 1); err != nil {
+		t.Fatalf("handshake read: %v", err)
+	}
+	if _, err := s.client.ReadHoldingRegisters(0, 1); err == nil {
+		t.Errorf("unscrambled read succeeded, want it rejected")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+)
+
+// preflight checks that the device accepts writes before a write operation
+// starts. It reads the probe coil or holding register and writes the same
+// value back, which leaves the device unchanged, so a device that rejects
+// writes (e.g. switched to local control) stops the run before its first
+// real write.
+func preflight(s *session) error {
+	args := s.args
+	address := args.PreflightAddress
+	var kind string
+	var err error
+	switch args.Operation {
+	case "write_single_coil", "write_multiple_coils", "coil_pattern":
+		kind = "coil"
+		var response []byte
+		if response, err = s.client.ReadCoils(address, 1); err == nil {
+			if len(response) == 0 {
+				err = fmt.Errorf("empty coil response")
+			} else {
+				state := uint16(0)
+				if response[0]&1 != 0 {
+					state = 0xFF00
+				}
+				_, err = s.client.WriteSingleCoil(address, state)
+			}
+		}
+	default:
+		kind = "holding register"
+		var response []byte
+		if response, err = s.client.ReadHoldingRegisters(address, 1); err == nil {
+			if len(response) < registerSize {
+				err = fmt.Errorf("short register response: %d bytes", len(response))
+			} else {
+				err = s.writeRegisters(address, response[:registerSize], writeSingle)
+			}
+		}
+	}
+
+	if err != nil {
+		err = describeException(err)
+		if s.printer.report != nil {
+			s.printer.report.write("- Preflight write-back of %s %d: FAILED: %v\n", kind, address, err)
+		}
+		return fmt.Errorf("Preflight write-back of %s %d failed, not running %s: %v", kind, address, args.Operation, err)
+	}
+	logInfof("Preflight: device accepted a write-back of %s %d", kind, address)
+	if s.printer.report != nil {
+		s.printer.report.write("- Preflight write-back of %s %d: accepted\n", kind, address)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/goburrow/modbus"
+)
+
+// sendRaw sends --pdu as it is and prints the response PDU in hex. Any
+// function code can be sent this way, including vendor-specific ones no
+// client library wraps.
+func sendRaw(ctx context.Context, s *session) error {
+	args, printer := s.args, s.printer
+	request := &modbus.ProtocolDataUnit{FunctionCode: args.PDU[0], Data: args.PDU[1:]}
+	if args.DryRun {
+		// The function code may be anything, so the request may write
+		logWarnf("Dry run, not sent: function code 0x%02X, data % X", request.FunctionCode, request.Data)
+		return nil
+	}
+
+	return s.repeat(ctx, func() error {
+		response, err := sendPDU(s.handler, request)
+		if err != nil {
+			printer.printError("read", err)
+			return err
+		}
+		pdu := fmt.Sprintf("% X", append([]byte{response.FunctionCode}, response.Data...))
+		printer.printValues("Response PDU: "+pdu, valueList([]string{pdu}))
+		return nil
+	})
+}
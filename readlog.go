@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// addressStats accumulates the numeric values read from one address
+type addressStats struct {
+	count         int
+	min, max, sum float64
+}
+
+// runReadLog implements the readlog subcommand. It converts a binary log
+// written with --format binlog to text, json or csv on stdout and prints
+// summary statistics on stderr. Blocks failing their CRC check are skipped.
+func runReadLog(argv []string) error {
+	flags := pflag.NewFlagSet("readlog", pflag.ContinueOnError)
+	format := flags.String("format", "text", "The output format. \ntext (one line per result)/json (one JSON object per line)/csv (header row, then one row per result)")
+	fromText := flags.String("from", "", "Only print results at or after this time (RFC3339).")
+	toText := flags.String("to", "", "Only print results before this time (RFC3339).")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: modbus-client readlog [flags] FILE")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(argv); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("readlog needs exactly one binlog file")
+	}
+	switch *format {
+	case "text", "json", "csv":
+	default:
+		return fmt.Errorf("Invalid output format: %s", *format)
+	}
+	var from, to time.Time
+	var err error
+	if *fromText != "" {
+		if from, err = time.Parse(time.RFC3339, *fromText); err != nil {
+			return fmt.Errorf("Invalid --from time: %v", err)
+		}
+	}
+	if *toText != "" {
+		if to, err = time.Parse(time.RFC3339, *toText); err != nil {
+			return fmt.Errorf("Invalid --to time: %v", err)
+		}
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := newBinlogReader(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", flags.Arg(0), err)
+	}
+
+	csvWriter := csv.NewWriter(os.Stdout)
+	defer csvWriter.Flush()
+	headerWritten := false
+	columns := 0
+	var pending [][]string
+	results, failed, corrupt := 0, 0, 0
+	var first, last time.Time
+	stats := make(map[uint16]*addressStats)
+	for {
+		records, err := reader.readBlock()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, errBinlogCRC) {
+			log.Printf("Skipping %v", err)
+			corrupt++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", flags.Arg(0), err)
+		}
+		if len(records) == 0 {
+			continue
+		}
+		timestamp := records[0].Time
+		if (!from.IsZero() && timestamp.Before(from)) || (!to.IsZero() && !timestamp.Before(to)) {
+			continue
+		}
+
+		results++
+		if first.IsZero() {
+			first = timestamp
+		}
+		last = timestamp
+		// The records of a result share its flags
+		flags := records[0].Flags
+		result := jsonResult{
+			Timestamp: timestamp.Format(time.RFC3339Nano),
+			Operation: reader.Operation,
+			UnitID:    reader.UnitID,
+			Start:     records[0].Address,
+			Quality:   resultQuality(nil, flags&binlogFlagClockStep != 0),
+			Retried:   flags&binlogFlagRetried != 0,
+		}
+		for _, record := range records {
+			if record.Flags&binlogFlagClockStep != 0 {
+				// The log keeps only that the clock stepped, not by how much
+				result.ClockStep = "yes"
+			}
+			if record.Flags&binlogFlagBad != 0 {
+				result.Quality = qualityBad
+				result.Error = fmt.Sprint(record.Value)
+				continue
+			}
+			result.Values = append(result.Values, jsonValue{Address: int(record.Address), Value: record.Value})
+			if value, ok := numeric(record.Value); ok {
+				s := stats[record.Address]
+				if s == nil {
+					s = &addressStats{min: value, max: value}
+					stats[record.Address] = s
+				}
+				s.count++
+				s.sum += value
+				if value < s.min {
+					s.min = value
+				}
+				if value > s.max {
+					s.max = value
+				}
+			}
+		}
+		if result.Error != "" {
+			failed++
+		}
+
+		switch *format {
+		case "json":
+			line, err := json.Marshal(result)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(line))
+		case "csv":
+			row := []string{timestamp.Format(csvTimestampFormat)}
+			for _, value := range result.Values {
+				row = append(row, fmt.Sprint(value.Value))
+			}
+			row = append(row, result.Quality, result.Error, result.ClockStep)
+			if result.Error != "" {
+				// Failed results carry no values to take the columns from, so
+				// hold them back until a successful one has set the header
+				pending = append(pending, row)
+				if headerWritten {
+					writeCSVRows(csvWriter, pending, columns)
+					pending = nil
+				}
+				continue
+			}
+			if !headerWritten {
+				header := []string{"timestamp"}
+				for _, value := range result.Values {
+					header = append(header, "addr_"+strconv.Itoa(value.Address))
+				}
+				csvWriter.Write(append(header, "quality", "error", "clock_step"))
+				headerWritten = true
+				columns = len(result.Values)
+			}
+			writeCSVRows(csvWriter, append(pending, row), columns)
+			pending = nil
+		default:
+			if result.Error != "" {
+				fmt.Printf("%s %s @ %d: FAILED: %s\n", result.Timestamp, result.Operation, result.Start, result.Error)
+				continue
+			}
+			values := make([]interface{}, len(result.Values))
+			for i, value := range result.Values {
+				values[i] = value.Value
+			}
+			fmt.Printf("%s %s @ %d: %v\n", result.Timestamp, result.Operation, result.Start, values)
+		}
+	}
+
+	if len(pending) > 0 {
+		if !headerWritten {
+			csvWriter.Write([]string{"timestamp", "quality", "error", "clock_step"})
+		}
+		writeCSVRows(csvWriter, pending, columns)
+	}
+
+	// Summary statistics
+	fmt.Fprintf(os.Stderr, "%d results, %d failed, %d corrupt blocks skipped", results, failed, corrupt)
+	if results > 0 {
+		fmt.Fprintf(os.Stderr, ", from %s to %s (%v)", first.Format(time.RFC3339Nano), last.Format(time.RFC3339Nano), last.Sub(first))
+	}
+	fmt.Fprintln(os.Stderr)
+	addresses := make([]int, 0, len(stats))
+	for address := range stats {
+		addresses = append(addresses, int(address))
+	}
+	sort.Ints(addresses)
+	for _, address := range addresses {
+		s := stats[uint16(address)]
+		fmt.Fprintf(os.Stderr, "  address %d: %d values, min %v, max %v, mean %v\n",
+			address, s.count, s.min, s.max, s.sum/float64(s.count))
+	}
+	return nil
+}
+
+// numeric returns value as a float64 if it is a number. Coil and input
+// states count as 0 or 1.
+func numeric(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case uint8:
+		return float64(v), true
+	case int16, uint16, int32, uint32, int64, uint64, float32, float64:
+		return toFloat64(v), true
+	}
+	return 0, false
+}
+
+// writeCSVRows writes rows of a timestamp, values and three trailing cells,
+// padding the value cells of failed results to columns
+func writeCSVRows(writer *csv.Writer, rows [][]string, columns int) {
+	for _, row := range rows {
+		if values := len(row) - 4; values < columns {
+			padded := append([]string{row[0]}, make([]string, columns)...)
+			row = append(padded, row[len(row)-3:]...)
+		}
+		writer.Write(row)
+	}
+}
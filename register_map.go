@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/goburrow/modbus"
+)
+
+// maxReadBits is the largest number of coils or discrete inputs one FC01/FC02
+// read can carry
+const maxReadBits = 2000
+
+// RegisterPoint is one named coil, discrete input or register (or group of
+// registers) in a register map
+type RegisterPoint struct {
+	Name     string  `json:"name"`
+	Table    string  `json:"table"`
+	Address  int     `json:"address"`
+	Datatype string  `json:"datatype"`
+	Scale    float64 `json:"scale"`
+	Unit     string  `json:"unit"`
+}
+
+// RegisterMap is a set of named points loaded with --map
+type RegisterMap struct {
+	Points []RegisterPoint
+
+	byName map[string]*RegisterPoint
+}
+
+// loadRegisterMap reads a register map from a JSON file of the form
+//
+//	{"points": [{"name": "Voltage_L1", "table": "input", "address": 0, "datatype": "uint16", "scale": 0.1, "unit": "V"}]}
+//
+// The table is coil, discrete, holding or input and defaults to holding. The
+// datatype of register points defaults to int16 and the scale to 1; coil and
+// discrete points take no datatype. Names must be unique and every point must
+// fit in the 16-bit address space. Errors carry the line of the offending
+// point.
+func loadRegisterMap(path string) (*RegisterMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	registerMap := &RegisterMap{byName: make(map[string]*RegisterPoint)}
+	err = decodeJSONList(path, data, "points", func(decode func(interface{}) error) error {
+		var point RegisterPoint
+		if err := decode(&point); err != nil {
+			return fmt.Errorf("point %d: %w", len(registerMap.Points)+1, err)
+		}
+		if err := checkPoint(&point, registerMap); err != nil {
+			return err
+		}
+		registerMap.Points = append(registerMap.Points, point)
+		registerMap.byName[point.Name] = nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Index the points once appending can no longer move them
+	for i := range registerMap.Points {
+		registerMap.byName[registerMap.Points[i].Name] = &registerMap.Points[i]
+	}
+	return registerMap, nil
+}
+
+// checkPoint validates a point read from a register map and fills in its defaults
+func checkPoint(point *RegisterPoint, registerMap *RegisterMap) error {
+	if point.Name == "" {
+		return fmt.Errorf("point %d has no name", len(registerMap.Points)+1)
+	}
+	if _, ok := registerMap.byName[point.Name]; ok {
+		return fmt.Errorf("duplicate point name %q", point.Name)
+	}
+	switch point.Table {
+	case "":
+		point.Table = "holding"
+	case "holding", "input":
+	case "coil", "discrete":
+		if point.Datatype != "" {
+			return fmt.Errorf("point %q is a %s and takes no datatype", point.Name, point.Table)
+		}
+	default:
+		return fmt.Errorf("point %q has unknown table %q (coil, discrete, holding or input)", point.Name, point.Table)
+	}
+	if point.Datatype == "" && !point.isBit() {
+		point.Datatype = "int16"
+	}
+	if !point.isBit() && (datatypeRegisters(point.Datatype) == 0 || point.Datatype == "string") {
+		return fmt.Errorf("point %q has unsupported datatype %q", point.Name, point.Datatype)
+	}
+	if point.Address < 0 || point.Address+point.size()-1 > 0xFFFF {
+		return fmt.Errorf("point %q address %d is out of range", point.Name, point.Address)
+	}
+	if point.Scale == 0 {
+		point.Scale = 1
+	}
+	return nil
+}
+
+// lookup returns the point with the given name
+func (m *RegisterMap) lookup(name string) (*RegisterPoint, bool) {
+	point, ok := m.byName[name]
+	return point, ok
+}
+
+// isBit reports whether the point is a coil or discrete input
+func (p *RegisterPoint) isBit() bool {
+	return p.Table == "coil" || p.Table == "discrete"
+}
+
+// size returns the number of coils, discrete inputs or registers the point takes
+func (p *RegisterPoint) size() int {
+	if p.isBit() {
+		return 1
+	}
+	return datatypeRegisters(p.Datatype)
+}
+
+// decode converts the registers of the point, in big-endian order, into its
+// scaled value. A bcd point holding a nibble above 9 has no value.
+func (p *RegisterPoint) decode(word []byte) (float64, error) {
+	value, err := decodeValue(word, p.Datatype)
+	if err != nil {
+		return 0, fmt.Errorf("point %s: %v", p.Name, err)
+	}
+	return applyScale(toFloat64(value), p.Scale), nil
+}
+
+// applyScale multiplies raw by scale. Fractional scales such as 0.1 are
+// applied by dividing by their inverse, which avoids results like
+// 230.10000000000002.
+func applyScale(raw, scale float64) float64 {
+	if inverse := 1 / scale; scale < 1 && inverse == math.Round(inverse) {
+		return raw / inverse
+	}
+	return raw * scale
+}
+
+// removeScale is the inverse of applyScale: it converts a scaled value back
+// to the raw value
+func removeScale(value, scale float64) float64 {
+	if inverse := 1 / scale; scale < 1 && inverse == math.Round(inverse) {
+		return value * inverse
+	}
+	return value / scale
+}
+
+// trimNoise rounds v to 12 significant digits, dropping the binary rounding
+// noise that adding a decimal offset can leave (-43.04999999999998)
+func trimNoise(v float64) float64 {
+	trimmed, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'g', 12, 64), 64)
+	return trimmed
+}
+
+// format formats a decoded value with the point's unit
+func (p *RegisterPoint) format(value float64) string {
+	text := strconv.FormatFloat(value, 'f', -1, 64)
+	if p.Unit != "" {
+		text += " " + p.Unit
+	}
+	return text
+}
+
+// pointRead is one read request covering one or more points of the same table
+type pointRead struct {
+	table  string
+	start  int
+	size   int
+	points []*RegisterPoint
+}
+
+// planPointReads groups points into read requests. Points of the same table
+// whose addresses touch or overlap share a request, up to the most a single
+// read can carry.
+func planPointReads(points []*RegisterPoint) []*pointRead {
+	sorted := append([]*RegisterPoint(nil), points...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Table != sorted[j].Table {
+			return sorted[i].Table < sorted[j].Table
+		}
+		return sorted[i].Address < sorted[j].Address
+	})
+
+	var reads []*pointRead
+	for _, point := range sorted {
+		limit := maxReadRegisters
+		if point.isBit() {
+			limit = maxReadBits
+		}
+		end := point.Address + point.size()
+		if n := len(reads); n > 0 {
+			last := reads[n-1]
+			if last.table == point.Table && point.Address <= last.start+last.size && end-last.start <= limit {
+				if end > last.start+last.size {
+					last.size = end - last.start
+				}
+				last.points = append(last.points, point)
+				continue
+			}
+		}
+		reads = append(reads, &pointRead{table: point.Table, start: point.Address, size: point.size(), points: []*RegisterPoint{point}})
+	}
+	return reads
+}
+
+// perform issues the read and returns the scaled value of each of its points
+func (r *pointRead) perform(client modbus.Client, byteOrder string) (map[*RegisterPoint]float64, error) {
+	var response []byte
+	var err error
+	switch r.table {
+	case "coil":
+		response, err = client.ReadCoils(uint16(r.start), uint16(r.size))
+	case "discrete":
+		response, err = client.ReadDiscreteInputs(uint16(r.start), uint16(r.size))
+	case "holding":
+		response, err = client.ReadHoldingRegisters(uint16(r.start), uint16(r.size))
+	case "input":
+		response, err = client.ReadInputRegisters(uint16(r.start), uint16(r.size))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[*RegisterPoint]float64, len(r.points))
+	for _, point := range r.points {
+		offset := point.Address - r.start
+		if point.isBit() {
+			if offset/8 >= len(response) {
+				return nil, fmt.Errorf("short %s response: %d bytes for %d bits", r.table, len(response), r.size)
+			}
+			values[point] = float64(response[offset/8] >> (offset % 8) & 1)
+			continue
+		}
+		from, to := offset*registerSize, (offset+point.size())*registerSize
+		if to > len(response) {
+			return nil, fmt.Errorf("short register response: %d bytes for %d registers", len(response), r.size)
+		}
+		if values[point], err = point.decode(orderBytes(response[from:to], byteOrder)); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// resolvePoints loads the register map and looks up the points named by --point
+func resolvePoints(args *ModbusArgs) ([]*RegisterPoint, error) {
+	if args.Map == "" || len(args.Points) == 0 {
+		return nil, fmt.Errorf("The read operation needs --map and --point")
+	}
+	registerMap, err := loadRegisterMap(args.Map)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading register map: %v", err)
+	}
+	points := make([]*RegisterPoint, len(args.Points))
+	for i, name := range args.Points {
+		point, ok := registerMap.lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("No point named %q in %s", name, args.Map)
+		}
+		points[i] = point
+	}
+	return points, nil
+}
+
+// readPoints reads the points named by --point from the register map. Each
+// cycle reads all of them, in as few requests as possible, and prints their
+// values with their names and units as one result.
+func readPoints(ctx context.Context, s *session) error {
+	client, args, printer := s.client, s.args, s.printer
+	points, err := resolvePoints(args)
+	if err != nil {
+		return err
+	}
+	reads := planPointReads(points)
+	for _, read := range reads {
+		logDebugf("Point read: %d %s value(s) from %d for %d point(s)", read.size, read.table, read.start, len(read.points))
+	}
+
+	// Results list the points in the order they were given
+	args.Start, args.Count = uint16(points[0].Address), uint16(len(points))
+	printer.addresses = make([]int, len(points))
+	printer.names = make([]string, len(points))
+	printer.tables = make([]string, len(points))
+	for i, point := range points {
+		printer.addresses[i] = point.Address
+		printer.names[i], printer.tables[i] = point.Name, point.Table
+	}
+
+	return s.repeat(ctx, func() error {
+		values := make(map[*RegisterPoint]float64, len(points))
+		for _, read := range reads {
+			readValues, err := read.perform(client, args.ByteOrder)
+			if err != nil {
+				printer.printError("read", err)
+				return err
+			}
+			for point, value := range readValues {
+				values[point] = value
+			}
+		}
+		texts := make([]string, len(points))
+		results := make([]float64, len(points))
+		for i, point := range points {
+			results[i] = values[point]
+			texts[i] = fmt.Sprintf("%s: %s", point.Name, point.format(values[point]))
+		}
+		printer.printValues(strings.Join(texts, ", "), valueList(results))
+		return nil
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// replCommand is one operation command of --interactive mode
+type replCommand struct {
+	operation string
+	usage     string
+}
+
+// replCommands maps the short commands of --interactive mode to operations.
+// The operation names themselves are accepted too.
+var replCommands = map[string]replCommand{
+	"rc":    {"read_coils", "rc ADDRESS [COUNT]"},
+	"rd":    {"read_discrete_inputs", "rd ADDRESS [COUNT]"},
+	"rh":    {"read_holding_registers", "rh ADDRESS [COUNT]"},
+	"ri":    {"read_input_registers", "ri ADDRESS [COUNT]"},
+	"wc":    {"write_single_coil", "wc ADDRESS on|off"},
+	"wr":    {"write_single_register", "wr ADDRESS VALUE"},
+	"wmc":   {"write_multiple_coils", "wmc ADDRESS VALUE,VALUE,..."},
+	"wmr":   {"write_multiple_registers", "wmr ADDRESS VALUE,VALUE,..."},
+	"rw":    {"read_write_multiple_registers", "rw ADDRESS COUNT WRITE_ADDRESS VALUE,VALUE,..."},
+	"mask":  {"mask_write_register", "mask ADDRESS AND_MASK OR_MASK"},
+	"id":    {"read_device_id", "id"},
+	"point": {"read", "point NAME [NAME...]"},
+}
+
+// replTables maps the table names of the read and write commands, as in
+// "read hr 100 4" or "write reg 100 55", to the short read and write commands
+var replTables = map[string][2]string{
+	"coil": {"rc", "wc"},
+	"co":   {"rc", "wc"},
+	"di":   {"rd", ""},
+	"hr":   {"rh", "wr"},
+	"reg":  {"rh", "wr"},
+	"ir":   {"ri", ""},
+}
+
+// replHelp is printed by the help command
+const replHelp = `Commands (addresses and values in decimal, 0x hex or 0b binary):
+  rc ADDRESS [COUNT]            read coils
+  rd ADDRESS [COUNT]            read discrete inputs
+  rh ADDRESS [COUNT]            read holding registers
+  ri ADDRESS [COUNT]            read input registers
+  wc ADDRESS on|off             write single coil
+  wr ADDRESS VALUE              write single register
+  wmc ADDRESS VALUE,VALUE,...   write multiple coils
+  wmr ADDRESS VALUE,VALUE,...   write multiple registers
+  rw ADDRESS COUNT WRITE_ADDRESS VALUE,VALUE,...
+                                read/write multiple registers
+  mask ADDRESS AND_MASK OR_MASK mask write register
+  id                            read device identification
+  point NAME [NAME...]          read register map points (needs --map)
+  read co|di|hr|ir ADDRESS [COUNT]
+                                read coils, inputs or registers
+  write co|reg ADDRESS VALUE    write a single coil or register
+  unit ID                       address another unit id
+  type [DATATYPE]               show or set the datatype (none for 16-bit integers)
+  history                       list the commands entered so far
+  !N, !!                        run command N of the history, or the last one
+  help                          show this help
+  quit, exit                    end the session
+Operation names such as read_holding_registers work as commands too.`
+
+// runInteractive reads commands from stdin and runs them over the session's
+// connection until quit, end of input or Ctrl-C. A failed or mistyped
+// command is reported and the session carries on.
+func runInteractive(ctx context.Context, s *session) error {
+	args := s.args
+	address := net.JoinHostPort(args.Server, strconv.FormatUint(uint64(args.Port), 10))
+
+	// Read stdin in the background so Ctrl-C ends the session while waiting
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	var history []string
+	for {
+		fmt.Fprintf(os.Stderr, "%s unit %d> ", address, args.UnitID)
+		var line string
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(os.Stderr)
+			return nil
+		case text, ok := <-lines:
+			if !ok {
+				fmt.Fprintln(os.Stderr)
+				return nil
+			}
+			line = strings.TrimSpace(text)
+		}
+		if line == "" {
+			continue
+		}
+
+		// History expansion
+		if strings.HasPrefix(line, "!") {
+			n := len(history)
+			if line != "!!" {
+				var err error
+				if n, err = strconv.Atoi(line[1:]); err != nil {
+					logErrorf("Invalid history reference: %s", line)
+					continue
+				}
+			}
+			if n < 1 || n > len(history) {
+				logErrorf("No command %s in the history", line)
+				continue
+			}
+			line = history[n-1]
+			fmt.Fprintln(os.Stderr, line)
+		}
+		history = append(history, line)
+
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "quit", "exit":
+			return nil
+		case "help":
+			fmt.Fprintln(os.Stderr, replHelp)
+		case "history":
+			for i, command := range history {
+				fmt.Fprintf(os.Stderr, "%4d  %s\n", i+1, command)
+			}
+		case "unit":
+			if len(fields) != 2 {
+				logErrorf("Usage: unit ID")
+				continue
+			}
+			unitID, err := strconv.ParseUint(fields[1], 0, 8)
+			if err != nil {
+				logErrorf("Invalid unit id: %s", fields[1])
+				continue
+			}
+			args.UnitID = byte(unitID)
+			setHandlerUnit(s.handler, args.UnitID)
+		case "type":
+			switch {
+			case len(fields) == 1 && args.Type == "":
+				fmt.Fprintln(os.Stderr, "none (16-bit integers)")
+			case len(fields) == 1:
+				fmt.Fprintln(os.Stderr, args.Type)
+			case fields[1] == "none":
+				args.Type = ""
+			case datatypeRegisters(fields[1]) == 0:
+				logErrorf("Invalid type: %s", fields[1])
+			default:
+				args.Type = fields[1]
+			}
+		default:
+			step, err := parseReplCommand(fields)
+			if err == nil {
+				err = step.prepare(args)
+			}
+			if err != nil {
+				logErrorf("%v", err)
+				continue
+			}
+			// Failed requests have been reported already, other errors not
+			if err := s.runStep(ctx, step); err != nil && err != s.lastErr {
+				logErrorf("%s failed: %v", step.Operation, err)
+			}
+		}
+	}
+}
+
+// parseReplCommand turns the fields of an operation command into a step
+func parseReplCommand(fields []string) (*scriptStep, error) {
+	// read and write followed by a table name stand for a short command
+	if len(fields) > 1 && (fields[0] == "read" || fields[0] == "write") {
+		if commands, ok := replTables[fields[1]]; ok {
+			short := commands[0]
+			if fields[0] == "write" {
+				short = commands[1]
+			}
+			if short == "" {
+				return nil, errors.New("Discrete inputs and input registers are read-only")
+			}
+			fields = append([]string{short}, fields[2:]...)
+		} else if fields[0] == "write" {
+			return nil, errors.New("Usage: write co|reg ADDRESS VALUE")
+		}
+	}
+	command, ok := replCommands[fields[0]]
+	if !ok {
+		for _, c := range replCommands {
+			if c.operation == fields[0] {
+				command, ok = c, true
+			}
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("Unknown command %q, type help for a list", fields[0])
+	}
+	usage := fmt.Errorf("Usage: %s", command.usage)
+	step := &scriptStep{Operation: command.operation}
+	operands := fields[1:]
+
+	// number parses operand i as a 16-bit address, count or mask
+	number := func(i int) (uint16, error) {
+		value, err := strconv.ParseUint(operands[i], 0, 16)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid number %q: %s", operands[i], command.usage)
+		}
+		return uint16(value), nil
+	}
+	values := func(text string) []interface{} {
+		var list []interface{}
+		for _, value := range strings.Split(text, ",") {
+			list = append(list, value)
+		}
+		return list
+	}
+
+	var err error
+	switch command.operation {
+	case "read_device_id":
+		if len(operands) != 0 {
+			return nil, usage
+		}
+	case "read":
+		if len(operands) == 0 {
+			return nil, usage
+		}
+		step.Points = operands
+	case "read_coils", "read_discrete_inputs", "read_holding_registers", "read_input_registers":
+		if len(operands) < 1 || len(operands) > 2 {
+			return nil, usage
+		}
+		if step.Start, err = number(0); err != nil {
+			return nil, err
+		}
+		if len(operands) == 2 {
+			if step.Count, err = number(1); err != nil {
+				return nil, err
+			}
+		}
+	case "write_single_coil", "write_single_register", "write_multiple_coils", "write_multiple_registers":
+		if len(operands) != 2 {
+			return nil, usage
+		}
+		if step.Start, err = number(0); err != nil {
+			return nil, err
+		}
+		switch command.operation {
+		case "write_single_coil", "write_single_register":
+			step.Value = operands[1]
+		default:
+			step.Values = values(operands[1])
+		}
+	case "read_write_multiple_registers":
+		if len(operands) != 4 {
+			return nil, usage
+		}
+		if step.Start, err = number(0); err != nil {
+			return nil, err
+		}
+		if step.Count, err = number(1); err != nil {
+			return nil, err
+		}
+		if step.WriteStart, err = number(2); err != nil {
+			return nil, err
+		}
+		step.Values = values(operands[3])
+	case "mask_write_register":
+		if len(operands) != 3 {
+			return nil, usage
+		}
+		if step.Start, err = number(0); err != nil {
+			return nil, err
+		}
+		andMask, err := number(1)
+		if err != nil {
+			return nil, err
+		}
+		step.AndMask = &andMask
+		if step.OrMask, err = number(2); err != nil {
+			return nil, err
+		}
+	}
+	return step, nil
+}
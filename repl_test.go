@@ -0,0 +1,16 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReplHelpMatchesUsage(t *testing.T) {
+	// Each command is documented in the help as its usage error spells it
+	for name, command := range replCommands {
+		line := "\n  " + command.usage
+		if !strings.Contains(replHelp, line+" ") && !strings.Contains(replHelp, line+"\n") {
+			t.Errorf("help does not document %s as %q", name, command.usage)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// sessionReport appends a Markdown record of every operation to a file. Each
+// entry is synced to disk as it is written so an interrupted run keeps
+// everything recorded up to that point.
+type sessionReport struct {
+	file      *os.File
+	clock     clock
+	started   time.Time
+	succeeded int
+	failed    int
+}
+
+// openSessionReport opens (or creates) the report file and starts a new
+// session section, timestamped with clock
+func openSessionReport(path string, args *ModbusArgs, clock clock) (*sessionReport, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	report := &sessionReport{file: file, clock: clock, started: clock.Now()}
+	report.write("\n# Modbus session %s\n\n- Server: %s port %d, unit id %d\n- Operation: %s\n\n",
+		report.started.Format(time.RFC3339), args.Server, args.Port, args.UnitID, args.Operation)
+	return report, nil
+}
+
+// write appends text to the report and syncs it to disk
+func (r *sessionReport) write(format string, v ...interface{}) {
+	if _, err := fmt.Fprintf(r.file, format, v...); err != nil {
+		logErrorf("Error writing report: %v", err)
+		return
+	}
+	if err := r.file.Sync(); err != nil {
+		logErrorf("Error syncing report: %v", err)
+	}
+}
+
+// addEntry records the outcome of one operation
+func (r *sessionReport) addEntry(operation string, start uint16, text string, err error) {
+	timestamp := r.clock.Now().Format(csvTimestampFormat)
+	if err != nil {
+		r.failed++
+		r.write("- `%s` **%s** @ %d: FAILED: %v\n", timestamp, operation, start, err)
+		return
+	}
+	r.succeeded++
+	r.write("- `%s` **%s** @ %d: %s\n", timestamp, operation, start, text)
+}
+
+// addBeforeAfter records the target values read around a write
+func (r *sessionReport) addBeforeAfter(before, after []uint16) {
+	r.write("  - before: %v, after: %v\n", before, after)
+}
+
+// close writes the summary statistics and closes the file
+func (r *sessionReport) close() {
+	r.write("\n## Summary\n\n- Operations: %d\n- Succeeded: %d\n- Failed: %d\n- Duration: %v\n",
+		r.succeeded+r.failed, r.succeeded, r.failed, r.clock.Now().Sub(r.started).Round(time.Millisecond))
+	if err := r.file.Close(); err != nil {
+		logErrorf("Error closing report: %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+const (
+	rtuMinSize = 4
+	rtuMaxSize = 256
+
+	// rtuFrameGap is the silence that ends a response whose length cannot be
+	// derived from its function code
+	rtuFrameGap = 100 * time.Millisecond
+)
+
+// crcError is returned when the CRC of an RTU response does not match its contents
+type crcError struct {
+	Received   uint16
+	Calculated uint16
+	Frame      []byte
+}
+
+func (e *crcError) Error() string {
+	return fmt.Sprintf("CRC mismatch in response: received 0x%04X, calculated 0x%04X (frame % x)", e.Received, e.Calculated, e.Frame)
+}
+
+// rtuOverTCPHandler implements the modbus Packager and Transporter interfaces
+// for gateways that pass raw RTU frames (unit id, PDU, CRC) over a TCP socket
+// instead of using the MBAP header
+type rtuOverTCPHandler struct {
+	Address string
+	SlaveId byte
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// crc16 computes the Modbus RTU CRC of data
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Encode builds an RTU frame: unit id, function code, data and CRC (low byte first)
+func (mb *rtuOverTCPHandler) Encode(pdu *modbus.ProtocolDataUnit) ([]byte, error) {
+	length := len(pdu.Data) + 4
+	if length > rtuMaxSize {
+		return nil, fmt.Errorf("modbus: length of data '%v' must not be bigger than '%v'", length, rtuMaxSize)
+	}
+	adu := make([]byte, length)
+	adu[0] = mb.SlaveId
+	adu[1] = pdu.FunctionCode
+	copy(adu[2:], pdu.Data)
+
+	crc := crc16(adu[:length-2])
+	adu[length-2] = byte(crc)
+	adu[length-1] = byte(crc >> 8)
+	return adu, nil
+}
+
+// Verify checks the response length and unit id
+func (mb *rtuOverTCPHandler) Verify(aduRequest []byte, aduResponse []byte) error {
+	if len(aduResponse) < rtuMinSize {
+		return fmt.Errorf("modbus: response length '%v' does not meet minimum '%v'", len(aduResponse), rtuMinSize)
+	}
+	if aduResponse[0] != aduRequest[0] {
+		return fmt.Errorf("modbus: response slave id '%v' does not match request '%v'", aduResponse[0], aduRequest[0])
+	}
+	return nil
+}
+
+// Decode checks the CRC and extracts the PDU from an RTU frame
+func (mb *rtuOverTCPHandler) Decode(adu []byte) (*modbus.ProtocolDataUnit, error) {
+	length := len(adu)
+	received := uint16(adu[length-1])<<8 | uint16(adu[length-2])
+	if calculated := crc16(adu[:length-2]); received != calculated {
+		return nil, &crcError{Received: received, Calculated: calculated, Frame: adu}
+	}
+	return &modbus.ProtocolDataUnit{FunctionCode: adu[1], Data: adu[2 : length-2]}, nil
+}
+
+// Send writes the request frame and reads one response frame
+func (mb *rtuOverTCPHandler) Send(aduRequest []byte) ([]byte, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if err := mb.connect(); err != nil {
+		return nil, err
+	}
+	var deadline time.Time
+	if mb.Timeout > 0 {
+		deadline = time.Now().Add(mb.Timeout)
+	}
+	if err := mb.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err := mb.conn.Write(aduRequest); err != nil {
+		return nil, err
+	}
+	return mb.readFrame()
+}
+
+// readFrame reads one RTU response. The frame length is derived from the
+// function code where the protocol defines it; anything else is read until
+// the line goes quiet for rtuFrameGap.
+func (mb *rtuOverTCPHandler) readFrame() ([]byte, error) {
+	var data [rtuMaxSize]byte
+	if _, err := io.ReadFull(mb.conn, data[:2]); err != nil {
+		return nil, err
+	}
+	n := 2
+	readMore := func(count int) error {
+		if n+count > rtuMaxSize {
+			return fmt.Errorf("modbus: response length '%v' exceeds maximum '%v'", n+count, rtuMaxSize)
+		}
+		_, err := io.ReadFull(mb.conn, data[n:n+count])
+		n += count
+		return err
+	}
+
+	var err error
+	switch function := data[1]; {
+	case function&0x80 != 0:
+		// Exception code and CRC
+		err = readMore(3)
+	case function == modbus.FuncCodeReadCoils, function == modbus.FuncCodeReadDiscreteInputs,
+		function == modbus.FuncCodeReadHoldingRegisters, function == modbus.FuncCodeReadInputRegisters,
+		function == modbus.FuncCodeReadWriteMultipleRegisters:
+		if err = readMore(1); err == nil {
+			err = readMore(int(data[2]) + 2)
+		}
+	case function == modbus.FuncCodeWriteSingleCoil, function == modbus.FuncCodeWriteSingleRegister,
+		function == modbus.FuncCodeWriteMultipleCoils, function == modbus.FuncCodeWriteMultipleRegisters:
+		err = readMore(6)
+	case function == modbus.FuncCodeMaskWriteRegister:
+		err = readMore(8)
+	case function == modbus.FuncCodeReadFIFOQueue:
+		if err = readMore(2); err == nil {
+			err = readMore(int(data[2])<<8 | int(data[3]) + 2)
+		}
+	default:
+		n, err = mb.readUntilQuiet(data[:], n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+// readUntilQuiet reads into buf from offset n until no data arrives for rtuFrameGap
+func (mb *rtuOverTCPHandler) readUntilQuiet(buf []byte, n int) (int, error) {
+	for n < len(buf) {
+		if err := mb.conn.SetReadDeadline(time.Now().Add(rtuFrameGap)); err != nil {
+			return n, err
+		}
+		read, err := mb.conn.Read(buf[n:])
+		n += read
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Connect dials the gateway if not already connected
+func (mb *rtuOverTCPHandler) Connect() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	return mb.connect()
+}
+
+func (mb *rtuOverTCPHandler) connect() error {
+	if mb.conn == nil {
+		dialer := net.Dialer{Timeout: mb.Timeout}
+		conn, err := dialer.Dial("tcp", mb.Address)
+		if err != nil {
+			return err
+		}
+		mb.conn = conn
+	}
+	return nil
+}
+
+// Close closes the connection to the gateway
+func (mb *rtuOverTCPHandler) Close() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.conn == nil {
+		return nil
+	}
+	err := mb.conn.Close()
+	mb.conn = nil
+	return err
+}
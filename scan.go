@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// scanInterval is the pause between the requests of a scan when --interval
+// is not given, short enough for a quick sweep but gentle on slow devices
+const scanInterval = 100
+
+// unitProbe is the outcome of probing one unit id
+type unitProbe int
+
+const (
+	unitSilent unitProbe = iota
+	unitAnswered
+	unitException
+)
+
+// scanUnits implements the scan_units operation: it probes every unit id
+// from --unit-start to --unit-end and reports which units answered. The
+// probe reads one holding register at --start, or with --probe device_id the
+// device identification. An exception response counts as an answer, as only
+// a present unit can reject a request. A unit that does not answer within
+// --probe-timeout is reported as silent; the connection is then closed, so
+// a late answer cannot be taken for the next unit's. With --parallel, units
+// are probed concurrently over separate connections.
+func scanUnits(ctx context.Context, s *session) error {
+	args := s.args
+	probeArgs := *args
+	probeArgs.ResponseTimeout = args.ProbeTimeout
+
+	outcomes := make(map[int]unitProbe)
+	var err error
+	if args.Parallel > 1 {
+		outcomes = scanUnitsParallel(ctx, &probeArgs, s.clock)
+	} else {
+		// Reconnects restore the response timeout from the session's arguments
+		s.args = &probeArgs
+		setHandlerTimeout(s.handler, probeArgs.ResponseTimeout)
+		defer func() {
+			s.args = args
+			setHandlerTimeout(s.handler, args.ResponseTimeout)
+			setHandlerUnit(s.handler, args.UnitID)
+		}()
+		err = s.scanUnitsSequential(ctx, outcomes)
+	}
+
+	var answered, exceptions, silent []int
+	for unit := int(args.UnitStart); unit <= int(args.UnitEnd); unit++ {
+		outcome, probed := outcomes[unit]
+		if !probed {
+			continue
+		}
+		switch outcome {
+		case unitAnswered:
+			s.succeeded++
+			answered = append(answered, unit)
+		case unitException:
+			s.succeeded++
+			exceptions = append(exceptions, unit)
+		default:
+			s.failed++
+			silent = append(silent, unit)
+		}
+	}
+
+	logInfof("Scan of units %d to %d: %d answered %v, %d answered with an exception %v, %d silent",
+		args.UnitStart, args.UnitEnd, len(answered), answered, len(exceptions), exceptions, len(silent))
+	live := append(append([]int{}, answered...), exceptions...)
+	sort.Ints(live)
+	logInfof("Live units: %v", live)
+	if s.printer.report != nil {
+		s.printer.report.write("- Unit scan %d to %d: answered %v, answered with an exception %v, %d silent\n",
+			args.UnitStart, args.UnitEnd, answered, exceptions, len(silent))
+	}
+	return err
+}
+
+// scanUnitsSequential probes the units one at a time over the session's
+// connection, reconnecting and probing the same unit again if it drops
+func (s *session) scanUnitsSequential(ctx context.Context, outcomes map[int]unitProbe) error {
+	args := s.args
+	for unit := int(args.UnitStart); unit <= int(args.UnitEnd) && ctx.Err() == nil; unit++ {
+		outcome, err := probeUnit(s.handler, s.client, args, byte(unit))
+		if err != nil {
+			if err := s.reconnect(ctx, err); err != nil {
+				if errors.Is(err, context.Canceled) {
+					break
+				}
+				return err
+			}
+			unit--
+			continue
+		}
+		s.reconnects = 0
+		outcomes[unit] = outcome
+		if unit < int(args.UnitEnd) && !sleepContext(ctx, s.clock, time.Duration(args.Interval)*time.Millisecond) {
+			break
+		}
+	}
+	return nil
+}
+
+// scanUnitsParallel probes the units with --parallel workers, each over its
+// own connection. A worker whose connection drops reconnects once and probes
+// the unit again; if that fails too, the unit is reported as silent.
+func scanUnitsParallel(ctx context.Context, args *ModbusArgs, clock clock) map[int]unitProbe {
+	units := make(chan int)
+	var mu sync.Mutex
+	outcomes := make(map[int]unitProbe)
+	var wg sync.WaitGroup
+	for worker := 0; worker < args.Parallel; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler, client := createModbusClient(args, clock, nil)
+			defer handler.Close()
+			for unit := range units {
+				outcome, err := probeUnit(handler, client, args, byte(unit))
+				if err != nil {
+					handler.Close()
+					if err = connectHandler(handler, args); err == nil {
+						outcome, err = probeUnit(handler, client, args, byte(unit))
+					}
+					if err != nil {
+						logInfof("Unit %d: no answer (%v)", unit, err)
+					}
+				}
+				mu.Lock()
+				outcomes[unit] = outcome
+				mu.Unlock()
+				sleepContext(ctx, clock, time.Duration(args.Interval)*time.Millisecond)
+			}
+		}()
+	}
+	for unit := int(args.UnitStart); unit <= int(args.UnitEnd) && ctx.Err() == nil; unit++ {
+		units <- unit
+	}
+	close(units)
+	wg.Wait()
+	return outcomes
+}
+
+// probeUnit sends the scan probe to unit and logs the outcome. A lost
+// connection is returned as an error, for the caller to reconnect.
+func probeUnit(handler clientHandler, client modbus.Client, args *ModbusArgs, unit byte) (unitProbe, error) {
+	setHandlerUnit(handler, unit)
+	var err error
+	if args.Probe == "device_id" {
+		_, err = readDeviceID(handler)
+	} else {
+		_, err = client.ReadHoldingRegisters(args.Start, 1)
+	}
+	if isConnectionError(err) {
+		return unitSilent, err
+	}
+
+	var modbusErr *modbus.ModbusError
+	switch {
+	case err == nil:
+		logInfof("Unit %d: answered", unit)
+		return unitAnswered, nil
+	case errors.As(err, &modbusErr):
+		logInfof("Unit %d: answered with %v", unit, describeException(err))
+		return unitException, nil
+	}
+	logInfof("Unit %d: no answer (%v)", unit, err)
+	handler.Close()
+	return unitSilent, nil
+}
+
+// scanTables maps the --table names of scan_registers to the read function
+// codes and the names used in its log lines
+var scanTables = map[string]struct {
+	functionCode byte
+	name         string
+}{
+	"holding":  {modbus.FuncCodeReadHoldingRegisters, "Register"},
+	"input":    {modbus.FuncCodeReadInputRegisters, "Input register"},
+	"coil":     {modbus.FuncCodeReadCoils, "Coil"},
+	"discrete": {modbus.FuncCodeReadDiscreteInputs, "Discrete input"},
+}
+
+// maxScanBackoff caps the pause between scan_registers requests, which
+// doubles after every timeout
+const maxScanBackoff = 5 * time.Second
+
+// scanRegisters implements the scan_registers operation: it reads the --table
+// addresses from --start, --count of them or up to --end, --chunk at a time,
+// and reports which addresses return data and which answer with an exception
+// such as Illegal Data Address. A chunk answered with an exception is read
+// again one address at a time to find the missing ones. After a timeout the
+// pause between requests doubles, up to maxScanBackoff, until the device
+// answers again. The readable addresses are summarised as contiguous ranges
+// at the end, which helps to map an undocumented device; --dump writes their
+// values to a CSV file.
+func scanRegisters(ctx context.Context, s *session) error {
+	args := s.args
+	table := scanTables[args.Table]
+	first := int(args.Start)
+	last := first + int(args.Count) - 1
+	if args.End != 0 {
+		last = int(args.End)
+	}
+	if last > 0xFFFF {
+		last = 0xFFFF
+	}
+
+	var dump *os.File
+	if args.Dump != "" {
+		var err error
+		if dump, err = os.Create(args.Dump); err != nil {
+			return fmt.Errorf("Error creating dump file: %v", err)
+		}
+		defer dump.Close()
+		fmt.Fprintln(dump, "address,value")
+	}
+
+	interval := time.Duration(args.Interval) * time.Millisecond
+	pause := interval
+	var readable []int
+	rejected, silent := 0, 0
+	// Addresses up to single are read one at a time
+	single := -1
+	for address := first; address <= last && ctx.Err() == nil; {
+		n := int(args.Chunk)
+		if address <= single {
+			n = 1
+		}
+		if address+n-1 > last {
+			n = last - address + 1
+		}
+		data, err := readBlock(s.client, table.functionCode, uint16(address), uint16(n), 1)
+		if isConnectionError(err) {
+			if err := s.reconnect(ctx, err); err != nil {
+				if errors.Is(err, context.Canceled) {
+					break
+				}
+				return err
+			}
+			continue
+		}
+		s.reconnects = 0
+
+		var modbusErr *modbus.ModbusError
+		switch {
+		case err == nil:
+			s.succeeded++
+			values := scanValues(table.functionCode, data, n)
+			for i, value := range values {
+				readable = append(readable, address+i)
+				if dump != nil {
+					fmt.Fprintf(dump, "%d,%d\n", address+i, value)
+				}
+			}
+			if n == 1 {
+				logInfof("%s %d: %d", table.name, address, values[0])
+			} else {
+				logInfof("%s %s: %v", table.name, addressSpan(address, n), values)
+			}
+			pause = interval
+		case errors.As(err, &modbusErr) && n > 1:
+			s.succeeded++
+			logInfof("%s %s: %v, reading them one at a time", table.name, addressSpan(address, n), describeException(err))
+			single = address + n - 1
+			pause = interval
+			n = 0
+		case errors.As(err, &modbusErr):
+			s.succeeded++
+			rejected++
+			logInfof("%s %d: %v", table.name, address, describeException(err))
+			pause = interval
+		default:
+			s.failed++
+			silent += n
+			logInfof("%s %s: no answer (%v)", table.name, addressSpan(address, n), err)
+			s.handler.Close()
+			if pause *= 2; pause < 100*time.Millisecond {
+				pause = 100 * time.Millisecond
+			} else if pause > maxScanBackoff {
+				pause = maxScanBackoff
+			}
+			logWarnf("Backing off to %v between requests", pause)
+		}
+		address += n
+		if address <= last && !sleepContext(ctx, s.clock, pause) {
+			break
+		}
+	}
+
+	ranges := registerRanges(readable)
+	logInfof("Scan of %s addresses %d to %d: %d readable, %d rejected, %d silent", args.Table, first, last, len(readable), rejected, silent)
+	logInfof("Readable ranges: %s", ranges)
+	if s.printer.report != nil {
+		s.printer.report.write("- Register scan (%s) %d to %d: readable %s\n", args.Table, first, last, ranges)
+	}
+	return nil
+}
+
+// addressSpan formats n addresses from address, e.g. "5" or "5 to 9"
+func addressSpan(address, n int) string {
+	if n == 1 {
+		return fmt.Sprint(address)
+	}
+	return fmt.Sprintf("%d to %d", address, address+n-1)
+}
+
+// scanValues decodes the n values of a scan_registers read: register words,
+// or coil and input states as 0 or 1
+func scanValues(functionCode byte, data []byte, n int) []uint16 {
+	values := make([]uint16, n)
+	for i := range values {
+		switch functionCode {
+		case modbus.FuncCodeReadCoils, modbus.FuncCodeReadDiscreteInputs:
+			if i/8 < len(data) {
+				values[i] = uint16(data[i/8]>>(i%8)) & 1
+			}
+		default:
+			if (i+1)*registerSize <= len(data) {
+				values[i] = binary.BigEndian.Uint16(data[i*registerSize:])
+			}
+		}
+	}
+	return values
+}
+
+// registerRanges formats sorted addresses as contiguous ranges, e.g. "0-9, 20, 30-31"
+func registerRanges(addresses []int) string {
+	if len(addresses) == 0 {
+		return "none"
+	}
+	var ranges []string
+	start := addresses[0]
+	for i := 1; i <= len(addresses); i++ {
+		if i < len(addresses) && addresses[i] == addresses[i-1]+1 {
+			continue
+		}
+		if end := addresses[i-1]; end == start {
+			ranges = append(ranges, fmt.Sprint(start))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", start, end))
+		}
+		if i < len(addresses) {
+			start = addresses[i]
+		}
+	}
+	return strings.Join(ranges, ", ")
+}
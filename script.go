@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// scriptOperations are the operations a --script step may run
+var scriptOperations = map[string]bool{
+	"read_coils":                    true,
+	"read_discrete_inputs":          true,
+	"read_holding_registers":        true,
+	"read_input_registers":          true,
+	"write_single_coil":             true,
+	"write_single_register":         true,
+	"write_multiple_coils":          true,
+	"write_multiple_registers":      true,
+	"read_write_multiple_registers": true,
+	"mask_write_register":           true,
+	"read_device_id":                true,
+	"read_fifo_queue":               true,
+	"read_exception_status":         true,
+	"read":                          true,
+}
+
+// scriptStep is one step of a --script file
+type scriptStep struct {
+	Operation  string        `json:"operation"`
+	Start      uint16        `json:"start"`
+	Count      uint16        `json:"count"`
+	WriteStart uint16        `json:"write_start"`
+	Type       string        `json:"type"`
+	Value      interface{}   `json:"value"`
+	Values     []interface{} `json:"values"`
+	AndMask    *uint16       `json:"and_mask"`
+	OrMask     uint16        `json:"or_mask"`
+	Points     []string      `json:"points"`
+	Delay      string        `json:"delay"`
+
+	// args are the command-line arguments with the step's settings applied
+	args  *ModbusArgs
+	delay time.Duration
+}
+
+// loadScript reads a script from a JSON file of the form
+//
+//	{"steps": [
+//	  {"operation": "write_single_register", "start": 10, "value": 500, "delay": "2s"},
+//	  {"operation": "read_holding_registers", "start": 0, "count": 3}
+//	]}
+//
+// Each step takes the settings of the command line (unit id, --type, byte
+// order, scale and so on) and overrides the ones it gives. The count defaults
+// to 1, as does the and_mask of mask_write_register to 0xFFFF. read steps
+// take the names of register map points in points. The delay is waited after the step, before the next one runs. Values
+// are checked when the script is loaded, so a mistake in a later step stops
+// the run before the first request.
+func loadScript(path string, args *ModbusArgs) ([]*scriptStep, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var steps []*scriptStep
+	err = decodeJSONList(path, data, "steps", func(decode func(interface{}) error) error {
+		step := &scriptStep{}
+		if err := decode(step); err != nil {
+			return fmt.Errorf("step %d: %w", len(steps)+1, err)
+		}
+		if err := step.prepare(args); err != nil {
+			return fmt.Errorf("step %d: %v", len(steps)+1, err)
+		}
+		steps = append(steps, step)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", path)
+	}
+	return steps, nil
+}
+
+// prepare builds the arguments the step runs with and parses its delay
+func (step *scriptStep) prepare(args *ModbusArgs) error {
+	if !scriptOperations[step.Operation] {
+		return fmt.Errorf("unsupported operation %q", step.Operation)
+	}
+	if step.Delay != "" {
+		delay, err := time.ParseDuration(step.Delay)
+		if err != nil || delay < 0 {
+			return fmt.Errorf("invalid delay %q", step.Delay)
+		}
+		step.delay = delay
+	}
+
+	stepArgs := *args
+	stepArgs.Operation = step.Operation
+	stepArgs.Start = step.Start
+	stepArgs.Count = step.Count
+	if stepArgs.Count == 0 {
+		stepArgs.Count = 1
+	}
+	stepArgs.WriteStart = step.WriteStart
+	if step.Type != "" {
+		stepArgs.Type = step.Type
+	}
+	stepArgs.ValueText = "0"
+	if step.Value != nil {
+		stepArgs.ValueText = fmt.Sprint(step.Value)
+	}
+	stepArgs.ValueTexts = make([]string, len(step.Values))
+	for i, value := range step.Values {
+		stepArgs.ValueTexts[i] = fmt.Sprint(value)
+	}
+	stepArgs.Values = nil
+	stepArgs.AndMask, stepArgs.OrMask = 0xFFFF, step.OrMask
+	if step.AndMask != nil {
+		stepArgs.AndMask = *step.AndMask
+	}
+	stepArgs.Points = step.Points
+
+	// The script as a whole is repeated, each step runs once per cycle
+	stepArgs.Repeat, stepArgs.RepeatSuccess, stepArgs.Interval = 1, 0, 0
+	stepArgs.OnChange = false
+	stepArgs.Script, stepArgs.Interactive = "", false
+	// The script runs --preflight once, before its first write step
+	stepArgs.Preflight = false
+	if !args.PreflightAddressSet {
+		stepArgs.PreflightAddress = stepArgs.Start
+		if step.Operation == "read_write_multiple_registers" {
+			stepArgs.PreflightAddress = stepArgs.WriteStart
+		}
+	}
+	if err := parseOperationValues(&stepArgs); err != nil {
+		return err
+	}
+	step.args = &stepArgs
+	return nil
+}
+
+// runScript runs the steps of --script in order over the session's
+// connection, repeating the whole sequence with --repeat and --interval. A
+// failed step is logged with its number; with --stop-on-error it ends the
+// run, otherwise the remaining steps still run. The run fails if any step did.
+// With --preflight, the probe runs once before the first write step and a
+// rejected probe stops the script.
+func runScript(ctx context.Context, s *session) error {
+	args := s.args
+	steps, err := loadScript(args.Script, args)
+	if err != nil {
+		return fmt.Errorf("Error loading script: %v", err)
+	}
+	failed, preflighted := false, !args.Preflight
+	for cycle := 1; args.Repeat == 0 || cycle <= args.Repeat; cycle++ {
+		for i, step := range steps {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if !preflighted && !readOnlyOperations[step.Operation] {
+				preflighted = true
+				if err := s.preflightStep(step); err != nil {
+					return err
+				}
+			}
+			if err := s.runStep(ctx, step); err != nil {
+				failed = true
+				logErrorf("Step %d (%s) failed: %v", i+1, step.Operation, describeException(err))
+				if args.StopOnError {
+					logErrorf("Stopping the script after step %d (--stop-on-error)", i+1)
+					return errReported
+				}
+			}
+			if step.delay > 0 && !sleepContext(ctx, s.clock, step.delay) {
+				return nil
+			}
+		}
+		if (args.Repeat == 0 || cycle < args.Repeat) && !sleepContext(ctx, s.clock, time.Duration(args.Interval)*time.Millisecond) {
+			return nil
+		}
+	}
+	if failed {
+		return errReported
+	}
+	return nil
+}
+
+// preflightStep runs the --preflight probe for the target of step
+func (s *session) preflightStep(step *scriptStep) error {
+	args := s.args
+	s.args, s.printer.args = step.args, step.args
+	defer func() {
+		s.args, s.printer.args = args, args
+	}()
+	return preflight(s)
+}
+
+// runStep runs one prepared step over the session's connection and returns
+// its error, if it failed
+func (s *session) runStep(ctx context.Context, step *scriptStep) error {
+	args := s.args
+	s.args, s.printer.args = step.args, step.args
+	defer func() {
+		s.args, s.printer.args, s.printer.addresses = args, args, nil
+	}()
+	s.lastErr = nil
+	err := runOperation(ctx, s)
+	if err == nil || errors.Is(err, errReported) {
+		err = s.lastErr
+	}
+	return err
+}
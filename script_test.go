@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/goburrow/modbus"
+)
+
+// writeTestScript writes a script with the given steps to a temporary file
+// and returns its path
+func writeTestScript(t *testing.T, steps string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "script.json")
+	if err := os.WriteFile(path, []byte(`{"steps": [`+steps+`]}`), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestScriptPreflight(t *testing.T) {
+	script := writeTestScript(t, `
+		{"operation": "read_holding_registers", "start": 0},
+		{"operation": "write_single_register", "start": 10, "value": 500},
+		{"operation": "write_single_register", "start": 11, "value": 600}`)
+	server := newTestServer(t)
+	server.holding[10] = 42
+	s, _ := newTestSession(t, server, "--script", script, "--preflight", "--repeat", "2")
+
+	if err := runScript(context.Background(), s); err != nil {
+		t.Fatalf("runScript: %v", err)
+	}
+	// The first write step's register is read and written back once, after
+	// the read step and before any write, however often the script repeats
+	want := []byte{
+		modbus.FuncCodeReadHoldingRegisters,
+		modbus.FuncCodeReadHoldingRegisters, modbus.FuncCodeWriteSingleRegister,
+		modbus.FuncCodeWriteSingleRegister, modbus.FuncCodeWriteSingleRegister,
+		modbus.FuncCodeReadHoldingRegisters, modbus.FuncCodeWriteSingleRegister, modbus.FuncCodeWriteSingleRegister,
+	}
+	if !reflect.DeepEqual(server.functionCodes, want) {
+		t.Errorf("function codes = %v, want %v", server.functionCodes, want)
+	}
+	if server.holding[10] != 500 || server.holding[11] != 600 {
+		t.Errorf("registers 10, 11 = %d, %d, want 500, 600", server.holding[10], server.holding[11])
+	}
+}
+
+func TestScriptPreflightRejected(t *testing.T) {
+	script := writeTestScript(t, `
+		{"operation": "read_holding_registers", "start": 0},
+		{"operation": "write_single_register", "start": 10, "value": 500}`)
+	server := newTestServer(t)
+	// The device has no register 1000 to probe, so no step writes
+	s, _ := newTestSession(t, server, "--script", script, "--preflight", "--preflight-address", "1000")
+
+	if err := runScript(context.Background(), s); err == nil {
+		t.Fatalf("runScript succeeded, want the rejected preflight")
+	}
+	if len(server.functionCodes) != 2 || server.functionCodes[1] != modbus.FuncCodeReadHoldingRegisters {
+		t.Errorf("function codes = %v, want the read step and the preflight read only", server.functionCodes)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/spf13/pflag"
+)
+
+// testTableSize is the number of addresses in each table of a testServer
+const testTableSize = 1000
+
+// testServer is an in-process Modbus TCP server for the tests. Each table
+// holds testTableSize addresses; requests beyond them are answered with
+// Illegal Data Address, and function codes it does not serve with Illegal
+// Function.
+type testServer struct {
+	listener net.Listener
+
+	mu              sync.Mutex
+	coils           [testTableSize]bool
+	discreteInputs  [testTableSize]bool
+	holding         [testTableSize]uint16
+	input           [testTableSize]uint16
+	exceptionStatus byte
+
+	// exception, if not 0, answers every request with this exception code,
+	// or only the first exceptionRequests requests if that is not 0
+	exception         byte
+	exceptionRequests int
+	// dropWrites applies write requests without answering them, as if the
+	// response were lost
+	dropWrites bool
+	// discardWrites neither applies write requests nor answers them, as if
+	// the request were lost
+	discardWrites bool
+	// xorKeyRegister, if not nil, makes the server scramble payloads as
+	// --payload-transform xor expects: the first request on a connection,
+	// the key handshake, is in clear, and the data of every later request
+	// and response is XORed with this holding register
+	xorKeyRegister *uint16
+	// clock, if set, is the clock of the sessions newTestSession connects,
+	// and every request takes latency on it
+	clock   *fakeClock
+	latency time.Duration
+	// functionCodes are the function codes of the requests received
+	functionCodes []byte
+
+	conns []net.Conn
+}
+
+// newTestServer starts a testServer on a free local port, stopped when the
+// test ends
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	server := &testServer{listener: listener}
+	t.Cleanup(server.close)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.mu.Lock()
+			server.conns = append(server.conns, conn)
+			server.mu.Unlock()
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+// close stops the server and closes its connections
+func (s *testServer) close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// port returns the port the server listens on
+func (s *testServer) port() string {
+	return strconv.Itoa(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// serve answers the requests of one connection until it is closed
+func (s *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 7)
+	for handshake := true; ; handshake = false {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint16(header[4:])
+		if length < 2 {
+			return
+		}
+		request := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		key := s.xorKey()
+		if handshake {
+			key = nil
+		}
+		xorData(request, key)
+		response := s.respond(request)
+		if response == nil {
+			continue
+		}
+		if response[0]&0x80 == 0 {
+			xorData(response, key)
+		}
+		binary.BigEndian.PutUint16(header[4:], uint16(len(response)+1))
+		if _, err := conn.Write(append(append([]byte(nil), header...), response...)); err != nil {
+			return
+		}
+	}
+}
+
+// xorKey returns the key the server scrambles payloads with, or nil
+func (s *testServer) xorKey() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.xorKeyRegister == nil {
+		return nil
+	}
+	return registerBytes(s.holding[*s.xorKeyRegister : *s.xorKeyRegister+1])
+}
+
+// xorData XORs the data of a PDU with key, if there is one
+func xorData(pdu []byte, key []byte) {
+	if key == nil {
+		return
+	}
+	for i := 1; i < len(pdu); i++ {
+		pdu[i] ^= key[(i-1)%len(key)]
+	}
+}
+
+// respond returns the response PDU to the request PDU, or nil to send none
+func (s *testServer) respond(request []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	functionCode := request[0]
+	s.functionCodes = append(s.functionCodes, functionCode)
+	if s.clock != nil {
+		s.clock.Advance(s.latency)
+	}
+	if s.exception != 0 && (s.exceptionRequests == 0 || len(s.functionCodes) <= s.exceptionRequests) {
+		return []byte{functionCode | 0x80, s.exception}
+	}
+	if s.discardWrites && testWriteFunctionCodes[functionCode] {
+		return nil
+	}
+	response, exception := s.execute(functionCode, request[1:])
+	if exception != 0 {
+		return []byte{functionCode | 0x80, exception}
+	}
+	if s.dropWrites && testWriteFunctionCodes[functionCode] {
+		return nil
+	}
+	return append([]byte{functionCode}, response...)
+}
+
+// testWriteFunctionCodes are the function codes a testServer treats as writes
+var testWriteFunctionCodes = map[byte]bool{
+	modbus.FuncCodeWriteSingleCoil:            true,
+	modbus.FuncCodeWriteSingleRegister:        true,
+	modbus.FuncCodeWriteMultipleCoils:         true,
+	modbus.FuncCodeWriteMultipleRegisters:     true,
+	modbus.FuncCodeMaskWriteRegister:          true,
+	modbus.FuncCodeReadWriteMultipleRegisters: true,
+}
+
+// execute carries out a request and returns the data of its response, or
+// the exception code it fails with
+func (s *testServer) execute(functionCode byte, data []byte) ([]byte, byte) {
+	word := func(i int) int { return int(binary.BigEndian.Uint16(data[2*i:])) }
+	inRange := func(address, quantity, limit int) bool {
+		return quantity >= 1 && quantity <= limit && address+quantity <= testTableSize
+	}
+
+	switch functionCode {
+	case modbus.FuncCodeReadCoils, modbus.FuncCodeReadDiscreteInputs:
+		address, quantity := word(0), word(1)
+		if !inRange(address, quantity, 2000) {
+			return nil, modbus.ExceptionCodeIllegalDataAddress
+		}
+		table := s.coils
+		if functionCode == modbus.FuncCodeReadDiscreteInputs {
+			table = s.discreteInputs
+		}
+		bits := make([]byte, (quantity+7)/8)
+		for i := 0; i < quantity; i++ {
+			if table[address+i] {
+				bits[i/8] |= 1 << (i % 8)
+			}
+		}
+		return append([]byte{byte(len(bits))}, bits...), 0
+
+	case modbus.FuncCodeReadHoldingRegisters, modbus.FuncCodeReadInputRegisters:
+		address, quantity := word(0), word(1)
+		if !inRange(address, quantity, 125) {
+			return nil, modbus.ExceptionCodeIllegalDataAddress
+		}
+		table := s.holding
+		if functionCode == modbus.FuncCodeReadInputRegisters {
+			table = s.input
+		}
+		return append([]byte{byte(2 * quantity)}, registerBytes(table[address:address+quantity])...), 0
+
+	case modbus.FuncCodeWriteSingleCoil:
+		address, value := word(0), word(1)
+		if address >= testTableSize {
+			return nil, modbus.ExceptionCodeIllegalDataAddress
+		}
+		if value != 0xFF00 && value != 0 {
+			return nil, modbus.ExceptionCodeIllegalDataValue
+		}
+		s.coils[address] = value == 0xFF00
+		return data[:4], 0
+
+	case modbus.FuncCodeWriteSingleRegister:
+		address := word(0)
+		if address >= testTableSize {
+			return nil, modbus.ExceptionCodeIllegalDataAddress
+		}
+		s.holding[address] = uint16(word(1))
+		return data[:4], 0
+
+	case funcCodeReadExceptionStatus:
+		return []byte{s.exceptionStatus}, 0
+
+	case modbus.FuncCodeWriteMultipleCoils:
+		address, quantity := word(0), word(1)
+		if !inRange(address, quantity, 1968) {
+			return nil, modbus.ExceptionCodeIllegalDataAddress
+		}
+		if int(data[4]) != (quantity+7)/8 || len(data) != 5+int(data[4]) {
+			return nil, modbus.ExceptionCodeIllegalDataValue
+		}
+		for i := 0; i < quantity; i++ {
+			s.coils[address+i] = data[5+i/8]&(1<<(i%8)) != 0
+		}
+		return data[:4], 0
+
+	case modbus.FuncCodeWriteMultipleRegisters:
+		address, quantity := word(0), word(1)
+		if !inRange(address, quantity, 123) {
+			return nil, modbus.ExceptionCodeIllegalDataAddress
+		}
+		if int(data[4]) != 2*quantity || len(data) != 5+int(data[4]) {
+			return nil, modbus.ExceptionCodeIllegalDataValue
+		}
+		for i := 0; i < quantity; i++ {
+			s.holding[address+i] = binary.BigEndian.Uint16(data[5+2*i:])
+		}
+		return data[:4], 0
+
+	case modbus.FuncCodeMaskWriteRegister:
+		address, and, or := word(0), uint16(word(1)), uint16(word(2))
+		if address >= testTableSize {
+			return nil, modbus.ExceptionCodeIllegalDataAddress
+		}
+		s.holding[address] = s.holding[address]&and | or&^and
+		return data[:6], 0
+
+	case modbus.FuncCodeReadWriteMultipleRegisters:
+		readAddress, readQuantity, writeAddress, writeQuantity := word(0), word(1), word(2), word(3)
+		if !inRange(readAddress, readQuantity, 125) || !inRange(writeAddress, writeQuantity, 121) {
+			return nil, modbus.ExceptionCodeIllegalDataAddress
+		}
+		for i := 0; i < writeQuantity; i++ {
+			s.holding[writeAddress+i] = binary.BigEndian.Uint16(data[9+2*i:])
+		}
+		return append([]byte{byte(2 * readQuantity)}, registerBytes(s.holding[readAddress:readAddress+readQuantity])...), 0
+	}
+	return nil, modbus.ExceptionCodeIllegalFunction
+}
+
+// registerBytes returns registers as big-endian bytes
+func registerBytes(registers []uint16) []byte {
+	data := make([]byte, 0, 2*len(registers))
+	for _, register := range registers {
+		data = binary.BigEndian.AppendUint16(data, register)
+	}
+	return data
+}
+
+// parseTestFlags runs parseFlags on a fresh flag set with the command line flags
+func parseTestFlags(t *testing.T, flags ...string) (*ModbusArgs, error) {
+	t.Helper()
+	commandLine, osArgs, level := pflag.CommandLine, os.Args, minLogLevel
+	t.Cleanup(func() { pflag.CommandLine, os.Args, minLogLevel = commandLine, osArgs, level })
+	pflag.CommandLine = pflag.NewFlagSet("modbus_client", pflag.ContinueOnError)
+	os.Args = append([]string{"modbus_client"}, flags...)
+	return parseFlags()
+}
+
+// newTestSession connects a session to server as run does, with the
+// command line flags and JSON results written to the returned buffer
+func newTestSession(t *testing.T, server *testServer, flags ...string) (*session, *bytes.Buffer) {
+	t.Helper()
+	flags = append([]string{"--server", "127.0.0.1", "--port", server.port(), "--format", "json",
+		"--response-timeout", "200ms", "--interval", "0", "--log-level", "error"}, flags...)
+	args, err := parseTestFlags(t, flags...)
+	if err != nil {
+		t.Fatalf("parseFlags(%q): %v", flags, err)
+	}
+	out := &bytes.Buffer{}
+	var clock clock = realClock{}
+	if server.clock != nil {
+		clock = server.clock
+	}
+	s := &session{args: args, printer: newResultPrinter(args, out, clock), clock: clock}
+	s.started = s.clock.Now()
+	if args.Stats {
+		s.stats = &latencyStats{every: args.StatsEvery}
+	}
+	s.handler, s.client = createModbusClient(args, s.clock, s.observeRequest)
+	t.Cleanup(func() { s.handler.Close() })
+	return s, out
+}
+
+// testResults decodes the JSON results printed to out
+func testResults(t *testing.T, out *bytes.Buffer) []jsonResult {
+	t.Helper()
+	var results []jsonResult
+	decoder := json.NewDecoder(out)
+	for decoder.More() {
+		var result jsonResult
+		if err := decoder.Decode(&result); err != nil {
+			t.Fatalf("Decoding results: %v", err)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// resultValues returns the values of a result, which JSON decodes as float64
+func resultValues(result jsonResult) []interface{} {
+	values := make([]interface{}, len(result.Values))
+	for i, value := range result.Values {
+		values[i] = value.Value
+	}
+	return values
+}
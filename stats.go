@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// timedHandler times every request sent through the handler it wraps, from
+// sending the request to receiving its response, and hands the time to
+// observe. A read split into several requests is timed request by request,
+// and the time taken decoding and printing results is left out.
+type timedHandler struct {
+	clientHandler
+	clock   clock
+	observe func(d time.Duration, err error)
+}
+
+// Send sends one request and times its round trip. err is only set when no
+// response arrived; an exception response counts as an answer.
+func (h *timedHandler) Send(aduRequest []byte) ([]byte, error) {
+	// Sub uses the monotonic clock, so wall clock steps do not skew the timing
+	sent := h.clock.Now()
+	aduResponse, err := h.clientHandler.Send(aduRequest)
+	h.observe(h.clock.Now().Sub(sent), err)
+	return aduResponse, err
+}
+
+// observeRequest counts one request and records its round-trip time in the
+// --stats statistics and the metrics. The --block goroutines share it.
+func (s *session) observeRequest(d time.Duration, err error) {
+	s.requests.Add(1)
+	if s.stats != nil {
+		s.stats.add(d, err)
+	}
+	if s.printer.metrics != nil {
+		s.printer.metrics.observe(d)
+		s.printer.metrics.setUp(!isConnectionError(err) && !isTimeout(err))
+	}
+}
+
+// latencyReservoirSize is the most round-trip times latencyStats keeps for
+// its percentiles. Past it they come from a uniform random sample of all the
+// requests, so a run with --repeat 0 does not grow without bound.
+const latencyReservoirSize = 10000
+
+// latencyStats collects the round-trip times of requests for --stats. The
+// --block goroutines share one, so every access holds mu.
+type latencyStats struct {
+	every int
+
+	mu sync.Mutex
+	// count, min, max and the running mean and sum of squared deviations
+	// (Welford's method) cover every request
+	count    int
+	min, max time.Duration
+	mean, m2 float64
+	// samples is a reservoir sample of the round-trip times, kept for the
+	// percentiles; random picks the samples replaced once it is full
+	samples []time.Duration
+	random  *rand.Rand
+	errors  int
+}
+
+// add records one request taking d, logging the statistics every --stats-every
+// requests. err is set for a request that got no response.
+func (l *latencyStats) add(d time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count++
+	if l.count == 1 || d < l.min {
+		l.min = d
+	}
+	if d > l.max {
+		l.max = d
+	}
+	delta := float64(d) - l.mean
+	l.mean += delta / float64(l.count)
+	l.m2 += delta * (float64(d) - l.mean)
+
+	if len(l.samples) < latencyReservoirSize {
+		l.samples = append(l.samples, d)
+	} else {
+		if l.random == nil {
+			l.random = rand.New(rand.NewSource(1))
+		}
+		if i := l.random.Intn(l.count); i < latencyReservoirSize {
+			l.samples[i] = d
+		}
+	}
+	if err != nil {
+		l.errors++
+	}
+	if l.every > 0 && l.count%l.every == 0 {
+		l.logLocked()
+	}
+}
+
+// log logs min/avg/max, the standard deviation and percentiles of the
+// round-trip times so far, with the number of requests without a response.
+// Past latencyReservoirSize requests the percentiles are estimates.
+func (l *latencyStats) log() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logLocked()
+}
+
+func (l *latencyStats) logLocked() {
+	if l.count == 0 {
+		return
+	}
+	sorted := append([]time.Duration(nil), l.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	stddev := math.Sqrt(l.m2 / float64(l.count))
+
+	// Nearest-rank percentile
+	percentile := func(p float64) time.Duration {
+		rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+		if rank < 1 {
+			rank = 1
+		}
+		return sorted[rank-1]
+	}
+	round := func(d time.Duration) time.Duration { return d.Round(time.Microsecond) }
+	logInfof("Latency over %d requests: min %v, avg %v, max %v, stddev %v, p50 %v, p95 %v, p99 %v, %d without a response",
+		l.count, round(l.min), round(time.Duration(l.mean)), round(l.max), round(time.Duration(stddev)),
+		round(percentile(50)), round(percentile(95)), round(percentile(99)), l.errors)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLatencyStatsBounded(t *testing.T) {
+	stats := &latencyStats{}
+	const n = 5 * latencyReservoirSize / 2
+	for i := 1; i <= n; i++ {
+		stats.add(time.Duration(i)*time.Microsecond, nil)
+	}
+
+	// Past the reservoir, memory stays bounded while the counts stay exact
+	if len(stats.samples) != latencyReservoirSize {
+		t.Errorf("kept %d samples, want %d", len(stats.samples), latencyReservoirSize)
+	}
+	if stats.count != n || stats.min != time.Microsecond || stats.max != n*time.Microsecond {
+		t.Errorf("count, min, max = %d, %v, %v, want %d, 1µs, %v", stats.count, stats.min, stats.max, n, n*time.Microsecond)
+	}
+	if mean := time.Duration(stats.mean); mean != (n+1)*time.Microsecond/2 {
+		t.Errorf("mean = %v, want %v", mean, (n+1)*time.Microsecond/2)
+	}
+	// The standard deviation of 1..n is sqrt((n²-1)/12)
+	want := math.Sqrt((n*n-1)/12.0) * float64(time.Microsecond)
+	if stddev := math.Sqrt(stats.m2 / n); math.Abs(stddev-want) > want*1e-9 {
+		t.Errorf("stddev = %v, want %v", time.Duration(stddev), time.Duration(want))
+	}
+
+	// The reservoir is a uniform sample of all requests, so its median
+	// estimates theirs
+	sorted := append([]time.Duration(nil), stats.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := float64(sorted[len(sorted)/2]) / float64(time.Microsecond)
+	if math.Abs(median-n/2) > n*0.03 {
+		t.Errorf("sampled median = %.0fµs, want about %dµs", median, n/2)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+const (
+	// mbapHeaderSize is the size of the Modbus application protocol header
+	mbapHeaderSize = 7
+	// mbapMaxLength is the maximum size of a Modbus TCP frame
+	mbapMaxLength = 260
+)
+
+// tlsHandler implements Modbus/TCP Security: MBAP frames carried over a TLS
+// connection. Framing is delegated to the goburrow TCP packager.
+type tlsHandler struct {
+	modbus.Packager
+	Address string
+	Timeout time.Duration
+	Config  *tls.Config
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// newTLSConfig builds the TLS configuration from the --tls-* flags
+func newTLSConfig(args *ModbusArgs) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         args.Server,
+		InsecureSkipVerify: args.TLSInsecure,
+	}
+	if args.TLSCA != "" {
+		pem, err := os.ReadFile(args.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificate: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", args.TLSCA)
+		}
+	}
+	if args.TLSCert != "" || args.TLSKey != "" {
+		if args.TLSCert == "" || args.TLSKey == "" {
+			return nil, errors.New("--tls-cert and --tls-key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(args.TLSCert, args.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// describeTLSError turns handshake failures into a message naming the certificate problem
+func describeTLSError(err error) error {
+	var verifyErr *tls.CertificateVerificationError
+	if errors.As(err, &verifyErr) {
+		subject := "unknown"
+		if len(verifyErr.UnverifiedCertificates) > 0 {
+			subject = verifyErr.UnverifiedCertificates[0].Subject.String()
+		}
+		var unknownAuthority x509.UnknownAuthorityError
+		var hostname x509.HostnameError
+		var invalid x509.CertificateInvalidError
+		switch {
+		case errors.As(verifyErr.Err, &unknownAuthority):
+			return fmt.Errorf("server certificate %q is signed by an unknown authority (use --tls-ca to trust it)", subject)
+		case errors.As(verifyErr.Err, &hostname):
+			return fmt.Errorf("server certificate %q is not valid for host %q: %v", subject, hostname.Host, hostname)
+		case errors.As(verifyErr.Err, &invalid):
+			return fmt.Errorf("server certificate %q is invalid: %v", subject, invalid)
+		}
+		return fmt.Errorf("server certificate %q failed verification: %v", subject, verifyErr.Err)
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return err
+	}
+	return fmt.Errorf("TLS handshake failed: %v", err)
+}
+
+// Send writes the request frame and reads one MBAP response frame
+func (mb *tlsHandler) Send(aduRequest []byte) ([]byte, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if err := mb.connect(); err != nil {
+		return nil, err
+	}
+	var deadline time.Time
+	if mb.Timeout > 0 {
+		deadline = time.Now().Add(mb.Timeout)
+	}
+	if err := mb.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err := mb.conn.Write(aduRequest); err != nil {
+		return nil, err
+	}
+
+	var data [mbapMaxLength]byte
+	if _, err := io.ReadFull(mb.conn, data[:mbapHeaderSize]); err != nil {
+		return nil, err
+	}
+	// The length field counts the unit id, which is part of the header
+	length := int(binary.BigEndian.Uint16(data[4:]))
+	if length <= 1 || length > mbapMaxLength-mbapHeaderSize+1 {
+		return nil, fmt.Errorf("modbus: length in response header '%v' is out of range", length)
+	}
+	length += mbapHeaderSize - 1
+	if _, err := io.ReadFull(mb.conn, data[mbapHeaderSize:length]); err != nil {
+		return nil, err
+	}
+	return data[:length], nil
+}
+
+// Connect dials the server and completes the TLS handshake if not already connected
+func (mb *tlsHandler) Connect() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	return mb.connect()
+}
+
+func (mb *tlsHandler) connect() error {
+	if mb.conn == nil {
+		dialer := &net.Dialer{Timeout: mb.Timeout}
+		conn, err := tls.DialWithDialer(dialer, "tcp", mb.Address, mb.Config)
+		if err != nil {
+			return err
+		}
+		mb.conn = conn
+	}
+	return nil
+}
+
+// Close closes the TLS connection
+func (mb *tlsHandler) Close() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.conn == nil {
+		return nil
+	}
+	err := mb.conn.Close()
+	mb.conn = nil
+	return err
+}
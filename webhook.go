@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// webhookQueueSize is the number of results that may wait to be posted
+	// before new ones are dropped
+	webhookQueueSize = 100
+	// webhookRetryDelay is the wait between attempts to post a result
+	webhookRetryDelay = time.Second
+	// webhookTimeout bounds each POST request
+	webhookTimeout = 5 * time.Second
+	// webhookDrainTimeout bounds the wait for queued results when the run ends
+	webhookDrainTimeout = 10 * time.Second
+)
+
+// webhookResult is the JSON posted for each result: the JSON output's
+// result with the server it came from
+type webhookResult struct {
+	Server string `json:"server"`
+	jsonResult
+}
+
+// webhook posts each result as JSON to a URL. Results are queued and posted
+// by a background goroutine so a slow receiver does not stall polling; when
+// the queue is full new results are dropped and counted.
+type webhook struct {
+	url      string
+	server   string
+	header   http.Header
+	attempts int
+	client   *http.Client
+	clock    clock
+	queue    chan []byte
+	done     chan struct{}
+	dropped  int
+	// failed is counted by the posting goroutine, which may still be running
+	// when close gives up waiting for it
+	failed atomic.Int64
+}
+
+// newWebhook starts posting results to --webhook-url with the
+// --webhook-header headers, trying each result up to --webhook-retries + 1
+// times, waiting on clock between attempts
+func newWebhook(args *ModbusArgs, clock clock) *webhook {
+	w := &webhook{
+		url:      args.WebhookURL,
+		server:   net.JoinHostPort(args.Server, strconv.FormatUint(uint64(args.Port), 10)),
+		header:   make(http.Header),
+		attempts: args.WebhookRetries + 1,
+		client:   &http.Client{Timeout: webhookTimeout},
+		clock:    clock,
+		queue:    make(chan []byte, webhookQueueSize),
+		done:     make(chan struct{}),
+	}
+	for _, header := range args.WebhookHeaders {
+		name, value, _ := strings.Cut(header, ":")
+		w.header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	w.header.Set("Content-Type", "application/json")
+	go w.run()
+	return w
+}
+
+// post queues result for posting without blocking
+func (w *webhook) post(result jsonResult) {
+	body, err := json.Marshal(webhookResult{Server: w.server, jsonResult: result})
+	if err != nil {
+		logErrorf("Error encoding webhook result: %v", err)
+		return
+	}
+	select {
+	case w.queue <- body:
+	default:
+		if w.dropped == 0 {
+			logWarnf("Webhook queue full, dropping results")
+		}
+		w.dropped++
+	}
+}
+
+// run posts queued results until the queue is closed
+func (w *webhook) run() {
+	defer close(w.done)
+	for body := range w.queue {
+		var err error
+		for attempt := 1; attempt <= w.attempts; attempt++ {
+			if err = w.send(body); err == nil {
+				break
+			}
+			if attempt < w.attempts {
+				logWarnf("Webhook post failed (attempt %d of %d): %v", attempt, w.attempts, err)
+				<-w.clock.After(webhookRetryDelay)
+			}
+		}
+		if err != nil {
+			w.failed.Add(1)
+			logErrorf("Error posting result to webhook after %d attempts: %v", w.attempts, err)
+		}
+	}
+}
+
+// send posts one result
+func (w *webhook) send(body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header = w.header.Clone()
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %s", response.Status)
+	}
+	return nil
+}
+
+// close waits (for a limited time) for queued results to be posted and
+// reports how many were dropped or could not be posted
+func (w *webhook) close() {
+	close(w.queue)
+	select {
+	case <-w.done:
+	case <-w.clock.After(webhookDrainTimeout):
+		logWarnf("Gave up waiting for %d queued webhook results", len(w.queue))
+	}
+	if failed := w.failed.Load(); w.dropped > 0 || failed > 0 {
+		logWarnf("Webhook: %d results dropped (queue full), %d failed to post", w.dropped, failed)
+	}
+}
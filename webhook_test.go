@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookCloseWhilePosting(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+	// The fake clock ends the drain wait at once, so close reports while the
+	// posting goroutine is still counting failures; -race checks the count
+	w := newWebhook(&ModbusArgs{WebhookURL: receiver.URL, WebhookRetries: 1}, newFakeClock())
+	for i := 0; i < 5; i++ {
+		w.post(jsonResult{Operation: "read_coils"})
+	}
+	w.close()
+	<-w.done
+	if failed := w.failed.Load(); failed != 5 {
+		t.Errorf("failed = %d, want 5", failed)
+	}
+}
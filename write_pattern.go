@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// writePatterns are the --pattern values that generate the values of write
+// operations, and the operations each one works with
+var writePatterns = map[string]map[string]bool{
+	"ramp": {"write_single_register": true, "write_multiple_registers": true},
+	"random": {
+		"write_single_register": true, "write_multiple_registers": true,
+		"write_single_coil": true, "write_multiple_coils": true,
+	},
+	"sine":     {"write_single_register": true, "write_multiple_registers": true},
+	"triangle": {"write_single_register": true, "write_multiple_registers": true},
+	"sawtooth": {"write_single_register": true, "write_multiple_registers": true},
+}
+
+// waveforms are the write patterns that sample a wave over time
+var waveforms = map[string]func(x float64) float64{
+	"sine": func(x float64) float64 { return math.Sin(2 * math.Pi * x) },
+	"triangle": func(x float64) float64 {
+		switch {
+		case x < 0.25:
+			return 4 * x
+		case x < 0.75:
+			return 2 - 4*x
+		}
+		return 4*x - 4
+	},
+	"sawtooth": func(x float64) float64 { return 2*x - 1 },
+}
+
+// writePattern generates the values written in each repeat of a write
+// operation with --pattern. Register values are in the signedness of
+// --unsigned and kept between --pattern-min and --pattern-max; coil values
+// are 0 or 1.
+//
+//	ramp:   --pattern-start, then --pattern-step more each cycle; past a bound
+//	        it wraps around to the other, or stays there with --pattern-clamp
+//	random: every value drawn afresh each cycle, from the --seed sequence
+//	sine, triangle, sawtooth: --midpoint plus --amplitude times the wave,
+//	        sampled at the time of the write and repeating every --period;
+//	        each register lags the one before by --phase degrees
+//
+// A wave is given in scaled units and written through --scale, --offset and
+// --type, clamped to what the registers can hold.
+type writePattern struct {
+	kind     string
+	min, max int64
+	step     int64
+	clamp    bool
+	random   *rand.Rand
+
+	wave                func(x float64) float64
+	amplitude, midpoint float64
+	period              time.Duration
+	phase               float64
+	clock               clock
+	started             time.Time
+	args                *ModbusArgs
+
+	next int64
+}
+
+// newWritePattern starts the --pattern of args, sampling waves on clock
+func newWritePattern(args *ModbusArgs, clock clock) *writePattern {
+	return &writePattern{
+		kind:   args.Pattern,
+		min:    args.PatternMin,
+		max:    args.PatternMax,
+		step:   args.PatternStep,
+		clamp:  args.PatternClamp,
+		random: rand.New(rand.NewSource(args.Seed)),
+
+		wave:      waveforms[args.Pattern],
+		amplitude: args.Amplitude,
+		midpoint:  args.Midpoint,
+		period:    args.Period,
+		phase:     args.Phase,
+		clock:     clock,
+		started:   clock.Now(),
+		args:      args,
+
+		next: args.PatternStart,
+	}
+}
+
+// registerRange returns the values a register holds in the selected signedness
+func registerRange(unsigned bool) (int64, int64) {
+	if unsigned {
+		return 0, 65535
+	}
+	return -32768, 32767
+}
+
+// datatypeRange returns the values an integer datatype holds, or false for
+// the float types, which need no clamping
+func datatypeRange(datatype string) (float64, float64, bool) {
+	switch datatype {
+	case "int16":
+		return math.MinInt16, math.MaxInt16, true
+	case "uint16":
+		return 0, math.MaxUint16, true
+	case "bcd":
+		return 0, 9999, true
+	case "int32":
+		return math.MinInt32, math.MaxInt32, true
+	case "uint32":
+		return 0, math.MaxUint32, true
+	case "int64":
+		return math.MinInt64, math.MaxInt64, true
+	case "uint64":
+		return 0, math.MaxUint64, true
+	}
+	return 0, 0, false
+}
+
+// validatePattern checks the --pattern flags of a write and fills in the
+// default bounds, the whole register range or 0 and 1 for coils
+func validatePattern(args *ModbusArgs, minChanged, maxChanged bool) error {
+	if !writePatterns[args.Pattern][args.Operation] {
+		return fmt.Errorf("--pattern %s does not work with %s", args.Pattern, args.Operation)
+	}
+	if waveforms[args.Pattern] != nil {
+		if args.Period <= 0 {
+			return fmt.Errorf("--period must be positive")
+		}
+		if args.Type == "string" {
+			return fmt.Errorf("--pattern %s cannot write --type string", args.Pattern)
+		}
+		if args.Type != "" {
+			if minChanged || maxChanged {
+				return fmt.Errorf("--pattern-min and --pattern-max only bound 16-bit register values, not --type %s", args.Type)
+			}
+			return nil
+		}
+		low, high := registerRange(args.Unsigned)
+		if !minChanged {
+			args.PatternMin = low
+		}
+		if !maxChanged {
+			args.PatternMax = high
+		}
+		if args.PatternMin < low || args.PatternMax > high || args.PatternMin > args.PatternMax {
+			return fmt.Errorf("Invalid pattern bounds %d to %d: they must lie within %d to %d", args.PatternMin, args.PatternMax, low, high)
+		}
+		return nil
+	}
+	if args.Operation == "write_single_coil" || args.Operation == "write_multiple_coils" {
+		if minChanged || maxChanged {
+			return fmt.Errorf("--pattern-min and --pattern-max do not apply to coils")
+		}
+		args.PatternMin, args.PatternMax = 0, 1
+		return nil
+	}
+	if args.Type != "" {
+		return fmt.Errorf("--pattern %s writes 16-bit registers; use --unsigned instead of --type", args.Pattern)
+	}
+	if args.Scale != 1 || args.Offset != 0 {
+		return fmt.Errorf("--pattern %s generates register values, which --scale and --offset do not apply to", args.Pattern)
+	}
+	low, high := registerRange(args.Unsigned)
+	if !minChanged {
+		args.PatternMin = low
+	}
+	if !maxChanged {
+		args.PatternMax = high
+	}
+	if args.PatternMin < low || args.PatternMax > high || args.PatternMin > args.PatternMax {
+		return fmt.Errorf("Invalid pattern bounds %d to %d: they must lie within %d to %d", args.PatternMin, args.PatternMax, low, high)
+	}
+	if args.Pattern == "ramp" {
+		if args.PatternStep == 0 {
+			return fmt.Errorf("--pattern-step must not be 0")
+		}
+		if args.PatternStart < args.PatternMin || args.PatternStart > args.PatternMax {
+			return fmt.Errorf("--pattern-start %d is outside %d to %d", args.PatternStart, args.PatternMin, args.PatternMax)
+		}
+	}
+	return nil
+}
+
+// values returns the count values written in this cycle and moves on to
+// the next cycle. A ramp writes the same value to every register.
+func (p *writePattern) values(count int) []int64 {
+	values := make([]int64, count)
+	for i := range values {
+		switch {
+		case p.kind == "random":
+			values[i] = p.min + p.random.Int63n(p.max-p.min+1)
+		case p.wave != nil:
+			raw := math.Round(p.sample(i))
+			values[i] = int64(math.Max(float64(p.min), math.Min(float64(p.max), raw)))
+		default:
+			values[i] = p.next
+		}
+	}
+	p.next = p.advance(p.next)
+	return values
+}
+
+// sample returns the wave for register i at the current time, converted from
+// scaled units to a raw value
+func (p *writePattern) sample(i int) float64 {
+	x := float64(p.clock.Now().Sub(p.started)) / float64(p.period)
+	x -= float64(i) * p.phase / 360
+	x -= math.Floor(x)
+	value := p.midpoint + p.amplitude*p.wave(x)
+	return removeScale(value-p.args.Offset, p.args.Scale)
+}
+
+// texts returns the count wave values of --type written in this cycle, as
+// write value texts. Integer types are rounded and clamped to their range.
+func (p *writePattern) texts(count int) []string {
+	texts := make([]string, count)
+	for i := range texts {
+		raw := p.sample(i)
+		if low, high, ok := datatypeRange(p.args.Type); ok {
+			raw = math.Max(low, math.Min(high, math.Round(raw)))
+			texts[i] = strconv.FormatFloat(raw, 'f', 0, 64)
+		} else {
+			texts[i] = strconv.FormatFloat(raw, 'g', -1, 64)
+		}
+	}
+	return texts
+}
+
+// advance returns the ramp value after value
+func (p *writePattern) advance(value int64) int64 {
+	next := value + p.step
+	if next >= p.min && next <= p.max {
+		return next
+	}
+	if p.clamp {
+		if next < p.min {
+			return p.min
+		}
+		return p.max
+	}
+	// Wrap around the range, as a register overflows
+	span := p.max - p.min + 1
+	return p.min + ((next-p.min)%span+span)%span
+}
+
+// registerWords converts pattern values to the register values sent
+func registerWords(values []int64) []uint16 {
+	words := make([]uint16, len(values))
+	for i, value := range values {
+		words[i] = uint16(value)
+	}
+	return words
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/goburrow/modbus"
+)
+
+const (
+	// writeSingle writes registers one at a time with FC06
+	writeSingle = "single"
+	// writeMultiple writes registers in one FC16 request
+	writeMultiple = "multiple"
+)
+
+// isIllegalFunction reports whether err is an Illegal Function exception response
+func isIllegalFunction(err error) bool {
+	var modbusErr *modbus.ModbusError
+	return errors.As(err, &modbusErr) && modbusErr.ExceptionCode == modbus.ExceptionCodeIllegalFunction
+}
+
+// writeRegisters writes data, already in device byte order, from address
+// using --write-strategy. preferred is the strategy the operation maps to
+// naturally; with auto it is tried first and, if the device answers with
+// Illegal Function, the other strategy is tried once. The strategy that works
+// is kept for the rest of the session.
+func (s *session) writeRegisters(address uint16, data []byte, preferred string) error {
+	strategy := s.writeStrategy
+	if strategy == "" && s.args.WriteStrategy != "auto" {
+		strategy = s.args.WriteStrategy
+	}
+	if strategy != "" {
+		return s.writeRegistersWith(strategy, address, data)
+	}
+
+	err := s.writeRegistersWith(preferred, address, data)
+	if isIllegalFunction(err) {
+		fallback := writeMultiple
+		if preferred == writeMultiple {
+			fallback = writeSingle
+		}
+		logWarnf("Device rejected %s register writes, falling back to %s", preferred, fallback)
+		if err = s.writeRegistersWith(fallback, address, data); err == nil {
+			s.writeStrategy = fallback
+		}
+	} else if err == nil {
+		s.writeStrategy = preferred
+	}
+	return err
+}
+
+// writeChunkRegisters is the most registers written by one FC16 request:
+// maxWriteRegisters, rounded down to whole values of --type so that no value
+// is split between two requests
+func writeChunkRegisters(args *ModbusArgs) int {
+	if args.Type == "" || args.Type == "string" {
+		return maxWriteRegisters
+	}
+	return maxWriteRegisters - maxWriteRegisters%datatypeRegisters(args.Type)
+}
+
+// writeRegistersWith writes data from address using one strategy. The single
+// strategy writes registers in address order and stops at the first failure.
+// The multiple strategy sends more registers than one FC16 request can carry
+// as several requests at increasing addresses, stopping at the first failure.
+func (s *session) writeRegistersWith(strategy string, address uint16, data []byte) error {
+	count := len(data) / registerSize
+	if strategy == writeMultiple {
+		chunk := writeChunkRegisters(s.args)
+		chunks := (count + chunk - 1) / chunk
+		if s.args.Verbose {
+			logDebugf("Write strategy: multiple (FC16, %d register(s) at %d in %d request(s))", count, address, chunks)
+		}
+		for written := 0; written < count; written += chunk {
+			n := count - written
+			if n > chunk {
+				n = chunk
+			}
+			first := address + uint16(written)
+			if _, err := s.client.WriteMultipleRegisters(first, uint16(n), data[written*registerSize:(written+n)*registerSize]); err != nil {
+				if written == 0 {
+					return err
+				}
+				return fmt.Errorf("registers %d to %d (%d of %d written): %w", first, int(first)+n-1, written, count, describeException(err))
+			}
+			if chunks > 1 {
+				logInfof("Wrote registers %d to %d (%d of %d)", first, int(first)+n-1, written+n, count)
+			}
+		}
+		if chunks > 1 {
+			logInfof("Wrote %d registers in %d requests", count, chunks)
+		}
+		return nil
+	}
+
+	if s.args.Verbose {
+		logDebugf("Write strategy: single (FC06, %d request(s) from %d)", count, address)
+	}
+	for i := 0; i < count; i++ {
+		value := binary.BigEndian.Uint16(data[i*registerSize:])
+		if _, err := s.client.WriteSingleRegister(address+uint16(i), value); err != nil {
+			if count == 1 {
+				return err
+			}
+			return fmt.Errorf("register %d (%d of %d written): %w", address+uint16(i), i, count, describeException(err))
+		}
+	}
+	return nil
+}